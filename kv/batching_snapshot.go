@@ -0,0 +1,101 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// DefaultReadBatchMaxSize is the max number of keys in a read batch of the
+// Snapshot wrapped by the ReadBatchWindow option.
+const DefaultReadBatchMaxSize = 128
+
+// batchingSnapshot is a Snapshot which coalesces the concurrent Gets issued
+// within a window into one BatchGet. It's safe for concurrent use if the
+// wrapped Snapshot is.
+type batchingSnapshot struct {
+	Snapshot
+	window  time.Duration
+	maxSize int
+
+	mu      sync.Mutex
+	pending *readBatch
+}
+
+// readBatch is a batch of keys which are read by one BatchGet.
+type readBatch struct {
+	keys   []Key
+	timer  *time.Timer
+	done   chan struct{}
+	values map[string][]byte
+	err    error
+}
+
+// NewBatchingSnapshot creates a Snapshot whose Get waits up to window for
+// other Gets, then reads all the keys by one BatchGet of snapshot. A batch is
+// sent at once when it has maxSize keys.
+func NewBatchingSnapshot(snapshot Snapshot, window time.Duration, maxSize int) Snapshot {
+	return &batchingSnapshot{
+		Snapshot: snapshot,
+		window:   window,
+		maxSize:  maxSize,
+	}
+}
+
+// Get implements the Retriever Get interface.
+func (s *batchingSnapshot) Get(k Key) ([]byte, error) {
+	s.mu.Lock()
+	b := s.pending
+	if b == nil {
+		b = &readBatch{done: make(chan struct{})}
+		b.timer = time.AfterFunc(s.window, func() { s.flush(b) })
+		s.pending = b
+	}
+	b.keys = append(b.keys, k)
+	full := len(b.keys) >= s.maxSize
+	if full {
+		s.pending = nil
+	}
+	s.mu.Unlock()
+
+	// If the timer has fired, the batch is sent by the timer.
+	if full && b.timer.Stop() {
+		s.flush(b)
+	}
+	<-b.done
+	if b.err != nil {
+		return nil, errors.Trace(b.err)
+	}
+	v, ok := b.values[string(k)]
+	if !ok || len(v) == 0 {
+		return nil, errors.Trace(ErrNotExist)
+	}
+	return v, nil
+}
+
+// flush sends b by BatchGet, it's called once for each batch, either by the
+// timer or by the Get which fills the batch.
+func (s *batchingSnapshot) flush(b *readBatch) {
+	s.mu.Lock()
+	if s.pending == b {
+		s.pending = nil
+	}
+	s.mu.Unlock()
+
+	b.values, b.err = s.Snapshot.BatchGet(b.keys)
+	close(b.done)
+}
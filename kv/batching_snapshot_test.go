@@ -0,0 +1,95 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+var _ = Suite(&testBatchingSnapshotSuite{})
+
+type testBatchingSnapshotSuite struct{}
+
+// countSnapshot is a Snapshot which counts the keys passed to BatchGet, it's
+// safe for concurrent use.
+type countSnapshot struct {
+	Snapshot
+	mu      sync.Mutex
+	batches []int
+}
+
+func (s *countSnapshot) BatchGet(keys []Key) (map[string][]byte, error) {
+	s.mu.Lock()
+	s.batches = append(s.batches, len(keys))
+	s.mu.Unlock()
+	return s.Snapshot.BatchGet(keys)
+}
+
+func (s *testBatchingSnapshotSuite) TestCoalesce(c *C) {
+	defer testleak.AfterTest(c)()
+	store := NewMemDbBuffer()
+	for i := 0; i < 10; i++ {
+		store.Set(encodeInt(i), encodeInt(i))
+	}
+	snap := &countSnapshot{Snapshot: &mockSnapshot{store}}
+	us := NewUnionStore(snap)
+	us.SetOption(ReadBatchWindow, 50*time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			val, err := us.Get(encodeInt(i))
+			if i < 10 {
+				c.Check(err, IsNil)
+				c.Check(val, BytesEquals, encodeInt(i))
+			} else {
+				c.Check(IsErrNotFound(err), IsTrue)
+			}
+		}(i)
+	}
+	wg.Wait()
+	c.Assert(snap.batches, DeepEquals, []int{20})
+
+	// Gets read the snapshot directly after the option is deleted.
+	us.DelOption(ReadBatchWindow)
+	_, err := us.Get(encodeInt(1))
+	c.Assert(err, IsNil)
+	c.Assert(snap.batches, HasLen, 1)
+}
+
+func (s *testBatchingSnapshotSuite) TestMaxSize(c *C) {
+	defer testleak.AfterTest(c)()
+	snap := &countSnapshot{Snapshot: &mockSnapshot{NewMemDbBuffer()}}
+	// The window is long enough that only full batches are sent in time.
+	bs := NewBatchingSnapshot(snap, time.Minute, 5)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := bs.Get(encodeInt(i))
+			c.Check(IsErrNotFound(err), IsTrue)
+		}(i)
+	}
+	wg.Wait()
+	c.Assert(time.Since(start) < time.Minute, IsTrue)
+	c.Assert(snap.batches, DeepEquals, []int{5, 5, 5})
+}
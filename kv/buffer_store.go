@@ -14,7 +14,11 @@
 package kv
 
 import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
 	"github.com/juju/errors"
+	goctx "golang.org/x/net/context"
 )
 
 // BufferStore wraps a Retriever for read and a MemBuffer for buffered write.
@@ -27,13 +31,23 @@ import (
 type BufferStore struct {
 	MemBuffer
 	r Retriever
+
+	// suspended is set by SuspendSizeTracking, the size and length at the time
+	// are reported until ResumeSizeTracking.
+	suspended     bool
+	suspendedSize int
+	suspendedLen  int
 }
 
 // NewBufferStore creates a BufferStore using r for read.
 func NewBufferStore(r Retriever) *BufferStore {
+	return newBufferStoreWithFactory(r, DefaultMemBufferFactory)
+}
+
+func newBufferStoreWithFactory(r Retriever, factory MemBufferFactory) *BufferStore {
 	return &BufferStore{
 		r:         r,
-		MemBuffer: &lazyMemBuffer{},
+		MemBuffer: &lazyMemBuffer{factory: factory},
 	}
 }
 
@@ -78,6 +92,12 @@ func (s *BufferStore) SeekReverse(k Key) (Iterator, error) {
 	return newUnionIter(bufferIt, retrieverIt, true)
 }
 
+// SeekLast creates a reversed Iterator positioned at the greatest key in the
+// buffer and the Retriever.
+func (s *BufferStore) SeekLast() (Iterator, error) {
+	return s.SeekReverse(nil)
+}
+
 // WalkBuffer iterates all buffered kv pairs.
 func (s *BufferStore) WalkBuffer(f func(k Key, v []byte) error) error {
 	iter, err := s.MemBuffer.Seek(nil)
@@ -97,6 +117,341 @@ func (s *BufferStore) WalkBuffer(f func(k Key, v []byte) error) error {
 	return nil
 }
 
+// walkCheckInterval is the number of kv pairs visited between two checks
+// of the context in WalkBufferContext.
+const walkCheckInterval = 256
+
+// WalkBufferContext iterates all buffered kv pairs like WalkBuffer, but stops
+// and returns the error of ctx once ctx is done. ctx is checked every
+// walkCheckInterval pairs.
+func (s *BufferStore) WalkBufferContext(ctx goctx.Context, f func(k Key, v []byte) error) error {
+	iter, err := s.MemBuffer.Seek(nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer iter.Close()
+	for cnt := 0; iter.Valid(); cnt++ {
+		if cnt%walkCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if err = f(iter.Key(), iter.Value()); err != nil {
+			return errors.Trace(err)
+		}
+		if err = iter.Next(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// WalkBufferRangeLimit iterates the buffered kv pairs in range [start, end),
+// and stops after limit pairs are visited. A nil end means no upper bound.
+// A limit of 0 or negative means no limit.
+func (s *BufferStore) WalkBufferRangeLimit(start, end Key, limit int, f func(k Key, v []byte) error) error {
+	it, err := s.MemBuffer.Seek(start)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	iter := newUpperBoundIter(it, end)
+	defer iter.Close()
+	for cnt := 0; iter.Valid() && (limit <= 0 || cnt < limit); cnt++ {
+		if err = f(iter.Key(), iter.Value()); err != nil {
+			return errors.Trace(err)
+		}
+		if err = iter.Next(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// WalkLargeValues iterates the buffered keys whose values are at least
+// minBytes long, f is called with the value size instead of the value. The
+// tombstones have a size of 0.
+func (s *BufferStore) WalkLargeValues(minBytes int, f func(k Key, size int) error) error {
+	return s.WalkBuffer(func(k Key, v []byte) error {
+		if len(v) < minBytes {
+			return nil
+		}
+		return f(k, len(v))
+	})
+}
+
+// SplitBuffer partitions the buffered kv pairs at the boundaries into
+// len(boundaries)+1 new MemBuffers, so they can be committed concurrently.
+// Partition i holds the keys in [boundaries[i-1], boundaries[i]), the first
+// and the last partitions are unbounded below and above. Tombstones are kept.
+// The boundaries must be ascending, otherwise ErrKeyOutOfOrder is returned.
+func (s *BufferStore) SplitBuffer(boundaries []Key) ([]MemBuffer, error) {
+	for i := 1; i < len(boundaries); i++ {
+		if boundaries[i].Cmp(boundaries[i-1]) < 0 {
+			return nil, ErrKeyOutOfOrder.Gen("boundary %q is less than %q", boundaries[i], boundaries[i-1])
+		}
+	}
+	parts := make([]MemBuffer, len(boundaries)+1)
+	for i := range parts {
+		parts[i] = NewMemDbBuffer()
+	}
+	i := 0
+	err := s.WalkBuffer(func(k Key, v []byte) error {
+		for i < len(boundaries) && k.Cmp(boundaries[i]) >= 0 {
+			i++
+		}
+		if len(v) == 0 {
+			return errors.Trace(parts[i].Delete(k))
+		}
+		return errors.Trace(parts[i].Set(k, v))
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return parts, nil
+}
+
+// RewriteKeys replaces the key of each buffered kv pair by mapping(k), the
+// pairs for which mapping returns false are dropped. The values and the
+// tombstones are kept, the metas and TTLs of the pairs are dropped. If two
+// keys are mapped to the same key, ErrKeyExists is returned and the buffer
+// isn't changed. If a write of the new pairs fails, the old pairs are
+// written back and the error is returned.
+func (s *BufferStore) RewriteKeys(mapping func(old Key) (Key, bool)) error {
+	return s.rewriteKeys(mapping, nil)
+}
+
+// rewriteKeys is RewriteKeys which calls check with each new pair before the
+// buffer is changed, an error of check fails the rewrite.
+func (s *BufferStore) rewriteKeys(mapping func(old Key) (Key, bool), check func(k Key, v []byte) error) error {
+	r, ok := s.MemBuffer.(entryRemover)
+	if !ok {
+		return errors.Trace(ErrNotImplemented)
+	}
+	var olds, pairs []KeyValue
+	mapped := make(map[string]Key)
+	err := s.WalkBuffer(func(k Key, v []byte) error {
+		olds = append(olds, KeyValue{Key: k.Clone(), Value: append([]byte(nil), v...)})
+		newKey, ok := mapping(k)
+		if !ok {
+			return nil
+		}
+		if old, ok := mapped[string(newKey)]; ok {
+			return ErrKeyExists.Gen("both %q and %q are rewritten to %q", old, k, newKey)
+		}
+		if check != nil {
+			if err := check(newKey, v); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		mapped[string(newKey)] = olds[len(olds)-1].Key
+		pairs = append(pairs, KeyValue{Key: newKey.Clone(), Value: olds[len(olds)-1].Value})
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = s.replacePairs(r, olds, pairs); err != nil {
+		if e := s.replacePairs(r, pairs, olds); e != nil {
+			log.Errorf("[kv] failed to restore the buffer after a failed key rewrite: %v", e)
+		}
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// replacePairs removes the keys of olds from the buffer, then writes pairs.
+func (s *BufferStore) replacePairs(r entryRemover, olds, pairs []KeyValue) error {
+	for _, p := range olds {
+		if err := r.remove(p.Key); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	for _, p := range pairs {
+		var err error
+		if len(p.Value) == 0 {
+			err = s.MemBuffer.Delete(p.Key)
+		} else {
+			err = s.MemBuffer.Set(p.Key, p.Value)
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// insertionTracker is implemented by the MemBuffers which can track the
+// order of the writes.
+type insertionTracker interface {
+	// trackInsertion starts tracking the order of the writes.
+	trackInsertion()
+	// keysByInsertion returns the buffered keys in the order of their latest
+	// writes, ok is false if the order isn't tracked.
+	keysByInsertion() (keys []Key, ok bool)
+}
+
+// TrackInsertionOrder makes the buffer record the order of the writes, which
+// is required by WalkBufferByInsertion. It's off by default for the memory
+// it takes per key, and should be called before any write since the earlier
+// writes aren't ordered.
+func (s *BufferStore) TrackInsertionOrder() {
+	if t, ok := s.MemBuffer.(insertionTracker); ok {
+		t.trackInsertion()
+	}
+}
+
+// WalkBufferByInsertion iterates all buffered kv pairs in the order they are
+// written, or in the reverse order if reverse is true. An overwritten key is
+// positioned by its latest write. It fails if TrackInsertionOrder is not
+// called.
+func (s *BufferStore) WalkBufferByInsertion(reverse bool, f func(k Key, v []byte) error) error {
+	t, ok := s.MemBuffer.(insertionTracker)
+	if !ok {
+		return errors.Trace(ErrNotImplemented)
+	}
+	keys, ok := t.keysByInsertion()
+	if !ok {
+		return errors.New("insertion order is not tracked")
+	}
+	for i := range keys {
+		k := keys[i]
+		if reverse {
+			k = keys[len(keys)-1-i]
+		}
+		v, err := s.MemBuffer.Get(k)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err = f(k, v); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// entryMetaHolder is implemented by the MemBuffers which can attach meta to
+// the entries.
+type entryMetaHolder interface {
+	setWithMeta(k Key, v []byte, meta []byte) error
+	meta(k Key) []byte
+	setWithTTL(k Key, v []byte, ttl time.Duration) error
+	ttl(k Key) time.Duration
+}
+
+// SetWithMeta sets k and attaches meta to the write. The meta is only kept in
+// the buffer and dropped by the next write of k.
+func (s *BufferStore) SetWithMeta(k Key, v []byte, meta []byte) error {
+	h, ok := s.MemBuffer.(entryMetaHolder)
+	if !ok {
+		return errors.Trace(ErrNotImplemented)
+	}
+	return errors.Trace(h.setWithMeta(k, v, meta))
+}
+
+// GetMeta returns the meta attached to the buffered write of k, or nil.
+func (s *BufferStore) GetMeta(k Key) []byte {
+	if h, ok := s.MemBuffer.(entryMetaHolder); ok {
+		return h.meta(k)
+	}
+	return nil
+}
+
+// SetWithTTL sets k and attaches ttl to the write. A ttl of 0 or negative
+// means no TTL. The TTL is only kept in the buffer and dropped by the next
+// write of k.
+func (s *BufferStore) SetWithTTL(k Key, v []byte, ttl time.Duration) error {
+	h, ok := s.MemBuffer.(entryMetaHolder)
+	if !ok {
+		return errors.Trace(ErrNotImplemented)
+	}
+	return errors.Trace(h.setWithTTL(k, v, ttl))
+}
+
+// GetTTL returns the TTL attached to the buffered write of k, or 0.
+func (s *BufferStore) GetTTL(k Key) time.Duration {
+	if h, ok := s.MemBuffer.(entryMetaHolder); ok {
+		return h.ttl(k)
+	}
+	return 0
+}
+
+// WalkBufferWithMeta iterates all buffered kv pairs with their meta.
+func (s *BufferStore) WalkBufferWithMeta(f func(k Key, v []byte, meta []byte) error) error {
+	return s.WalkBuffer(func(k Key, v []byte) error {
+		return f(k, v, s.GetMeta(k))
+	})
+}
+
+// Reserve reserves room in the buffer for a batch of writes, see Reserver.
+func (s *BufferStore) Reserve(entries int, bytes int) (*Reservation, error) {
+	r, ok := s.MemBuffer.(Reserver)
+	if !ok {
+		return nil, errors.Trace(ErrNotImplemented)
+	}
+	res, err := r.Reserve(entries, bytes)
+	return res, errors.Trace(err)
+}
+
+// UndoKey drops the buffered write (set or delete) of k, so that k is read
+// from the Retriever again. It's a no-op if k is not buffered.
+func (s *BufferStore) UndoKey(k Key) error {
+	r, ok := s.MemBuffer.(entryRemover)
+	if !ok {
+		return errors.Trace(ErrNotImplemented)
+	}
+	return errors.Trace(r.remove(k))
+}
+
+// limitSuspender is implemented by the MemBuffers whose size and length
+// limits can be suspended.
+type limitSuspender interface {
+	suspendLimits(suspend bool)
+}
+
+// SuspendSizeTracking makes Size and Len report the values at the time it's
+// called, so the internal writes that temporarily buffer entries don't trip
+// the transaction size limits. The size and length limits of the MemBuffer
+// are suspended too, while the entry size limit still applies. The suspended
+// writes still consume memory. It's a no-op if the tracking is already
+// suspended.
+func (s *BufferStore) SuspendSizeTracking() {
+	if s.suspended {
+		return
+	}
+	s.suspended = true
+	s.suspendedSize, s.suspendedLen = s.MemBuffer.Size(), s.MemBuffer.Len()
+	if l, ok := s.MemBuffer.(limitSuspender); ok {
+		l.suspendLimits(true)
+	}
+}
+
+// ResumeSizeTracking makes Size and Len report the buffer again, the entries
+// written while suspended and still buffered are counted from then on. The
+// limits of the MemBuffer apply again, so if the entries left exceed them,
+// the later writes fail.
+func (s *BufferStore) ResumeSizeTracking() {
+	s.suspended = false
+	if l, ok := s.MemBuffer.(limitSuspender); ok {
+		l.suspendLimits(false)
+	}
+}
+
+// Size implements the MemBuffer Size interface.
+func (s *BufferStore) Size() int {
+	if s.suspended {
+		return s.suspendedSize
+	}
+	return s.MemBuffer.Size()
+}
+
+// Len implements the MemBuffer Len interface.
+func (s *BufferStore) Len() int {
+	if s.suspended {
+		return s.suspendedLen
+	}
+	return s.MemBuffer.Len()
+}
+
 // SaveTo saves all buffered kv pairs into a Mutator.
 func (s *BufferStore) SaveTo(m Mutator) error {
 	err := s.WalkBuffer(func(k Key, v []byte) error {
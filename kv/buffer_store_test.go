@@ -16,8 +16,11 @@ package kv
 import (
 	"bytes"
 	"fmt"
+	"sync/atomic"
 
+	"github.com/juju/errors"
 	. "github.com/pingcap/check"
+	goctx "golang.org/x/net/context"
 )
 
 type testBufferStoreSuite struct{}
@@ -61,3 +64,295 @@ func (s testBufferStoreSuite) TestSaveTo(c *C) {
 		iter.Next()
 	}
 }
+
+func (s testBufferStoreSuite) TestUndoKey(c *C) {
+	snap := NewMemDbBuffer()
+	snap.Set(Key("a"), []byte("1"))
+	bs := NewBufferStore(&mockSnapshot{snap})
+
+	c.Check(bs.Set(Key("a"), []byte("2")), IsNil)
+	c.Check(bs.Delete(Key("b")), IsNil)
+	c.Check(bs.UndoKey(Key("a")), IsNil)
+	c.Check(bs.UndoKey(Key("b")), IsNil)
+	c.Check(bs.UndoKey(Key("c")), IsNil)
+	c.Check(bs.Len(), Equals, 0)
+	c.Check(bs.Size(), Equals, 0)
+
+	value, err := bs.Get(Key("a"))
+	c.Check(err, IsNil)
+	c.Check(value, BytesEquals, []byte("1"))
+}
+
+func (s testBufferStoreSuite) TestWalkBufferRangeLimit(c *C) {
+	bs := NewBufferStore(&mockSnapshot{NewMemDbBuffer()})
+	for i := 0; i < 10; i++ {
+		c.Check(bs.Set(encodeInt(i), encodeInt(i)), IsNil)
+	}
+	c.Check(bs.Delete(encodeInt(5)), IsNil)
+
+	walk := func(start, end Key, limit int) []int {
+		var visited []int
+		err := bs.WalkBufferRangeLimit(start, end, limit, func(k Key, v []byte) error {
+			visited = append(visited, decodeInt(k))
+			return nil
+		})
+		c.Check(err, IsNil)
+		return visited
+	}
+	// The range [2, 7) has 5 entries including the tombstone of 5.
+	c.Check(walk(encodeInt(2), encodeInt(7), 3), DeepEquals, []int{2, 3, 4})
+	c.Check(walk(encodeInt(2), encodeInt(7), 5), DeepEquals, []int{2, 3, 4, 5, 6})
+	c.Check(walk(encodeInt(2), encodeInt(7), 10), DeepEquals, []int{2, 3, 4, 5, 6})
+	c.Check(walk(encodeInt(2), encodeInt(7), 0), DeepEquals, []int{2, 3, 4, 5, 6})
+	c.Check(walk(encodeInt(8), nil, -1), DeepEquals, []int{8, 9})
+	c.Check(walk(encodeInt(20), nil, 1), HasLen, 0)
+
+	cnt := 0
+	err := bs.WalkBufferRangeLimit(nil, nil, 5, func(k Key, v []byte) error {
+		cnt++
+		if cnt == 2 {
+			return ErrNotImplemented
+		}
+		return nil
+	})
+	c.Check(ErrNotImplemented.Equal(err), IsTrue)
+	c.Check(cnt, Equals, 2)
+}
+
+func (s testBufferStoreSuite) TestSplitBuffer(c *C) {
+	bs := NewBufferStore(&mockSnapshot{NewMemDbBuffer()})
+	for i := 0; i < 10; i += 2 {
+		c.Check(bs.Set(encodeInt(i), encodeInt(i)), IsNil)
+	}
+	c.Check(bs.Delete(encodeInt(5)), IsNil)
+
+	split := func(boundaries ...int) [][]string {
+		var keys []Key
+		for _, b := range boundaries {
+			keys = append(keys, encodeInt(b))
+		}
+		parts, err := bs.SplitBuffer(keys)
+		c.Assert(err, IsNil)
+		c.Assert(parts, HasLen, len(boundaries)+1)
+		var result [][]string
+		for _, p := range parts {
+			part := []string{}
+			iter, err := p.Seek(nil)
+			c.Assert(err, IsNil)
+			for ; iter.Valid(); iter.Next() {
+				part = append(part, fmt.Sprintf("%d=%s", decodeInt(iter.Key()), iter.Value()))
+			}
+			iter.Close()
+			result = append(result, part)
+		}
+		return result
+	}
+	// Boundaries on the keys, between the keys and outside the key range.
+	c.Check(split(4, 6), DeepEquals, [][]string{
+		{"0=0000000000", "2=0000000002"},
+		{"4=0000000004", "5="},
+		{"6=0000000006", "8=0000000008"},
+	})
+	c.Check(split(3, 7), DeepEquals, [][]string{
+		{"0=0000000000", "2=0000000002"},
+		{"4=0000000004", "5=", "6=0000000006"},
+		{"8=0000000008"},
+	})
+	c.Check(split(-1, 20), DeepEquals, [][]string{
+		{},
+		{"0=0000000000", "2=0000000002", "4=0000000004", "5=", "6=0000000006", "8=0000000008"},
+		{},
+	})
+	c.Check(split(), HasLen, 1)
+
+	_, err := bs.SplitBuffer([]Key{encodeInt(6), encodeInt(4)})
+	c.Check(ErrKeyOutOfOrder.Equal(err), IsTrue)
+}
+
+func (s testBufferStoreSuite) TestSuspendSizeTracking(c *C) {
+	bs := NewBufferStore(&mockSnapshot{NewMemDbBuffer()})
+	c.Check(bs.Set(Key("a"), []byte("1")), IsNil)
+	c.Check(bs.Size(), Equals, 2)
+	c.Check(bs.Len(), Equals, 1)
+
+	bs.SuspendSizeTracking()
+	c.Check(bs.Set(Key("tmp1"), []byte("xxxx")), IsNil)
+	c.Check(bs.Set(Key("tmp2"), []byte("xxxx")), IsNil)
+	bs.SuspendSizeTracking()
+	c.Check(bs.Size(), Equals, 2)
+	c.Check(bs.Len(), Equals, 1)
+	c.Check(bs.UndoKey(Key("tmp1")), IsNil)
+	c.Check(bs.UndoKey(Key("tmp2")), IsNil)
+	c.Check(bs.Set(Key("b"), []byte("22")), IsNil)
+	c.Check(bs.Size(), Equals, 2)
+	bs.ResumeSizeTracking()
+
+	// The entry left by the suspended writes is counted after resuming.
+	c.Check(bs.Size(), Equals, 5)
+	c.Check(bs.Len(), Equals, 2)
+	c.Check(bs.Set(Key("c"), []byte("3")), IsNil)
+	c.Check(bs.Size(), Equals, 7)
+	c.Check(bs.Len(), Equals, 3)
+
+	// The suspended writes don't fail by the buffer limits.
+	bs = NewBufferStore(&mockSnapshot{NewMemDbBuffer()})
+	defer func(limit uint64) {
+		atomic.StoreUint64(&TxnEntryCountLimit, limit)
+	}(atomic.LoadUint64(&TxnEntryCountLimit))
+	atomic.StoreUint64(&TxnEntryCountLimit, 2)
+	c.Check(bs.Set(Key("a"), []byte("1")), IsNil)
+	bs.SuspendSizeTracking()
+	for i := 0; i < 3; i++ {
+		c.Check(bs.Set(Key{'t', byte(i)}, []byte("1")), IsNil)
+	}
+	for i := 0; i < 3; i++ {
+		c.Check(bs.UndoKey(Key{'t', byte(i)}), IsNil)
+	}
+	bs.ResumeSizeTracking()
+	c.Check(bs.Set(Key("b"), []byte("2")), IsNil)
+	c.Check(ErrTxnTooLarge.Equal(bs.Set(Key("c"), []byte("3"))), IsTrue)
+}
+
+func (s testBufferStoreSuite) TestRewriteKeys(c *C) {
+	newStore := func() *BufferStore {
+		bs := NewBufferStore(&mockSnapshot{NewMemDbBuffer()})
+		c.Check(bs.Set(Key("i1_a"), []byte("1")), IsNil)
+		c.Check(bs.Set(Key("i1_b"), []byte("2")), IsNil)
+		c.Check(bs.Delete(Key("i1_c")), IsNil)
+		c.Check(bs.Set(Key("r_a"), []byte("3")), IsNil)
+		return bs
+	}
+	dump := func(bs *BufferStore) []string {
+		var pairs []string
+		bs.WalkBuffer(func(k Key, v []byte) error {
+			pairs = append(pairs, string(k)+"="+string(v))
+			return nil
+		})
+		return pairs
+	}
+
+	// Rewrite the prefix i1_ to i2_.
+	bs := newStore()
+	err := bs.RewriteKeys(func(k Key) (Key, bool) {
+		if k.HasPrefix(Key("i1_")) {
+			return append(Key("i2_"), k[3:]...), true
+		}
+		return k, true
+	})
+	c.Check(err, IsNil)
+	c.Check(dump(bs), DeepEquals, []string{"i2_a=1", "i2_b=2", "i2_c=", "r_a=3"})
+
+	// Drop the prefix i1_.
+	bs = newStore()
+	err = bs.RewriteKeys(func(k Key) (Key, bool) {
+		return k, !k.HasPrefix(Key("i1_"))
+	})
+	c.Check(err, IsNil)
+	c.Check(dump(bs), DeepEquals, []string{"r_a=3"})
+
+	// Collisions leave the buffer unchanged.
+	bs = newStore()
+	err = bs.RewriteKeys(func(k Key) (Key, bool) {
+		return k[:1], true
+	})
+	c.Check(ErrKeyExists.Equal(err), IsTrue)
+	c.Check(dump(bs), DeepEquals, []string{"i1_a=1", "i1_b=2", "i1_c=", "r_a=3"})
+
+	// A failed write restores the old pairs.
+	bs = newStore()
+	err = bs.RewriteKeys(func(k Key) (Key, bool) {
+		if k.Cmp(Key("r_a")) == 0 {
+			return make(Key, TxnEntrySizeLimit), true
+		}
+		return append(Key("i2_"), k[3:]...), true
+	})
+	c.Check(ErrEntryTooLarge.Equal(err), IsTrue)
+	c.Check(dump(bs), DeepEquals, []string{"i1_a=1", "i1_b=2", "i1_c=", "r_a=3"})
+}
+
+func (s testBufferStoreSuite) TestWalkLargeValues(c *C) {
+	bs := NewBufferStore(&mockSnapshot{NewMemDbBuffer()})
+	c.Check(bs.Set(Key("a"), make([]byte, 10)), IsNil)
+	c.Check(bs.Set(Key("b"), make([]byte, 100)), IsNil)
+	c.Check(bs.Set(Key("c"), make([]byte, 99)), IsNil)
+	c.Check(bs.Set(Key("d"), make([]byte, 1000)), IsNil)
+	c.Check(bs.Delete(Key("e")), IsNil)
+
+	walk := func(minBytes int) []string {
+		var visited []string
+		err := bs.WalkLargeValues(minBytes, func(k Key, size int) error {
+			visited = append(visited, fmt.Sprintf("%s:%d", k, size))
+			return nil
+		})
+		c.Check(err, IsNil)
+		return visited
+	}
+	c.Check(walk(100), DeepEquals, []string{"b:100", "d:1000"})
+	c.Check(walk(1001), HasLen, 0)
+	c.Check(walk(0), DeepEquals, []string{"a:10", "b:100", "c:99", "d:1000", "e:0"})
+
+	err := bs.WalkLargeValues(0, func(k Key, size int) error {
+		return ErrNotImplemented
+	})
+	c.Check(ErrNotImplemented.Equal(err), IsTrue)
+}
+
+func (s testBufferStoreSuite) TestWalkBufferByInsertion(c *C) {
+	bs := NewBufferStore(&mockSnapshot{NewMemDbBuffer()})
+	c.Check(bs.WalkBufferByInsertion(false, func(k Key, v []byte) error { return nil }), NotNil)
+	bs.TrackInsertionOrder()
+	c.Check(bs.Set(Key("c"), []byte("1")), IsNil)
+	c.Check(bs.Set(Key("a"), []byte("2")), IsNil)
+	c.Check(bs.Delete(Key("d")), IsNil)
+	c.Check(bs.Set(Key("b"), []byte("3")), IsNil)
+	// The overwrite moves c to the latest position.
+	c.Check(bs.Set(Key("c"), []byte("4")), IsNil)
+	c.Check(bs.Set(Key("e"), []byte("5")), IsNil)
+	c.Check(bs.UndoKey(Key("e")), IsNil)
+
+	walk := func(reverse bool) []string {
+		var visited []string
+		err := bs.WalkBufferByInsertion(reverse, func(k Key, v []byte) error {
+			visited = append(visited, string(k)+"="+string(v))
+			return nil
+		})
+		c.Check(err, IsNil)
+		return visited
+	}
+	c.Check(walk(false), DeepEquals, []string{"a=2", "d=", "b=3", "c=4"})
+	c.Check(walk(true), DeepEquals, []string{"c=4", "b=3", "d=", "a=2"})
+}
+
+func (s testBufferStoreSuite) TestWalkBufferContext(c *C) {
+	bs := NewBufferStore(&mockSnapshot{NewMemDbBuffer()})
+	for i := 0; i < 10*walkCheckInterval; i++ {
+		c.Check(bs.Set(encodeInt(i), encodeInt(i)), IsNil)
+	}
+	cnt := 0
+	c.Check(bs.WalkBufferContext(goctx.Background(), func(k Key, v []byte) error {
+		cnt++
+		return nil
+	}), IsNil)
+	c.Check(cnt, Equals, 10*walkCheckInterval)
+
+	ctx, cancel := goctx.WithCancel(goctx.Background())
+	cnt = 0
+	err := bs.WalkBufferContext(ctx, func(k Key, v []byte) error {
+		cnt++
+		if cnt == 10 {
+			cancel()
+		}
+		return nil
+	})
+	c.Check(errors.Cause(err), Equals, goctx.Canceled)
+	c.Check(cnt, Equals, walkCheckInterval)
+
+	// A done context stops the walk before any pair is visited.
+	cnt = 0
+	err = bs.WalkBufferContext(ctx, func(k Key, v []byte) error {
+		cnt++
+		return nil
+	})
+	c.Check(errors.Cause(err), Equals, goctx.Canceled)
+	c.Check(cnt, Equals, 0)
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"sync"
+	"time"
+)
+
+// conditionPrefetcher reads the keys of the recorded lazy condition pairs from
+// the snapshot in the background, so CheckLazyConditionPairs finds most of
+// them fetched. The keys added while a BatchGet is running are read by the
+// next one. A failed read is dropped, the keys are read again by the check.
+type conditionPrefetcher struct {
+	snapshot Snapshot
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	pending []Key
+	running bool
+	// observe is called with the number of keys and the duration of each
+	// read, it's the one passed to the latest add.
+	observe func(keys int, dur time.Duration)
+	// values keeps the fetched values, a nil value means the key doesn't exist.
+	values map[string][]byte
+}
+
+func newConditionPrefetcher(snapshot Snapshot) *conditionPrefetcher {
+	return &conditionPrefetcher{
+		snapshot: snapshot,
+		values:   make(map[string][]byte),
+	}
+}
+
+// add adds k to the pending batch, and starts reading it if no read is running.
+// The reads are reported to observe if it's not nil.
+func (p *conditionPrefetcher) add(k Key, observe func(keys int, dur time.Duration)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.observe = observe
+	if _, ok := p.values[string(k)]; ok {
+		return
+	}
+	p.pending = append(p.pending, k)
+	if !p.running {
+		p.running = true
+		p.wg.Add(1)
+		go p.run()
+	}
+}
+
+func (p *conditionPrefetcher) run() {
+	defer p.wg.Done()
+	for {
+		p.mu.Lock()
+		keys, observe := p.pending, p.observe
+		p.pending = nil
+		if len(keys) == 0 {
+			p.running = false
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+
+		start := time.Now()
+		values, err := p.snapshot.BatchGet(keys)
+		if observe != nil {
+			observe(len(keys), time.Since(start))
+		}
+		if err != nil {
+			continue
+		}
+		p.mu.Lock()
+		for _, k := range keys {
+			v := values[string(k)]
+			if len(v) == 0 {
+				v = nil
+			}
+			p.values[string(k)] = v
+		}
+		p.mu.Unlock()
+	}
+}
+
+// wait waits for the running read.
+func (p *conditionPrefetcher) wait() {
+	p.wg.Wait()
+}
+
+// get returns the fetched value of k.
+func (p *conditionPrefetcher) get(k string) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v, ok := p.values[k]
+	return v, ok
+}
@@ -34,6 +34,18 @@ const (
 	codeNotImplemented                            = 10
 	codeTxnTooLarge                               = 11
 	codeEntryTooLarge                             = 12
+	codeKeyOutOfOrder                             = 13
+	codeValueTooLarge                             = 14
+	codeDeleteNotExist                            = 15
+	codeConditionConflict                         = 16
+	codeReservationPending                        = 17
+	codeStoreSealed                               = 18
+	codeGlobalMemExceeded                         = 19
+	codeSkipMutation                              = 20
+	codeBufferAllocFailed                         = 21
+	codeForbiddenKeyRange                         = 22
+	codeAppendOnlyViolation                       = 23
+	codeDeleted                                   = 24
 
 	codeKeyExists = 1062
 )
@@ -60,6 +72,31 @@ var (
 	ErrTxnTooLarge = terror.ClassKV.New(codeTxnTooLarge, "transaction is too large")
 	// ErrEntryTooLarge is the error when a key value entry is too large.
 	ErrEntryTooLarge = terror.ClassKV.New(codeEntryTooLarge, "entry is too large")
+	// ErrKeyOutOfOrder is the error when keys are expected to be ascending but they are not.
+	ErrKeyOutOfOrder = terror.ClassKV.New(codeKeyOutOfOrder, "key is out of order")
+	// ErrValueTooLarge is the error when a value is larger than the MaxValueBytes option.
+	ErrValueTooLarge = terror.ClassKV.New(codeValueTooLarge, "value is too large")
+	// ErrDeleteNotExist is the error when a key which doesn't exist is deleted with the StrictDelete option.
+	ErrDeleteNotExist = terror.ClassKV.New(codeDeleteNotExist, "delete a key which doesn't exist")
+	// ErrConditionConflict is the error when a key is asserted with an expected value different from the recorded one.
+	ErrConditionConflict = terror.ClassKV.New(codeConditionConflict, "condition conflicts with the recorded one")
+	// ErrReservationPending is the error when a buffer is reserved before its last reservation ends.
+	ErrReservationPending = terror.ClassKV.New(codeReservationPending, "reservation is pending")
+	// ErrStoreSealed is the error when a union store is written after it's sealed.
+	ErrStoreSealed = terror.ClassKV.New(codeStoreSealed, "store is sealed")
+	// ErrGlobalMemExceeded is the error when the union stores sharing a MemTracker
+	// use more memory than its budget.
+	ErrGlobalMemExceeded = terror.ClassKV.New(codeGlobalMemExceeded, "global memory exceeded")
+	// ErrSkipMutation is returned by the CommitFilter option to drop a write from the commit.
+	ErrSkipMutation = terror.ClassKV.New(codeSkipMutation, "skip the mutation")
+	// ErrBufferAllocFailed is the error when the MemBufferFactory panics or returns nil.
+	ErrBufferAllocFailed = terror.ClassKV.New(codeBufferAllocFailed, "failed to allocate the buffer")
+	// ErrForbiddenKeyRange is the error when a key in the ForbiddenRanges option is written.
+	ErrForbiddenKeyRange = terror.ClassKV.New(codeForbiddenKeyRange, "key is in a forbidden range")
+	// ErrAppendOnlyViolation is the error when a write breaks the AppendOnly option.
+	ErrAppendOnlyViolation = terror.ClassKV.New(codeAppendOnlyViolation, "write violates append-only")
+	// ErrDeleted is the error when a key deleted in the buffer is read with the DistinctDeletedError option.
+	ErrDeleted = terror.ClassKV.New(codeDeleted, "key is deleted")
 
 	// ErrNotCommitted is the error returned by CommitVersion when this
 	// transaction is not committed.
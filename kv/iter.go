@@ -27,3 +27,118 @@ func NextUntil(it Iterator, fn FnKeyCmp) error {
 	}
 	return nil
 }
+
+// upperBoundIter wraps an Iterator and stops at the first key which is not
+// less than end. A nil end means no upper bound.
+type upperBoundIter struct {
+	Iterator
+	end Key
+}
+
+func newUpperBoundIter(it Iterator, end Key) Iterator {
+	if end == nil {
+		return it
+	}
+	return &upperBoundIter{Iterator: it, end: end}
+}
+
+// Valid implements the Iterator Valid interface.
+func (it *upperBoundIter) Valid() bool {
+	return it.Iterator.Valid() && it.Iterator.Key().Cmp(it.end) < 0
+}
+
+// PeekIterator wraps an Iterator to look at the entry after the current one.
+// Key and Value return the current entry like any Iterator, while Peek
+// returns the next entry without advancing. The wrapped iterator is kept one
+// entry ahead, so the current entry is copied.
+type PeekIterator struct {
+	it    Iterator
+	key   Key
+	value []byte
+	valid bool
+}
+
+// NewPeekIterator creates a PeekIterator positioned at the current entry of it.
+func NewPeekIterator(it Iterator) (*PeekIterator, error) {
+	p := &PeekIterator{it: it}
+	if err := p.Next(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return p, nil
+}
+
+// Peek returns the entry after the current one, ok is false if there is none.
+func (p *PeekIterator) Peek() (k Key, v []byte, ok bool) {
+	if !p.valid || !p.it.Valid() {
+		return nil, nil, false
+	}
+	return p.it.Key(), p.it.Value(), true
+}
+
+// Next implements the Iterator Next interface.
+func (p *PeekIterator) Next() error {
+	p.valid = p.it.Valid()
+	if !p.valid {
+		return nil
+	}
+	p.key = append(p.key[:0], p.it.Key()...)
+	p.value = append(p.value[:0], p.it.Value()...)
+	return errors.Trace(p.it.Next())
+}
+
+// Valid implements the Iterator Valid interface.
+func (p *PeekIterator) Valid() bool {
+	return p.valid
+}
+
+// Key implements the Iterator Key interface.
+func (p *PeekIterator) Key() Key {
+	return p.key
+}
+
+// Value implements the Iterator Value interface.
+func (p *PeekIterator) Value() []byte {
+	return p.value
+}
+
+// Close implements the Iterator Close interface.
+func (p *PeekIterator) Close() {
+	p.it.Close()
+}
+
+// stopIter wraps an Iterator and becomes invalid at the first entry for
+// which stop returns true, the entry is excluded.
+type stopIter struct {
+	Iterator
+	stop    func(k Key, v []byte) bool
+	stopped bool
+}
+
+func newStopIter(it Iterator, stop func(k Key, v []byte) bool) Iterator {
+	iter := &stopIter{Iterator: it, stop: stop}
+	iter.check()
+	return iter
+}
+
+func (it *stopIter) check() {
+	if it.Iterator.Valid() && it.stop(it.Iterator.Key(), it.Iterator.Value()) {
+		it.stopped = true
+	}
+}
+
+// Next implements the Iterator Next interface.
+func (it *stopIter) Next() error {
+	if it.stopped {
+		return nil
+	}
+	if err := it.Iterator.Next(); err != nil {
+		return errors.Trace(err)
+	}
+	it.check()
+	return nil
+}
+
+// Valid implements the Iterator Valid interface.
+func (it *stopIter) Valid() bool {
+	return !it.stopped && it.Iterator.Valid()
+}
@@ -81,6 +81,19 @@ func (r *KeyRange) IsPoint() bool {
 	return bytes.Equal(r.StartKey.PrefixNext(), r.EndKey)
 }
 
+// keySlice attaches the methods of sort.Interface to []Key, sorting in increasing order.
+type keySlice []Key
+
+func (s keySlice) Len() int           { return len(s) }
+func (s keySlice) Less(i, j int) bool { return s[i].Cmp(s[j]) < 0 }
+func (s keySlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// KeyValue represents a key and its value.
+type KeyValue struct {
+	Key   Key
+	Value []byte
+}
+
 // EncodedKey represents encoded key in low-level storage engine.
 type EncodedKey []byte
 
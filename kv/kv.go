@@ -42,6 +42,84 @@ const (
 	NotFillCache
 	// SyncLog decides whether the WAL(write-ahead log) of this request should be synchronized.
 	SyncLog
+	// SkipPreCommitConditionCheck makes PreCommit skip checking lazy condition pairs.
+	SkipPreCommitConditionCheck
+	// SkipPreCommitSizeCheck makes PreCommit skip validating the transaction size limits.
+	SkipPreCommitSizeCheck
+	// ConditionCheckMetrics is a func(ConditionCheckStats) which is called after
+	// lazy condition pairs are checked.
+	ConditionCheckMetrics
+	// SortBatchKeys makes the keys sorted before they are sent to Snapshot.BatchGet,
+	// which improves locality for range-partitioned storage.
+	SortBatchKeys
+	// MaxValueBytes is the max length of a value which can be set, a larger one
+	// is rejected by ErrValueTooLarge. It's unbounded by default.
+	MaxValueBytes
+	// BufferValueTransformer is a ValueTransformer applied to the values kept in
+	// the buffer. Reads and the commit path see the decoded values, while the
+	// buffer size counts the encoded ones. It must be set before any write.
+	BufferValueTransformer
+	// ReadBatchWindow is a time.Duration. If it's positive, the snapshot Gets
+	// issued within the window are coalesced into one BatchGet, see
+	// NewBatchingSnapshot. Gets of a UnionStore are only safe for concurrent
+	// use if PresumeKeyNotExists is not set.
+	ReadBatchWindow
+	// StrictDelete makes deleting a key which exists in neither the buffer nor
+	// the snapshot fail with ErrDeleteNotExist.
+	StrictDelete
+	// KeepHistory makes the union store keep every write of each key, which
+	// can be read by UnionStore.History. It's memory-heavy and for debugging.
+	KeepHistory
+	// KeyValidator is a func(k Key) error which is called with the key of every
+	// Set and Delete of a union store. The write fails with the returned error.
+	KeyValidator
+	// SlowReadThreshold is a time.Duration. The snapshot batch reads of the
+	// lazy condition check which take longer are reported to the observer set
+	// by UnionStore.SetSlowReadObserver.
+	SlowReadThreshold
+	// AsyncConditionCheck makes PreCommitWith check the lazy condition pairs
+	// concurrently with building the commit mutations. The ConditionCheckMetrics
+	// func is called on the goroutine of the check.
+	AsyncConditionCheck
+	// PrefetchConditions makes the union store read the key of each recorded
+	// lazy condition pair from the snapshot in the background, so the commit
+	// time check mostly doesn't read the snapshot again.
+	PrefetchConditions
+	// CommitFilter is a func(op Op) (Op, error) which is called with each write
+	// passed to UnionStore.WalkCommitMutations, op.Tp is OpSet or OpDelete. It
+	// returns the op to commit, which can be rewritten, ErrSkipMutation to drop
+	// the write, or another error to reject it. The returned op.Tp must be
+	// OpSet or OpDelete, an OpSet of an empty value is committed as a delete.
+	CommitFilter
+	// TrackAccess makes the union store count the Gets of each key, which can
+	// be read by UnionStore.HotKeys. It's off by default for the overhead.
+	TrackAccess
+	// ConditionHint is an int hinting the number of the lazy condition pairs a
+	// transaction records, so the storage of the pairs is pre-sized. It's
+	// advisory and only takes effect when no pair is recorded.
+	ConditionHint
+	// ForbiddenRanges is a []KeyRange which must not be written, a Set or
+	// Delete of a key in any of the ranges fails with ErrForbiddenKeyRange. A
+	// nil EndKey means no upper bound.
+	ForbiddenRanges
+	// ConditionScanDensity is a float64 threshold. If the lazy condition keys
+	// to check are at least this share of the snapshot keys in their range,
+	// by the EstimateRangeCount of the snapshot, the range is scanned instead
+	// of reading the keys by BatchGet and BatchExist. It's off if unset.
+	ConditionScanDensity
+	// TrackWriteTime makes the union store keep the time each key is first
+	// written, which can be read by UnionStore.BufferedSince. It's off by
+	// default.
+	TrackWriteTime
+	// AppendOnly makes the union store accept only the Sets of keys greater
+	// than all the buffered ones, a Delete, an overwrite or an out-of-order
+	// Set fails with ErrAppendOnlyViolation. The writes take the append path
+	// of a slice buffer instead of the MemBufferFactory one. It's a hint of
+	// the bulk loads.
+	AppendOnly
+	// DistinctDeletedError makes the Get of a union store return ErrDeleted
+	// instead of ErrNotExist for a key deleted in the buffer.
+	DistinctDeletedError
 )
 
 // Priority value for transaction priority.
@@ -109,6 +187,12 @@ type MemBuffer interface {
 	Size() int
 	// Len returns the number of entries in the DB.
 	Len() int
+	// MemUsage returns the estimated memory used by the buffer, which includes
+	// the structural overhead of each entry in addition to Size().
+	MemUsage() int
+	// BatchDelete deletes all the keys, it's the same as calling Delete for
+	// each key in turn.
+	BatchDelete(keys []Key) error
 }
 
 // Transaction defines the interface for operations inside a Transaction.
@@ -202,6 +286,17 @@ type Snapshot interface {
 	Retriever
 	// BatchGet gets a batch of values from snapshot.
 	BatchGet(keys []Key) (map[string][]byte, error)
+	// BatchExist checks which keys exist in snapshot. The map only contains the existing keys.
+	// It's preferred to BatchGet when the values are not needed.
+	BatchExist(keys []Key) (map[string]bool, error)
+	// EstimateRangeCount returns the approximate number of keys in range
+	// [start, end) by the statistics of the storage engine, without scanning
+	// the range. A nil end means no upper bound. It returns -1 if the snapshot
+	// has no statistics.
+	EstimateRangeCount(start, end Key) (int64, error)
+	// Release releases the resources held by the snapshot, such as the cached
+	// connections. It's idempotent, and the snapshot must not be used after it.
+	Release()
 }
 
 // Driver is the interface that must be implemented by a KV storage.
@@ -0,0 +1,156 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kvtest provides kv wrappers for test only.
+package kvtest
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+)
+
+// ErrInjected is the default error returned by ChaosSnapshot.
+var ErrInjected = errors.New("injected by chaos snapshot")
+
+// ChaosConfig configures the faults injected by ChaosSnapshot.
+type ChaosConfig struct {
+	// Delay is the latency added before each read.
+	Delay time.Duration
+	// ErrorRate is the probability in [0, 1] that a read fails with Err.
+	ErrorRate float64
+	// PartialRate is the probability in [0, 1] that a BatchGet or BatchExist
+	// which doesn't fail completely only returns the results of a part of
+	// the keys together with Err.
+	PartialRate float64
+	// Err is the injected error, ErrInjected is used if it's nil.
+	Err error
+}
+
+// ChaosSnapshot wraps a Snapshot, delays its reads and makes them fail
+// randomly. The faults are decided by a random source created from the
+// seed, so a test sees the same faults for the same sequence of calls.
+type ChaosSnapshot struct {
+	kv.Snapshot
+
+	mu  sync.Mutex
+	cfg ChaosConfig
+	rnd *rand.Rand
+}
+
+// NewChaosSnapshot creates a ChaosSnapshot wrapping snapshot.
+func NewChaosSnapshot(snapshot kv.Snapshot, cfg ChaosConfig, seed int64) *ChaosSnapshot {
+	return &ChaosSnapshot{
+		Snapshot: snapshot,
+		cfg:      cfg,
+		rnd:      rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetConfig replaces the config, it takes effect from the next call.
+func (s *ChaosSnapshot) SetConfig(cfg ChaosConfig) {
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+}
+
+// inject sleeps for the configured delay, then returns the number of keys
+// to keep if the call fails partially, or -1 otherwise, and the error to
+// inject if the call fails.
+func (s *ChaosSnapshot) inject(keyCnt int) (int, error) {
+	s.mu.Lock()
+	cfg := s.cfg
+	fail := s.rnd.Float64() < cfg.ErrorRate
+	partial := s.rnd.Float64() < cfg.PartialRate
+	keep := 0
+	if keyCnt > 0 {
+		keep = s.rnd.Intn(keyCnt)
+	}
+	s.mu.Unlock()
+
+	if cfg.Delay > 0 {
+		time.Sleep(cfg.Delay)
+	}
+	err := cfg.Err
+	if err == nil {
+		err = ErrInjected
+	}
+	if fail {
+		return 0, err
+	}
+	if partial && keyCnt > 0 {
+		return keep, err
+	}
+	return -1, nil
+}
+
+// Get implements the Snapshot Get interface.
+func (s *ChaosSnapshot) Get(k kv.Key) ([]byte, error) {
+	if _, err := s.inject(0); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return s.Snapshot.Get(k)
+}
+
+// Seek implements the Snapshot Seek interface.
+func (s *ChaosSnapshot) Seek(k kv.Key) (kv.Iterator, error) {
+	if _, err := s.inject(0); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return s.Snapshot.Seek(k)
+}
+
+// SeekReverse implements the Snapshot SeekReverse interface.
+func (s *ChaosSnapshot) SeekReverse(k kv.Key) (kv.Iterator, error) {
+	if _, err := s.inject(0); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return s.Snapshot.SeekReverse(k)
+}
+
+// BatchGet implements the Snapshot BatchGet interface. On a partial failure,
+// the values of the first keys are returned with the error.
+func (s *ChaosSnapshot) BatchGet(keys []kv.Key) (map[string][]byte, error) {
+	keep, err := s.inject(len(keys))
+	if err != nil && keep == 0 {
+		return nil, errors.Trace(err)
+	}
+	if keep > 0 {
+		keys = keys[:keep]
+	}
+	m, e := s.Snapshot.BatchGet(keys)
+	if e != nil {
+		return nil, errors.Trace(e)
+	}
+	return m, errors.Trace(err)
+}
+
+// BatchExist implements the Snapshot BatchExist interface. On a partial failure,
+// the existence of the first keys are returned with the error.
+func (s *ChaosSnapshot) BatchExist(keys []kv.Key) (map[string]bool, error) {
+	keep, err := s.inject(len(keys))
+	if err != nil && keep == 0 {
+		return nil, errors.Trace(err)
+	}
+	if keep > 0 {
+		keys = keys[:keep]
+	}
+	m, e := s.Snapshot.BatchExist(keys)
+	if e != nil {
+		return nil, errors.Trace(e)
+	}
+	return m, errors.Trace(err)
+}
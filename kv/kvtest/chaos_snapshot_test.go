@@ -0,0 +1,173 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvtest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+func TestT(t *testing.T) {
+	CustomVerboseFlag = true
+	TestingT(t)
+}
+
+var _ = Suite(&testChaosSnapshotSuite{})
+
+type testChaosSnapshotSuite struct {
+	keys []kv.Key
+	snap kv.Snapshot
+}
+
+// bufferSnapshot is a Snapshot reading from a MemBuffer.
+type bufferSnapshot struct {
+	kv.MemBuffer
+}
+
+func (s bufferSnapshot) BatchGet(keys []kv.Key) (map[string][]byte, error) {
+	m := make(map[string][]byte)
+	for _, k := range keys {
+		v, err := s.Get(k)
+		if kv.IsErrNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		m[string(k)] = v
+	}
+	return m, nil
+}
+
+func (s bufferSnapshot) EstimateRangeCount(start, end kv.Key) (int64, error) {
+	return -1, nil
+}
+
+func (s bufferSnapshot) Release() {}
+
+func (s bufferSnapshot) BatchExist(keys []kv.Key) (map[string]bool, error) {
+	values, err := s.BatchGet(keys)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	m := make(map[string]bool, len(values))
+	for k := range values {
+		m[k] = true
+	}
+	return m, nil
+}
+
+func (s *testChaosSnapshotSuite) SetUpSuite(c *C) {
+	buffer := kv.NewMemDbBuffer()
+	for i := 0; i < 10; i++ {
+		k := kv.Key(fmt.Sprintf("k%d", i))
+		c.Assert(buffer.Set(k, []byte("v")), IsNil)
+		s.keys = append(s.keys, k)
+	}
+	s.snap = bufferSnapshot{buffer}
+}
+
+func (s *testChaosSnapshotSuite) TestNoFault(c *C) {
+	defer testleak.AfterTest(c)()
+	snap := NewChaosSnapshot(s.snap, ChaosConfig{}, 1)
+	for i := 0; i < 100; i++ {
+		v, err := snap.Get(s.keys[0])
+		c.Assert(err, IsNil)
+		c.Assert(v, BytesEquals, []byte("v"))
+		m, err := snap.BatchGet(s.keys)
+		c.Assert(err, IsNil)
+		c.Assert(m, HasLen, len(s.keys))
+	}
+}
+
+func (s *testChaosSnapshotSuite) TestDelay(c *C) {
+	defer testleak.AfterTest(c)()
+	delay := 10 * time.Millisecond
+	snap := NewChaosSnapshot(s.snap, ChaosConfig{Delay: delay}, 1)
+	start := time.Now()
+	_, err := snap.BatchGet(s.keys)
+	c.Assert(err, IsNil)
+	_, err = snap.Get(s.keys[0])
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(start) >= 2*delay, IsTrue)
+}
+
+func (s *testChaosSnapshotSuite) TestError(c *C) {
+	defer testleak.AfterTest(c)()
+	snap := NewChaosSnapshot(s.snap, ChaosConfig{ErrorRate: 1}, 1)
+	_, err := snap.Get(s.keys[0])
+	c.Assert(errors.Cause(err), Equals, ErrInjected)
+	_, err = snap.Seek(nil)
+	c.Assert(errors.Cause(err), Equals, ErrInjected)
+	m, err := snap.BatchGet(s.keys)
+	c.Assert(errors.Cause(err), Equals, ErrInjected)
+	c.Assert(m, IsNil)
+
+	myErr := errors.New("my error")
+	snap.SetConfig(ChaosConfig{ErrorRate: 1, Err: myErr})
+	_, err = snap.BatchExist(s.keys)
+	c.Assert(errors.Cause(err), Equals, myErr)
+
+	// About half of the calls fail.
+	snap.SetConfig(ChaosConfig{ErrorRate: 0.5})
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		if _, err = snap.Get(s.keys[0]); err != nil {
+			failed++
+		}
+	}
+	c.Assert(failed > 400 && failed < 600, IsTrue, Commentf("failed %d", failed))
+}
+
+func (s *testChaosSnapshotSuite) TestPartialFailure(c *C) {
+	defer testleak.AfterTest(c)()
+	snap := NewChaosSnapshot(s.snap, ChaosConfig{PartialRate: 1}, 1)
+	for i := 0; i < 100; i++ {
+		m, err := snap.BatchGet(s.keys)
+		c.Assert(errors.Cause(err), Equals, ErrInjected)
+		c.Assert(len(m) < len(s.keys), IsTrue)
+		for j, k := range s.keys {
+			if j < len(m) {
+				c.Assert(m[string(k)], BytesEquals, []byte("v"))
+			} else {
+				c.Assert(m[string(k)], IsNil)
+			}
+		}
+	}
+}
+
+func (s *testChaosSnapshotSuite) TestDeterministic(c *C) {
+	defer testleak.AfterTest(c)()
+	cfg := ChaosConfig{ErrorRate: 0.3, PartialRate: 0.3}
+	run := func() []int {
+		snap := NewChaosSnapshot(s.snap, cfg, 20171220)
+		var results []int
+		for i := 0; i < 100; i++ {
+			m, err := snap.BatchGet(s.keys)
+			if err == nil {
+				results = append(results, -1)
+			} else {
+				results = append(results, len(m))
+			}
+		}
+		return results
+	}
+	c.Assert(run(), DeepEquals, run())
+}
@@ -42,12 +42,14 @@ type testKVSuite struct {
 }
 
 func (s *testKVSuite) SetUpSuite(c *C) {
-	s.bs = make([]MemBuffer, 1)
+	s.bs = make([]MemBuffer, 2)
 	s.bs[0] = NewMemDbBuffer()
+	s.bs[1] = NewSliceBuffer()
 }
 
 func (s *testKVSuite) ResetMembuffers() {
 	s.bs[0] = NewMemDbBuffer()
+	s.bs[1] = NewSliceBuffer()
 }
 
 func insertData(c *C, buffer MemBuffer) {
@@ -173,6 +175,53 @@ func (s *testKVSuite) TestIterNextUntil(c *C) {
 	c.Assert(iter.Valid(), IsFalse)
 }
 
+func (s *testKVSuite) TestPeekIterator(c *C) {
+	defer testleak.AfterTest(c)()
+	check := func(it Iterator, expect []string) {
+		iter, err := NewPeekIterator(it)
+		c.Assert(err, IsNil)
+		defer iter.Close()
+		var keys []string
+		for i := 0; iter.Valid(); i++ {
+			keys = append(keys, string(iter.Key()))
+			k, v, ok := iter.Peek()
+			// Peeking twice doesn't advance.
+			k2, _, ok2 := iter.Peek()
+			c.Assert(ok2, Equals, ok)
+			c.Assert(k2, DeepEquals, k)
+			c.Assert(string(iter.Key()), Equals, keys[i])
+			c.Assert(ok, Equals, i+1 < len(expect))
+			c.Assert(iter.Next(), IsNil)
+			if ok {
+				c.Assert(iter.Key(), DeepEquals, k)
+				c.Assert(iter.Value(), BytesEquals, v)
+			}
+		}
+		c.Assert(keys, DeepEquals, expect)
+		_, _, ok := iter.Peek()
+		c.Assert(ok, IsFalse)
+	}
+
+	buffer := NewMemDbBuffer()
+	for i := 0; i < 5; i++ {
+		buffer.Set(encodeInt(i), encodeInt(i*10))
+	}
+	it, err := buffer.Seek(nil)
+	c.Assert(err, IsNil)
+	check(it, []string{string(encodeInt(0)), string(encodeInt(1)), string(encodeInt(2)), string(encodeInt(3)), string(encodeInt(4))})
+	it, err = buffer.Seek(encodeInt(10))
+	c.Assert(err, IsNil)
+	check(it, nil)
+
+	us := NewUnionStore(&mockSnapshot{buffer})
+	us.Set(encodeInt(1), []byte("1"))
+	us.Delete(encodeInt(2))
+	us.Set(encodeInt(5), []byte("5"))
+	it, err = us.Seek(encodeInt(1))
+	c.Assert(err, IsNil)
+	check(it, []string{string(encodeInt(1)), string(encodeInt(3)), string(encodeInt(4)), string(encodeInt(5))})
+}
+
 func (s *testKVSuite) TestBasicNewIterator(c *C) {
 	defer testleak.AfterTest(c)()
 	for _, buffer := range s.bs {
@@ -240,6 +289,296 @@ func (s *testKVSuite) TestBufferLimit(c *C) {
 	c.Assert(err, NotNil) // buffer len limit
 }
 
+func (s *testKVSuite) TestReserve(c *C) {
+	buffer := NewMemDbBuffer().(*memDbBuffer)
+	buffer.bufferSizeLimit = 100
+	buffer.bufferLenLimit = 10
+	c.Assert(buffer.Set([]byte("a"), make([]byte, 9)), IsNil)
+
+	// A reservation which exceeds the limits is rejected up front.
+	_, err := buffer.Reserve(10, 10)
+	c.Assert(ErrTxnTooLarge.Equal(err), IsTrue)
+	_, err = buffer.Reserve(1, 91)
+	c.Assert(ErrTxnTooLarge.Equal(err), IsTrue)
+
+	r, err := buffer.Reserve(5, 50)
+	c.Assert(err, IsNil)
+	_, err = buffer.Reserve(1, 1)
+	c.Assert(ErrReservationPending.Equal(err), IsTrue)
+	// The other writes can't take the reserved room.
+	for i := 0; i < 3; i++ {
+		c.Assert(buffer.Set([]byte{'b', byte(i)}, make([]byte, 8)), IsNil)
+	}
+	entries, bytes := r.Remaining()
+	c.Assert(entries, Equals, 2)
+	c.Assert(bytes, Equals, 20)
+	// A failed write doesn't take the reserved room.
+	c.Assert(buffer.Set([]byte("c"), make([]byte, 70)), NotNil)
+	c.Assert(buffer.remove([]byte("c")), IsNil)
+	entries, bytes = r.Remaining()
+	c.Assert(entries, Equals, 2)
+	c.Assert(bytes, Equals, 20)
+
+	// The unused room is released.
+	r.Commit()
+	entries, bytes = r.Remaining()
+	c.Assert(entries, Equals, 0)
+	c.Assert(bytes, Equals, 0)
+	c.Assert(buffer.Set([]byte("c"), make([]byte, 59)), IsNil)
+
+	r, err = buffer.Reserve(1, 0)
+	c.Assert(err, IsNil)
+	r.Cancel()
+	c.Assert(buffer.reservation, IsNil)
+
+	// A negative reservation is rejected.
+	_, err = buffer.Reserve(-1, 0)
+	c.Assert(err, NotNil)
+	_, err = buffer.Reserve(0, -1)
+	c.Assert(err, NotNil)
+	c.Assert(buffer.reservation, IsNil)
+
+	// A write which shrinks the buffer gives its room back, up to the
+	// reserved room.
+	buffer = NewMemDbBuffer().(*memDbBuffer)
+	buffer.bufferSizeLimit = 100
+	buffer.bufferLenLimit = 10
+	c.Assert(buffer.Set([]byte("a"), make([]byte, 39)), IsNil)
+	r, err = buffer.Reserve(2, 20)
+	c.Assert(err, IsNil)
+	c.Assert(buffer.Set([]byte("b"), make([]byte, 9)), IsNil)
+	entries, bytes = r.Remaining()
+	c.Assert(entries, Equals, 1)
+	c.Assert(bytes, Equals, 10)
+	c.Assert(buffer.Set([]byte("a"), make([]byte, 1)), IsNil)
+	entries, bytes = r.Remaining()
+	c.Assert(entries, Equals, 1)
+	c.Assert(bytes, Equals, 20)
+	r.Commit()
+
+	us := NewUnionStore(&mockSnapshot{NewMemDbBuffer()})
+	r, err = us.Reserve(1, 1)
+	c.Assert(err, IsNil)
+	r.Commit()
+}
+
+func (s *testKVSuite) TestMemUsage(c *C) {
+	defer testleak.AfterTest(c)()
+	buffer := NewMemDbBuffer()
+	c.Assert(buffer.MemUsage(), Equals, 0)
+
+	for i := 1; i <= 100; i++ {
+		val := encodeInt(i)
+		err := buffer.Set(val, val)
+		c.Assert(err, IsNil)
+		c.Assert(buffer.MemUsage()-buffer.Size(), Equals, i*memDbEntryOverhead)
+	}
+	usage := buffer.MemUsage()
+	c.Assert(usage, Greater, buffer.Size())
+
+	// Overwriting an entry doesn't add a new node, but the old value is
+	// still held.
+	err := buffer.Set(encodeInt(1), []byte("x"))
+	c.Assert(err, IsNil)
+	c.Assert(buffer.MemUsage(), Equals, usage+len(encodeInt(1))+1)
+
+	// The removed entries are still held until the buffer is compacted.
+	usage = buffer.MemUsage()
+	c.Assert(buffer.(*memDbBuffer).remove(encodeInt(2)), IsNil)
+	c.Assert(buffer.MemUsage(), Equals, usage)
+	c.Assert(buffer.(*memDbBuffer).Compact(), IsNil)
+	c.Assert(buffer.MemUsage()-buffer.Size(), Equals, 99*memDbEntryOverhead)
+}
+
+func (s *testKVSuite) TestBatchDelete(c *C) {
+	defer testleak.AfterTest(c)()
+	for _, buffer := range s.bs {
+		insertData(c, buffer)
+		keys := make([]Key, 0, testCount)
+		for i := 0; i < testCount; i++ {
+			keys = append(keys, encodeInt(i*indexStep))
+		}
+		c.Assert(buffer.BatchDelete(keys), IsNil)
+		for _, k := range keys {
+			val, err := buffer.Get(k)
+			c.Assert(err, IsNil)
+			c.Assert(val, HasLen, 0)
+		}
+		c.Assert(buffer.Len(), Equals, testCount)
+		c.Assert(buffer.Size(), Equals, testCount*len(encodeInt(0)))
+	}
+	s.ResetMembuffers()
+}
+
+func (s *testKVSuite) TestCompact(c *C) {
+	defer testleak.AfterTest(c)()
+	buffer := NewMemDbBuffer()
+	compactor := buffer.(Compactor)
+	c.Assert(compactor.Fragmentation(), Equals, 0.0)
+	for i := 0; i < 100; i++ {
+		c.Assert(buffer.Set(encodeInt(i), encodeInt(i)), IsNil)
+	}
+	c.Assert(compactor.Fragmentation(), Equals, 0.0)
+
+	// Churn the entries.
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 100; i++ {
+			c.Assert(buffer.Set(encodeInt(i), encodeInt(round*100+i)), IsNil)
+		}
+	}
+	for i := 50; i < 100; i++ {
+		c.Assert(buffer.(entryRemover).remove(encodeInt(i)), IsNil)
+	}
+	c.Assert(buffer.Delete(encodeInt(0)), IsNil)
+	c.Assert(compactor.Fragmentation() > 10, IsTrue)
+	size, length := buffer.Size(), buffer.Len()
+
+	c.Assert(compactor.Compact(), IsNil)
+	c.Assert(compactor.Fragmentation(), Equals, 0.0)
+	c.Assert(buffer.Size(), Equals, size)
+	c.Assert(buffer.Len(), Equals, length)
+	val, err := buffer.Get(encodeInt(0))
+	c.Assert(err, IsNil)
+	c.Assert(val, HasLen, 0)
+	for i := 1; i < 50; i++ {
+		val, err = buffer.Get(encodeInt(i))
+		c.Assert(err, IsNil)
+		c.Assert(val, BytesEquals, encodeInt(900+i))
+	}
+	_, err = buffer.Get(encodeInt(50))
+	c.Assert(IsErrNotFound(err), IsTrue)
+	// The compacted buffer is still writable.
+	c.Assert(buffer.Set(encodeInt(50), encodeInt(50)), IsNil)
+	c.Assert(buffer.Len(), Equals, length+1)
+}
+
+func (s *testKVSuite) TestSeekCache(c *C) {
+	defer testleak.AfterTest(c)()
+	buffer := NewMemDbBuffer()
+	buffer.(SeekCacher).SetSeekCache(2, 1)
+	for i := 0; i < 100; i += 2 {
+		c.Assert(buffer.Set(encodeInt(i), encodeInt(i)), IsNil)
+	}
+
+	seek := func(n int) int {
+		iter, err := buffer.Seek(encodeInt(n))
+		c.Assert(err, IsNil)
+		defer iter.Close()
+		if !iter.Valid() {
+			return -1
+		}
+		return decodeInt(iter.Key())
+	}
+	// Close caches the positions, the later seeks resume from them.
+	c.Assert(seek(10), Equals, 10)
+	c.Assert(seek(10), Equals, 10)
+	c.Assert(seek(11), Equals, 12)
+	c.Assert(seek(40), Equals, 40)
+	c.Assert(seek(98), Equals, 98)
+	c.Assert(seek(99), Equals, -1)
+	c.Assert(seek(20), Equals, 20)
+
+	// A write invalidates the cached positions and the open iterators.
+	iter, err := buffer.Seek(encodeInt(30))
+	c.Assert(err, IsNil)
+	c.Assert(seek(30), Equals, 30)
+	c.Assert(buffer.Set(encodeInt(31), encodeInt(31)), IsNil)
+	iter.Close()
+	c.Assert(seek(31), Equals, 31)
+	c.Assert(buffer.Delete(encodeInt(32)), IsNil)
+	c.Assert(seek(32), Equals, 32)
+	c.Assert(buffer.(entryRemover).remove(encodeInt(32)), IsNil)
+	c.Assert(seek(32), Equals, 34)
+	c.Assert(buffer.(Compactor).Compact(), IsNil)
+	c.Assert(seek(31), Equals, 31)
+	c.Assert(buffer.BatchDelete([]Key{encodeInt(31)}), IsNil)
+	iter, err = buffer.Seek(encodeInt(30))
+	c.Assert(err, IsNil)
+	keys := []int{}
+	for ; iter.Valid() && len(keys) < 3; iter.Next() {
+		keys = append(keys, decodeInt(iter.Key()))
+	}
+	iter.Close()
+	c.Assert(keys, DeepEquals, []int{30, 31, 34})
+
+	buffer.(SeekCacher).SetSeekCache(0, 0)
+	c.Assert(seek(33), Equals, 34)
+}
+
+func sliceIter(data [][]byte) func() (Key, []byte, bool) {
+	i := 0
+	return func() (Key, []byte, bool) {
+		if i >= len(data) {
+			return nil, nil, false
+		}
+		i++
+		return data[i-1], data[i-1], true
+	}
+}
+
+func (s *testKVSuite) TestBulkLoad(c *C) {
+	defer testleak.AfterTest(c)()
+	buffer := NewMemDbBuffer()
+	data := [][]byte{encodeInt(1), encodeInt(2), encodeInt(3)}
+	err := buffer.(BulkLoader).BulkLoad(sliceIter(data))
+	c.Assert(err, IsNil)
+	c.Assert(buffer.Len(), Equals, 3)
+	iter, err := buffer.Seek(nil)
+	c.Assert(err, IsNil)
+	for _, k := range data {
+		c.Assert(iter.Valid(), IsTrue)
+		c.Assert([]byte(iter.Key()), BytesEquals, k)
+		c.Assert(iter.Value(), BytesEquals, k)
+		c.Assert(iter.Next(), IsNil)
+	}
+	c.Assert(iter.Valid(), IsFalse)
+	iter.Close()
+
+	// Keys must be greater than the loaded ones.
+	err = buffer.(BulkLoader).BulkLoad(sliceIter([][]byte{encodeInt(3)}))
+	c.Assert(ErrKeyOutOfOrder.Equal(err), IsTrue)
+	err = buffer.(BulkLoader).BulkLoad(sliceIter([][]byte{encodeInt(4), encodeInt(6), encodeInt(5)}))
+	c.Assert(ErrKeyOutOfOrder.Equal(err), IsTrue)
+	c.Assert(buffer.Len(), Equals, 5)
+
+	buffer = NewMemDbBuffer()
+	err = buffer.(BulkLoader).BulkLoad(sliceIter([][]byte{encodeInt(2), encodeInt(1)}))
+	c.Assert(ErrKeyOutOfOrder.Equal(err), IsTrue)
+
+	// The limits stop an unbounded stream, the loaded pairs take the
+	// reserved room like Set.
+	buffer = NewMemDbBuffer()
+	buffer.(*memDbBuffer).bufferLenLimit = 10
+	r, err := buffer.(Reserver).Reserve(5, 0)
+	c.Assert(err, IsNil)
+	n := 0
+	err = buffer.(BulkLoader).BulkLoad(func() (Key, []byte, bool) {
+		n++
+		return encodeInt(n), []byte("v"), true
+	})
+	c.Assert(ErrTxnTooLarge.Equal(err), IsTrue)
+	c.Assert(n, Equals, 11)
+	entries, _ := r.Remaining()
+	c.Assert(entries, Equals, 0)
+	r.Cancel()
+
+	// A union store loads through its lazy buffer with the checks of Set.
+	us := NewUnionStore(&mockSnapshot{NewMemDbBuffer()})
+	c.Assert(us.Set(encodeInt(0), []byte("0")), IsNil)
+	loader := us.(interface {
+		BulkLoad(iter func() (Key, []byte, bool)) error
+	})
+	c.Assert(loader.BulkLoad(sliceIter(data)), IsNil)
+	c.Assert(us.Len(), Equals, 4)
+	v, err := us.Get(encodeInt(2))
+	c.Assert(err, IsNil)
+	c.Assert(v, BytesEquals, encodeInt(2))
+	us.SetOption(MaxValueBytes, 1)
+	err = loader.BulkLoad(sliceIter([][]byte{encodeInt(4)}))
+	c.Assert(ErrValueTooLarge.Equal(err), IsTrue)
+	c.Assert(us.Len(), Equals, 4)
+}
+
 var opCnt = 100000
 
 func BenchmarkMemDbBufferSequential(b *testing.B) {
@@ -263,6 +602,110 @@ func BenchmarkMemDbBufferRandom(b *testing.B) {
 	b.ReportAllocs()
 }
 
+func BenchmarkMemDbBufferSequentialSet(b *testing.B) {
+	data := make([][]byte, opCnt)
+	for i := 0; i < opCnt; i++ {
+		data[i] = encodeInt(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer := NewMemDbBuffer()
+		for _, k := range data {
+			buffer.Set(k, k)
+		}
+	}
+	b.ReportAllocs()
+}
+
+func BenchmarkMemDbBufferBulkLoad(b *testing.B) {
+	data := make([][]byte, opCnt)
+	for i := 0; i < opCnt; i++ {
+		data[i] = encodeInt(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer := NewMemDbBuffer()
+		buffer.(BulkLoader).BulkLoad(sliceIter(data))
+	}
+	b.ReportAllocs()
+}
+
+func BenchmarkUnionStoreSingleWrite(b *testing.B) {
+	snapshot := &mockSnapshot{NewMemDbBuffer()}
+	key, value := []byte("key"), []byte("value")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		us := NewUnionStore(snapshot)
+		us.Set(key, value)
+		us.WalkBuffer(func(k Key, v []byte) error {
+			return nil
+		})
+	}
+}
+
+func BenchmarkMemDbBufferRepeatedSeek(b *testing.B) {
+	benchmarkRepeatedSeek(b, 0)
+}
+
+func BenchmarkMemDbBufferRepeatedSeekCached(b *testing.B) {
+	benchmarkRepeatedSeek(b, 4)
+}
+
+func benchmarkRepeatedSeek(b *testing.B, capacity int) {
+	buffer := NewMemDbBuffer()
+	buffer.(SeekCacher).SetSeekCache(capacity, 4)
+	for i := 0; i < opCnt; i++ {
+		buffer.Set(encodeInt(i), encodeInt(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		iter, _ := buffer.Seek(encodeInt(opCnt/2 + i%8))
+		iter.Close()
+	}
+	b.ReportAllocs()
+}
+
+func BenchmarkUnionStoreRecordConditions(b *testing.B) {
+	benchmarkRecordConditions(b, 0)
+}
+
+func BenchmarkUnionStoreRecordConditionsWithHint(b *testing.B) {
+	benchmarkRecordConditions(b, 10000)
+}
+
+func benchmarkRecordConditions(b *testing.B, hint int) {
+	snapshot := &mockSnapshot{NewMemDbBuffer()}
+	keys := make([]Key, 10000)
+	for i := range keys {
+		keys[i] = encodeInt(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		us := NewUnionStore(snapshot)
+		us.SetOption(ConditionHint, hint)
+		us.BatchAssertNotExists(keys)
+	}
+	b.ReportAllocs()
+}
+
+func BenchmarkUnionStoreSeekClose(b *testing.B) {
+	snapshot := &mockSnapshot{NewMemDbBuffer()}
+	for i := 0; i < 100; i++ {
+		snapshot.store.Set(encodeInt(i), encodeInt(i))
+	}
+	us := NewUnionStore(snapshot)
+	for i := 0; i < 100; i += 3 {
+		us.Set(encodeInt(i), encodeInt(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		iter, _ := us.Seek(encodeInt(i % 100))
+		iter.Next()
+		iter.Close()
+	}
+	b.ReportAllocs()
+}
+
 func BenchmarkMemDbIter(b *testing.B) {
 	buffer := NewMemDbBuffer()
 	benchIterator(b, buffer)
@@ -0,0 +1,43 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import "sync/atomic"
+
+// MemTracker tracks the buffer memory usage of the union stores sharing it
+// against a global budget. It's safe for concurrent use.
+type MemTracker struct {
+	budget int64
+	used   int64
+}
+
+// NewMemTracker creates a MemTracker with the budget in bytes.
+func NewMemTracker(budget int64) *MemTracker {
+	return &MemTracker{budget: budget}
+}
+
+// Used returns the memory usage of all the union stores in bytes.
+func (t *MemTracker) Used() int64 {
+	return atomic.LoadInt64(&t.used)
+}
+
+// add adds delta to the usage, it returns ErrGlobalMemExceeded if the usage
+// exceeds the budget after a positive delta.
+func (t *MemTracker) add(delta int64) error {
+	used := atomic.AddInt64(&t.used, delta)
+	if delta > 0 && used > t.budget {
+		return ErrGlobalMemExceeded.Gen("global memory exceeded, used: %d, budget: %d", used, t.budget)
+	}
+	return nil
+}
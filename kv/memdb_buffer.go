@@ -16,6 +16,7 @@
 package kv
 
 import (
+	"math"
 	"sync/atomic"
 
 	"github.com/juju/errors"
@@ -27,18 +28,197 @@ import (
 	"github.com/pingcap/tidb/terror"
 )
 
+// memDbEntryOverhead is the estimated per-entry overhead of memdb.DB.
+// Every skip-list node stores its kv offset, key length, value length and
+// height as ints, followed by one next pointer per level. The node height is
+// chosen with probability 1/4 per extra level, so a node has 4/3 levels on
+// average. With 8-byte ints it is about 5.33 * 8 bytes, rounded up to 48.
+const memDbEntryOverhead = 48
+
 type memDbBuffer struct {
 	db              *memdb.DB
 	entrySizeLimit  int
 	bufferLenLimit  uint64
 	bufferSizeLimit int
+	reservation     *Reservation
+	seekCache       *seekCache
+	// removedNodes is the number of the skip-list nodes unlinked by remove,
+	// memdb.DB doesn't reuse them until the buffer is compacted.
+	removedNodes int
+	// limitsSuspended skips the buffer size and length limits, see
+	// BufferStore.SuspendSizeTracking.
+	limitsSuspended bool
+}
+
+// SeekCacher is implemented by the MemBuffers which can cache the positions
+// of closed iterators, so that a later Seek to a nearby key resumes from the
+// cached position instead of searching from the root.
+type SeekCacher interface {
+	// SetSeekCache keeps at most capacity positions, one for each distinct
+	// prefix of prefixLen bytes of the seek keys. A capacity of 0 or negative
+	// disables the cache. The cache is dropped by any write.
+	SetSeekCache(capacity int, prefixLen int)
+}
+
+// seekCacheMaxSteps is the max number of steps to move a cached position
+// forward to the seek key, a farther Seek searches from the root.
+const seekCacheMaxSteps = 32
+
+// seekCache caches the positions of the closed forward iterators of a
+// memDbBuffer. It's simple since the buffer has a single writer.
+type seekCache struct {
+	capacity  int
+	prefixLen int
+	gen       uint64
+	entries   []seekCacheEntry
+}
+
+type seekCacheEntry struct {
+	prefix string
+	iter   iterator.Iterator
+}
+
+func (c *seekCache) prefix(k Key) string {
+	if len(k) > c.prefixLen {
+		k = k[:c.prefixLen]
+	}
+	return string(k)
+}
+
+// take removes and returns the cached position of k's prefix if it can be
+// moved forward to k within seekCacheMaxSteps.
+func (c *seekCache) take(k Key) iterator.Iterator {
+	prefix := c.prefix(k)
+	for i, e := range c.entries {
+		if e.prefix != prefix {
+			continue
+		}
+		c.entries = append(c.entries[:i], c.entries[i+1:]...)
+		iter := e.iter
+		if cmp := Key(iter.Key()).Cmp(k); cmp >= 0 {
+			if cmp == 0 {
+				return iter
+			}
+			iter.Release()
+			return nil
+		}
+		for steps := 0; steps < seekCacheMaxSteps; steps++ {
+			if !iter.Next() {
+				break
+			}
+			if Key(iter.Key()).Cmp(k) >= 0 {
+				return iter
+			}
+		}
+		iter.Release()
+		return nil
+	}
+	return nil
+}
+
+// put caches the position of iter for the prefix, the oldest position is
+// dropped if the cache is full.
+func (c *seekCache) put(prefix string, iter iterator.Iterator) {
+	for i, e := range c.entries {
+		if e.prefix == prefix {
+			e.iter.Release()
+			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+			break
+		}
+	}
+	if len(c.entries) >= c.capacity {
+		c.entries[0].iter.Release()
+		c.entries = c.entries[1:]
+	}
+	c.entries = append(c.entries, seekCacheEntry{prefix: prefix, iter: iter})
+}
+
+// reset drops all the cached positions, the iterators created before are
+// not cached when they're closed.
+func (c *seekCache) reset() {
+	for _, e := range c.entries {
+		e.iter.Release()
+	}
+	c.entries = nil
+	c.gen++
+}
+
+// Reserver is implemented by the MemBuffers which can reserve room under
+// their limits for a batch of writes.
+type Reserver interface {
+	// Reserve reserves room for entries more entries of bytes more bytes. It
+	// fails if entries or bytes is negative, and with ErrTxnTooLarge if the
+	// room doesn't fit the limits. The Sets
+	// within the reservation never fail by the limits, while the other writes
+	// can't take the reserved room. Only one reservation can be made at a time.
+	Reserve(entries int, bytes int) (*Reservation, error)
+}
+
+// Reservation is the room reserved in a MemBuffer by Reserver.Reserve.
+// The Sets after Reserve take the reserved room until it's used up.
+type Reservation struct {
+	m       *memDbBuffer
+	entries int
+	bytes   int
+	// maxEntries and maxBytes are the reserved room, the room given back by
+	// the writes which shrink the buffer never grows the reservation over it.
+	maxEntries int
+	maxBytes   int
+}
+
+// BulkLoader is implemented by the MemBuffers which can load a stream of
+// presorted kv pairs. The memDbBuffer inserts each pair into its skip list,
+// which has no append path, so it isn't faster than calling Set repeatedly
+// but checks the order of the stream.
+type BulkLoader interface {
+	// BulkLoad loads kv pairs returned by iter until it returns false.
+	// Keys must be strictly ascending and greater than any key in the buffer,
+	// otherwise ErrKeyOutOfOrder is returned. The pairs loaded before an
+	// error are kept.
+	BulkLoad(iter func() (Key, []byte, bool)) error
+}
+
+// Compactor is implemented by the MemBuffers whose storage keeps the bytes of
+// overwritten and removed entries until it's compacted.
+type Compactor interface {
+	// Fragmentation returns the ratio of the bytes held by overwritten or
+	// removed entries to the bytes of the live entries. It's +Inf if only
+	// dead bytes are held.
+	Fragmentation() float64
+	// Compact rebuilds the storage with the live entries only.
+	Compact() error
+}
+
+// entryRemover is implemented by the MemBuffers which can drop a buffered entry,
+// unlike Delete which buffers a tombstone.
+type entryRemover interface {
+	remove(k Key) error
 }
 
 type memDbIter struct {
 	iter    iterator.Iterator
 	reverse bool
+	// cache is set for the iterators created with the seek cache enabled.
+	cache  *seekCache
+	gen    uint64
+	prefix string
+}
+
+// MemBufferFactory creates the MemBuffers used to buffer writes.
+type MemBufferFactory interface {
+	// NewMemBuffer creates a new empty MemBuffer.
+	NewMemBuffer() MemBuffer
+}
+
+type memDbBufferFactory struct{}
+
+func (f memDbBufferFactory) NewMemBuffer() MemBuffer {
+	return NewMemDbBuffer()
 }
 
+// DefaultMemBufferFactory creates MemBuffers by NewMemDbBuffer.
+var DefaultMemBufferFactory MemBufferFactory = memDbBufferFactory{}
+
 // NewMemDbBuffer creates a new memDbBuffer.
 func NewMemDbBuffer() MemBuffer {
 	return &memDbBuffer{
@@ -51,6 +231,15 @@ func NewMemDbBuffer() MemBuffer {
 
 // Seek creates an Iterator.
 func (m *memDbBuffer) Seek(k Key) (Iterator, error) {
+	if c := m.seekCache; c != nil {
+		i := &memDbIter{cache: c, gen: c.gen, prefix: c.prefix(k)}
+		if i.iter = c.take(k); i.iter != nil {
+			return i, nil
+		}
+		i.iter = m.db.NewIterator(&util.Range{Start: []byte(k)})
+		i.iter.Next()
+		return i, nil
+	}
 	var i Iterator
 	if k == nil {
 		i = &memDbIter{iter: m.db.NewIterator(&util.Range{}), reverse: false}
@@ -75,6 +264,24 @@ func (m *memDbBuffer) SeekReverse(k Key) (Iterator, error) {
 	return i, nil
 }
 
+// SetSeekCache implements the SeekCacher SetSeekCache interface.
+func (m *memDbBuffer) SetSeekCache(capacity int, prefixLen int) {
+	if m.seekCache != nil {
+		m.seekCache.reset()
+		m.seekCache = nil
+	}
+	if capacity > 0 {
+		m.seekCache = &seekCache{capacity: capacity, prefixLen: prefixLen}
+	}
+}
+
+// invalidateSeekCache drops the seek cache before a write.
+func (m *memDbBuffer) invalidateSeekCache() {
+	if m.seekCache != nil {
+		m.seekCache.reset()
+	}
+}
+
 // Get returns the value associated with key.
 func (m *memDbBuffer) Get(k Key) ([]byte, error) {
 	v, err := m.db.Get(k)
@@ -93,22 +300,192 @@ func (m *memDbBuffer) Set(k Key, v []byte) error {
 		return ErrEntryTooLarge.Gen("entry too large, size: %d", len(k)+len(v))
 	}
 
-	err := m.db.Put(k, v)
-	if m.Size() > m.bufferSizeLimit {
+	m.invalidateSeekCache()
+	size, length := m.Size(), m.Len()
+	if err := m.db.Put(k, v); err != nil {
+		return errors.Trace(err)
+	}
+	return m.chargeWrite(size, length)
+}
+
+// chargeWrite checks the buffer limits after a write, the buffer had size
+// and length before it, and takes the room of the write from the
+// reservation. The reservation is only charged if the limits are met.
+func (m *memDbBuffer) chargeWrite(size, length int) error {
+	if m.limitsSuspended {
+		return nil
+	}
+	reservedEntries, reservedBytes := m.reservedEntries(), m.reservedBytes()
+	if r := m.reservation; r != nil {
+		reservedEntries, reservedBytes = r.after(m.Len()-length, m.Size()-size)
+	}
+	if m.Size()+reservedBytes > m.bufferSizeLimit {
 		return ErrTxnTooLarge.Gen("transaction too large, size:%d", m.Size())
 	}
-	if m.Len() > int(m.bufferLenLimit) {
+	if m.Len()+reservedEntries > int(m.bufferLenLimit) {
 		return ErrTxnTooLarge.Gen("transaction too large, len:%d", m.Len())
 	}
-	return errors.Trace(err)
+	if r := m.reservation; r != nil {
+		r.entries, r.bytes = reservedEntries, reservedBytes
+	}
+	return nil
+}
+
+func (m *memDbBuffer) suspendLimits(suspend bool) {
+	m.limitsSuspended = suspend
+}
+
+// Reserve implements the Reserver Reserve interface.
+func (m *memDbBuffer) Reserve(entries int, bytes int) (*Reservation, error) {
+	if m.reservation != nil {
+		return nil, errors.Trace(ErrReservationPending)
+	}
+	if entries < 0 || bytes < 0 {
+		return nil, errors.Errorf("invalid reservation, entries:%d, bytes:%d", entries, bytes)
+	}
+	if m.Size()+bytes > m.bufferSizeLimit {
+		return nil, ErrTxnTooLarge.Gen("reservation too large, size:%d", m.Size()+bytes)
+	}
+	if m.Len()+entries > int(m.bufferLenLimit) {
+		return nil, ErrTxnTooLarge.Gen("reservation too large, len:%d", m.Len()+entries)
+	}
+	m.reservation = &Reservation{
+		m:          m,
+		entries:    entries,
+		bytes:      bytes,
+		maxEntries: entries,
+		maxBytes:   bytes,
+	}
+	return m.reservation, nil
+}
+
+func (m *memDbBuffer) reservedBytes() int {
+	if m.reservation == nil {
+		return 0
+	}
+	return m.reservation.bytes
+}
+
+func (m *memDbBuffer) reservedEntries() int {
+	if m.reservation == nil {
+		return 0
+	}
+	return m.reservation.entries
+}
+
+// after returns the room left after a write takes its room from the
+// reservation. A write which shrinks the buffer gives its room back, up to
+// the reserved room.
+func (r *Reservation) after(entries int, bytes int) (int, int) {
+	return clampRoom(r.entries-entries, r.maxEntries), clampRoom(r.bytes-bytes, r.maxBytes)
+}
+
+func clampRoom(room, max int) int {
+	if room < 0 {
+		return 0
+	}
+	if room > max {
+		return max
+	}
+	return room
+}
+
+// Remaining returns the reserved room which is not used yet.
+func (r *Reservation) Remaining() (entries int, bytes int) {
+	return r.entries, r.bytes
+}
+
+// Commit ends the reservation after the batch is written, the unused room is
+// released to the other writes.
+func (r *Reservation) Commit() {
+	r.release()
+}
+
+// Cancel ends the reservation when the batch is abandoned. The entries which
+// are already written are kept in the buffer, the unused room is released.
+func (r *Reservation) Cancel() {
+	r.release()
+}
+
+func (r *Reservation) release() {
+	if r.m.reservation == r {
+		r.m.reservation = nil
+	}
+	r.entries, r.bytes = 0, 0
+}
+
+// BulkLoad implements the BulkLoader interface.
+// The buffer limits and the reservation are checked after each pair, so a
+// stream too large for the buffer stops at the first pair over the limits.
+func (m *memDbBuffer) BulkLoad(iter func() (Key, []byte, bool)) error {
+	m.invalidateSeekCache()
+	var last Key
+	it := m.db.NewIterator(&util.Range{})
+	hasLast := it.Last()
+	if hasLast {
+		last = append(last, it.Key()...)
+	}
+	it.Release()
+
+	for {
+		k, v, ok := iter()
+		if !ok {
+			break
+		}
+		if len(v) == 0 {
+			return errors.Trace(ErrCannotSetNilValue)
+		}
+		if len(k)+len(v) > m.entrySizeLimit {
+			return ErrEntryTooLarge.Gen("entry too large, size: %d", len(k)+len(v))
+		}
+		if hasLast && k.Cmp(last) <= 0 {
+			return ErrKeyOutOfOrder.Gen("key %q is not greater than %q", k, last)
+		}
+		size, length := m.Size(), m.Len()
+		if err := m.db.Put(k, v); err != nil {
+			return errors.Trace(err)
+		}
+		if err := m.chargeWrite(size, length); err != nil {
+			return errors.Trace(err)
+		}
+		last = append(last[:0], k...)
+		hasLast = true
+	}
+	return nil
 }
 
 // Delete removes the entry from buffer with provided key.
 func (m *memDbBuffer) Delete(k Key) error {
+	m.invalidateSeekCache()
 	err := m.db.Put(k, nil)
 	return errors.Trace(err)
 }
 
+// BatchDelete removes the entries from buffer with provided keys.
+func (m *memDbBuffer) BatchDelete(keys []Key) error {
+	m.invalidateSeekCache()
+	for _, k := range keys {
+		if err := m.db.Put(k, nil); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// remove drops the entry of k from buffer, it's a no-op if k is not buffered.
+func (m *memDbBuffer) remove(k Key) error {
+	m.invalidateSeekCache()
+	err := m.db.Delete(k)
+	if terror.ErrorEqual(err, leveldb.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	m.removedNodes++
+	return nil
+}
+
 // Size returns sum of keys and values length.
 func (m *memDbBuffer) Size() int {
 	return m.db.Size()
@@ -119,6 +496,46 @@ func (m *memDbBuffer) Len() int {
 	return m.db.Len()
 }
 
+// MemUsage returns the bytes of all the keys and values written, including
+// the dead ones left behind by overwrites and removes, plus the estimated
+// overhead of all the skip-list nodes, including the removed ones. The dead
+// bytes and nodes are freed by Compact.
+func (m *memDbBuffer) MemUsage() int {
+	written := m.db.Capacity() - m.db.Free()
+	return written + (m.db.Len()+m.removedNodes)*memDbEntryOverhead
+}
+
+// Fragmentation implements the Compactor Fragmentation interface.
+// memdb.DB appends every Put to its data, so the bytes of the old values
+// are left behind.
+func (m *memDbBuffer) Fragmentation() float64 {
+	used := m.db.Size()
+	dead := m.db.Capacity() - m.db.Free() - used
+	if dead == 0 {
+		return 0
+	}
+	if used == 0 {
+		return math.Inf(1)
+	}
+	return float64(dead) / float64(used)
+}
+
+// Compact implements the Compactor Compact interface.
+func (m *memDbBuffer) Compact() error {
+	m.invalidateSeekCache()
+	db := memdb.New(comparer.DefaultComparer, m.db.Size())
+	iter := m.db.NewIterator(&util.Range{})
+	defer iter.Release()
+	for iter.Next() {
+		if err := db.Put(iter.Key(), iter.Value()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	m.db = db
+	m.removedNodes = 0
+	return nil
+}
+
 // Next implements the Iterator Next.
 func (i *memDbIter) Next() error {
 	if i.reverse {
@@ -145,6 +562,13 @@ func (i *memDbIter) Value() []byte {
 }
 
 // Close Implements the Iterator Close.
+// With the seek cache enabled, the position of a valid iterator is cached
+// unless the buffer is written after the iterator is created.
 func (i *memDbIter) Close() {
+	if c := i.cache; c != nil && c.gen == i.gen && i.iter.Valid() {
+		i.cache = nil
+		c.put(i.prefix, i.iter)
+		return
+	}
 	i.iter.Release()
 }
@@ -83,6 +83,10 @@ func (t *mockTxn) Delete(k Key) error {
 	return nil
 }
 
+func (t *mockTxn) BatchDelete(keys []Key) error {
+	return nil
+}
+
 func (t *mockTxn) Valid() bool {
 	return t.valid
 }
@@ -95,6 +99,10 @@ func (t *mockTxn) Size() int {
 	return 0
 }
 
+func (t *mockTxn) MemUsage() int {
+	return 0
+}
+
 // mockStorage is used to start a must commit-failed txn.
 type mockStorage struct {
 }
@@ -177,6 +185,27 @@ func (s *mockSnapshot) BatchGet(keys []Key) (map[string][]byte, error) {
 	return m, nil
 }
 
+func (s *mockSnapshot) EstimateRangeCount(start, end Key) (int64, error) {
+	return -1, nil
+}
+
+func (s *mockSnapshot) Release() {}
+
+func (s *mockSnapshot) BatchExist(keys []Key) (map[string]bool, error) {
+	m := make(map[string]bool)
+	for _, k := range keys {
+		_, err := s.store.Get(k)
+		if IsErrNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		m[string(k)] = true
+	}
+	return m, nil
+}
+
 func (s *mockSnapshot) Seek(k Key) (Iterator, error) {
 	return s.store.Seek(k)
 }
@@ -0,0 +1,482 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// prefixedUnionStore is a UnionStore over the keys of inner with prefix, the
+// prefix is prepended to the keys passed in and stripped from the keys
+// returned. The methods which read or report the buffered writes and the lazy
+// condition pairs, like WalkBuffer, Size, Dirty and CheckLazyConditionPairsAll,
+// only see the keys with the prefix. The methods which set up, check or end
+// the transaction, like the options, PreCommit, CheckLazyConditionPairs, Seal
+// and Release, and MemUsage are the ones of inner and work on the whole store,
+// so the errors they return and the options like KeyValidator and
+// CommitFilter see the prefixed keys.
+type prefixedUnionStore struct {
+	UnionStore
+	prefix Key
+	// end is the upper bound of the keys with prefix, nil means no bound.
+	end Key
+}
+
+// NewPrefixedUnionStore creates a UnionStore which works in the keyspace of
+// prefix in inner, so the callers read and write the keys without prefix.
+func NewPrefixedUnionStore(inner UnionStore, prefix Key) UnionStore {
+	return &prefixedUnionStore{
+		UnionStore: inner,
+		prefix:     prefix.Clone(),
+		end:        prefixEnd(prefix),
+	}
+}
+
+// prefixEnd returns the least key greater than all the keys with prefix, or
+// nil if there is none, i.e. prefix is empty or all 0xff.
+func prefixEnd(prefix Key) Key {
+	for _, b := range prefix {
+		if b != 0xff {
+			return prefix.PrefixNext()
+		}
+	}
+	return nil
+}
+
+// key prepends the prefix to k.
+func (s *prefixedUnionStore) key(k Key) Key {
+	buf := make(Key, 0, len(s.prefix)+len(k))
+	return append(append(buf, s.prefix...), k...)
+}
+
+// keys prepends the prefix to each key.
+func (s *prefixedUnionStore) keys(keys []Key) []Key {
+	prefixed := make([]Key, len(keys))
+	for i, k := range keys {
+		prefixed[i] = s.key(k)
+	}
+	return prefixed
+}
+
+// bound prepends the prefix to the upper bound end, a nil end is translated
+// to the end of the prefix.
+func (s *prefixedUnionStore) bound(end Key) Key {
+	if end == nil {
+		return s.end
+	}
+	return s.key(end)
+}
+
+// strip removes the prefix from k, it shares the memory of k.
+func (s *prefixedUnionStore) strip(k Key) Key {
+	return k[len(s.prefix):]
+}
+
+// walk wraps f to be called with the stripped keys.
+func (s *prefixedUnionStore) walk(f func(k Key, v []byte) error) func(k Key, v []byte) error {
+	return func(k Key, v []byte) error {
+		return f(s.strip(k), v)
+	}
+}
+
+// Get implements the Retriever Get interface.
+func (s *prefixedUnionStore) Get(k Key) ([]byte, error) {
+	v, err := s.UnionStore.Get(s.key(k))
+	return v, errors.Trace(err)
+}
+
+// Seek implements the Retriever Seek interface.
+func (s *prefixedUnionStore) Seek(k Key) (Iterator, error) {
+	it, err := s.UnionStore.Seek(s.key(k))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return newPrefixIter(it, s.prefix), nil
+}
+
+// SeekReverse implements the Retriever SeekReverse interface.
+func (s *prefixedUnionStore) SeekReverse(k Key) (Iterator, error) {
+	it, err := s.UnionStore.SeekReverse(s.bound(k))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return newPrefixIter(it, s.prefix), nil
+}
+
+// SeekLast implements the UnionStore SeekLast interface.
+func (s *prefixedUnionStore) SeekLast() (Iterator, error) {
+	return s.SeekReverse(nil)
+}
+
+// SeekUntil implements the UnionStore SeekUntil interface.
+func (s *prefixedUnionStore) SeekUntil(start Key, stop func(k Key, v []byte) bool) (Iterator, error) {
+	it, err := s.Seek(start)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return newStopIter(it, stop), nil
+}
+
+// SeekSnapshotOnly implements the UnionStore SeekSnapshotOnly interface.
+func (s *prefixedUnionStore) SeekSnapshotOnly(start, end Key) (Iterator, error) {
+	it, err := s.UnionStore.SeekSnapshotOnly(s.key(start), s.bound(end))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return newPrefixIter(it, s.prefix), nil
+}
+
+// Set implements the Mutator Set interface.
+func (s *prefixedUnionStore) Set(k Key, v []byte) error {
+	return errors.Trace(s.UnionStore.Set(s.key(k), v))
+}
+
+// Delete implements the Mutator Delete interface.
+func (s *prefixedUnionStore) Delete(k Key) error {
+	return errors.Trace(s.UnionStore.Delete(s.key(k)))
+}
+
+// BatchDelete implements the MemBuffer BatchDelete interface.
+func (s *prefixedUnionStore) BatchDelete(keys []Key) error {
+	return errors.Trace(s.UnionStore.BatchDelete(s.keys(keys)))
+}
+
+// WalkBuffer implements the UnionStore WalkBuffer interface.
+func (s *prefixedUnionStore) WalkBuffer(f func(k Key, v []byte) error) error {
+	return errors.Trace(s.UnionStore.WalkBufferRangeLimit(s.prefix, s.end, 0, s.walk(f)))
+}
+
+// WalkBufferRangeLimit implements the UnionStore WalkBufferRangeLimit interface.
+func (s *prefixedUnionStore) WalkBufferRangeLimit(start, end Key, limit int, f func(k Key, v []byte) error) error {
+	return errors.Trace(s.UnionStore.WalkBufferRangeLimit(s.key(start), s.bound(end), limit, s.walk(f)))
+}
+
+// WalkBufferWithMeta implements the UnionStore WalkBufferWithMeta interface.
+func (s *prefixedUnionStore) WalkBufferWithMeta(f func(k Key, v []byte, meta []byte) error) error {
+	return s.WalkBuffer(func(k Key, v []byte) error {
+		return f(k, v, s.GetMeta(k))
+	})
+}
+
+// Update implements the UnionStore Update interface.
+func (s *prefixedUnionStore) Update(k Key, f func(old []byte, exists bool) (new []byte, delete bool, err error)) error {
+	return errors.Trace(s.UnionStore.Update(s.key(k), f))
+}
+
+// UndoKey implements the UnionStore UndoKey interface.
+func (s *prefixedUnionStore) UndoKey(k Key) error {
+	return errors.Trace(s.UnionStore.UndoKey(s.key(k)))
+}
+
+// BatchAssertNotExists implements the UnionStore BatchAssertNotExists interface.
+func (s *prefixedUnionStore) BatchAssertNotExists(keys []Key) error {
+	return errors.Trace(s.UnionStore.BatchAssertNotExists(s.keys(keys)))
+}
+
+// CheckBatchUnique implements the UnionStore CheckBatchUnique interface.
+func (s *prefixedUnionStore) CheckBatchUnique(keys []Key) ([]Key, error) {
+	dupes, err := s.UnionStore.CheckBatchUnique(s.keys(keys))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for i, k := range dupes {
+		dupes[i] = s.strip(k)
+	}
+	return dupes, nil
+}
+
+// BatchAssertEquals implements the UnionStore BatchAssertEquals interface.
+func (s *prefixedUnionStore) BatchAssertEquals(pairs []KeyValue) error {
+	prefixed := make([]KeyValue, len(pairs))
+	for i, p := range pairs {
+		prefixed[i] = KeyValue{Key: s.key(p.Key), Value: p.Value}
+	}
+	return errors.Trace(s.UnionStore.BatchAssertEquals(prefixed))
+}
+
+// Resolve implements the UnionStore Resolve interface.
+func (s *prefixedUnionStore) Resolve(k Key) ([]byte, EntrySource, bool, error) {
+	v, src, exists, err := s.UnionStore.Resolve(s.key(k))
+	return v, src, exists, errors.Trace(err)
+}
+
+// GetWithOld implements the UnionStore GetWithOld interface.
+func (s *prefixedUnionStore) GetWithOld(k Key) ([]byte, []byte, error) {
+	newVal, oldVal, err := s.UnionStore.GetWithOld(s.key(k))
+	return newVal, oldVal, errors.Trace(err)
+}
+
+// DeleteWithCondition implements the UnionStore DeleteWithCondition interface.
+func (s *prefixedUnionStore) DeleteWithCondition(k Key, expect []byte) error {
+	return errors.Trace(s.UnionStore.DeleteWithCondition(s.key(k), expect))
+}
+
+// PrepareRetry implements the UnionStore PrepareRetry interface.
+func (s *prefixedUnionStore) PrepareRetry(conflictKeys []Key) error {
+	return errors.Trace(s.UnionStore.PrepareRetry(s.keys(conflictKeys)))
+}
+
+// LockKeys implements the UnionStore LockKeys interface.
+// Only the keys with the prefix are returned.
+func (s *prefixedUnionStore) LockKeys() []Key {
+	var keys []Key
+	for _, k := range s.UnionStore.LockKeys() {
+		if k.HasPrefix(s.prefix) {
+			keys = append(keys, s.strip(k))
+		}
+	}
+	return keys
+}
+
+// SetWithMeta implements the UnionStore SetWithMeta interface.
+func (s *prefixedUnionStore) SetWithMeta(k Key, v []byte, meta []byte) error {
+	return errors.Trace(s.UnionStore.SetWithMeta(s.key(k), v, meta))
+}
+
+// GetMeta implements the UnionStore GetMeta interface.
+func (s *prefixedUnionStore) GetMeta(k Key) []byte {
+	return s.UnionStore.GetMeta(s.key(k))
+}
+
+// SetWithTTL implements the UnionStore SetWithTTL interface.
+func (s *prefixedUnionStore) SetWithTTL(k Key, v []byte, ttl time.Duration) error {
+	return errors.Trace(s.UnionStore.SetWithTTL(s.key(k), v, ttl))
+}
+
+// GetTTL implements the UnionStore GetTTL interface.
+func (s *prefixedUnionStore) GetTTL(k Key) time.Duration {
+	return s.UnionStore.GetTTL(s.key(k))
+}
+
+// History implements the UnionStore History interface.
+func (s *prefixedUnionStore) History(k Key) ([]HistoryEntry, error) {
+	h, err := s.UnionStore.History(s.key(k))
+	return h, errors.Trace(err)
+}
+
+// BufferedSince implements the UnionStore BufferedSince interface.
+func (s *prefixedUnionStore) BufferedSince(k Key) (time.Time, bool) {
+	return s.UnionStore.BufferedSince(s.key(k))
+}
+
+// EstimateRangeCount implements the UnionStore EstimateRangeCount interface.
+func (s *prefixedUnionStore) EstimateRangeCount(start, end Key) (int64, error) {
+	cnt, err := s.UnionStore.EstimateRangeCount(s.key(start), s.bound(end))
+	return cnt, errors.Trace(err)
+}
+
+// WalkCommitMutations implements the UnionStore WalkCommitMutations interface.
+// Only the writes of the keys with the prefix are visited.
+func (s *prefixedUnionStore) WalkCommitMutations(f func(op Op) error) error {
+	err := s.UnionStore.WalkCommitMutations(func(op Op) error {
+		if !op.Key.HasPrefix(s.prefix) {
+			return nil
+		}
+		op.Key = s.strip(op.Key)
+		return f(op)
+	})
+	return errors.Trace(err)
+}
+
+// ApplyMutations implements the UnionStore ApplyMutations interface.
+func (s *prefixedUnionStore) ApplyMutations(ops []Op) error {
+	prefixed := make([]Op, len(ops))
+	for i, op := range ops {
+		op.Key = s.key(op.Key)
+		prefixed[i] = op
+	}
+	return errors.Trace(s.UnionStore.ApplyMutations(prefixed))
+}
+
+// HotKeys implements the UnionStore HotKeys interface.
+// Only the keys with the prefix are counted.
+func (s *prefixedUnionStore) HotKeys(topN int) []KeyCount {
+	var counts []KeyCount
+	for _, kc := range s.UnionStore.HotKeys(-1) {
+		if topN >= 0 && len(counts) >= topN {
+			break
+		}
+		if kc.Key.HasPrefix(s.prefix) {
+			counts = append(counts, KeyCount{Key: s.strip(kc.Key), Count: kc.Count})
+		}
+	}
+	return counts
+}
+
+// SizeByPrefix implements the UnionStore SizeByPrefix interface.
+// Only the keys with the prefix are counted, grouped and sized without it.
+func (s *prefixedUnionStore) SizeByPrefix(prefixLen int) map[string]int {
+	if prefixLen < 0 {
+		prefixLen = 0
+	}
+	sizes := make(map[string]int)
+	s.WalkBuffer(func(k Key, v []byte) error {
+		prefix := k
+		if len(prefix) > prefixLen {
+			prefix = prefix[:prefixLen]
+		}
+		sizes[string(prefix)] += len(k) + len(v)
+		return nil
+	})
+	return sizes
+}
+
+// DumpBuffer implements the UnionStore DumpBuffer interface.
+func (s *prefixedUnionStore) DumpBuffer(limit int) []BufferEntry {
+	var entries []BufferEntry
+	s.WalkBufferRangeLimit(nil, nil, limit, func(k Key, v []byte) error {
+		entries = append(entries, BufferEntry{
+			Key:       k.Clone(),
+			Tombstone: len(v) == 0,
+			ValueLen:  len(v),
+		})
+		return nil
+	})
+	return entries
+}
+
+// WalkShadowed implements the UnionStore WalkShadowed interface.
+func (s *prefixedUnionStore) WalkShadowed(start, end Key, f func(k Key, old, new []byte) error) error {
+	err := s.UnionStore.WalkShadowed(s.key(start), s.bound(end), func(k Key, old, new []byte) error {
+		return f(s.strip(k), old, new)
+	})
+	return errors.Trace(err)
+}
+
+// RangeFullyBuffered implements the UnionStore RangeFullyBuffered interface.
+func (s *prefixedUnionStore) RangeFullyBuffered(start, end Key) (bool, error) {
+	ok, err := s.UnionStore.RangeFullyBuffered(s.key(start), s.bound(end))
+	return ok, errors.Trace(err)
+}
+
+// Len implements the MemBuffer Len interface.
+// Only the keys with the prefix are counted.
+func (s *prefixedUnionStore) Len() int {
+	n := 0
+	s.WalkBuffer(func(k Key, v []byte) error {
+		n++
+		return nil
+	})
+	return n
+}
+
+// Size implements the MemBuffer Size interface.
+// Only the keys with the prefix are counted, sized without it.
+func (s *prefixedUnionStore) Size() int {
+	size := 0
+	s.WalkBuffer(func(k Key, v []byte) error {
+		size += len(k) + len(v)
+		return nil
+	})
+	return size
+}
+
+// Dirty implements the UnionStore Dirty interface.
+// It reports whether a key with the prefix is written.
+func (s *prefixedUnionStore) Dirty() bool {
+	dirty := false
+	s.WalkBufferRangeLimit(nil, nil, 1, func(k Key, v []byte) error {
+		dirty = true
+		return nil
+	})
+	return dirty
+}
+
+// SizeHistogram implements the UnionStore SizeHistogram interface.
+func (s *prefixedUnionStore) SizeHistogram() (keyHist, valHist []int) {
+	return sizeHistogram(s.WalkBuffer)
+}
+
+// WriteSetChecksum implements the UnionStore WriteSetChecksum interface.
+func (s *prefixedUnionStore) WriteSetChecksum() (uint64, error) {
+	sum, err := writeSetChecksum(s.WalkBuffer)
+	return sum, errors.Trace(err)
+}
+
+// CheckLazyConditionPairsAll implements the UnionStore CheckLazyConditionPairsAll interface.
+// Only the violations of the keys with the prefix are returned.
+func (s *prefixedUnionStore) CheckLazyConditionPairsAll() ([]ConditionViolation, error) {
+	all, err := s.UnionStore.CheckLazyConditionPairsAll()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var violations []ConditionViolation
+	for _, v := range all {
+		if v.Key.HasPrefix(s.prefix) {
+			v.Key = s.strip(v.Key)
+			violations = append(violations, v)
+		}
+	}
+	return violations, nil
+}
+
+// deletedConditionKeysLister is implemented by the UnionStores which can list
+// the keys ValidateConditionConsistency reports.
+type deletedConditionKeysLister interface {
+	deletedConditionKeys() ([]Key, error)
+}
+
+// ValidateConditionConsistency implements the UnionStore ValidateConditionConsistency interface.
+// Only the keys with the prefix are validated.
+func (s *prefixedUnionStore) ValidateConditionConsistency() error {
+	keys, err := s.deletedConditionKeys()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return errors.Errorf("keys %q must not exist but are deleted", keys)
+}
+
+func (s *prefixedUnionStore) deletedConditionKeys() ([]Key, error) {
+	lister, ok := s.UnionStore.(deletedConditionKeysLister)
+	if !ok {
+		return nil, errors.Trace(ErrNotImplemented)
+	}
+	all, err := lister.deletedConditionKeys()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var keys []Key
+	for _, k := range all {
+		if k.HasPrefix(s.prefix) {
+			keys = append(keys, s.strip(k))
+		}
+	}
+	return keys, nil
+}
+
+// prefixIter wraps an Iterator of the prefixed keys, it stops at the first
+// key without the prefix and strips the prefix from the keys.
+type prefixIter struct {
+	Iterator
+	prefix Key
+}
+
+func newPrefixIter(it Iterator, prefix Key) Iterator {
+	return &prefixIter{Iterator: it, prefix: prefix}
+}
+
+// Valid implements the Iterator Valid interface.
+func (it *prefixIter) Valid() bool {
+	return it.Iterator.Valid() && it.Iterator.Key().HasPrefix(it.prefix)
+}
+
+// Key implements the Iterator Key interface.
+func (it *prefixIter) Key() Key {
+	return it.Iterator.Key()[len(it.prefix):]
+}
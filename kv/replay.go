@@ -0,0 +1,94 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+)
+
+// OpType is the type of a MemBuffer operation recorded in an Op.
+type OpType int
+
+// MemBuffer operation types.
+const (
+	OpSet OpType = iota + 1
+	OpDelete
+	OpGet
+	OpSeek
+)
+
+// Op is a single MemBuffer operation. Value is only used by OpSet.
+type Op struct {
+	Tp    OpType
+	Key   Key
+	Value []byte
+}
+
+// String implements fmt.Stringer interface.
+func (op Op) String() string {
+	switch op.Tp {
+	case OpSet:
+		return fmt.Sprintf("set(%q, %q)", op.Key, op.Value)
+	case OpDelete:
+		return fmt.Sprintf("delete(%q)", op.Key)
+	case OpGet:
+		return fmt.Sprintf("get(%q)", op.Key)
+	case OpSeek:
+		return fmt.Sprintf("seek(%q)", op.Key)
+	}
+	return fmt.Sprintf("unknown(%d)", op.Tp)
+}
+
+// ReplayOps applies ops to mb in order. It is used to reproduce a sequence
+// of buffer operations, e.g. one found by a randomized test, deterministically.
+// Reads of nonexistent keys are not treated as errors. A Seek walks the
+// returned iterator to the end before closing it.
+func ReplayOps(mb MemBuffer, ops []Op) error {
+	for i, op := range ops {
+		if err := replayOp(mb, op); err != nil {
+			return errors.Annotatef(err, "op %d %v", i, op)
+		}
+	}
+	return nil
+}
+
+func replayOp(mb MemBuffer, op Op) error {
+	switch op.Tp {
+	case OpSet:
+		return errors.Trace(mb.Set(op.Key, op.Value))
+	case OpDelete:
+		return errors.Trace(mb.Delete(op.Key))
+	case OpGet:
+		_, err := mb.Get(op.Key)
+		if IsErrNotFound(err) {
+			return nil
+		}
+		return errors.Trace(err)
+	case OpSeek:
+		iter, err := mb.Seek(op.Key)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer iter.Close()
+		for iter.Valid() {
+			if err = iter.Next(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	}
+	return errors.Errorf("unknown op type %d", op.Tp)
+}
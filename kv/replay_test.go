@@ -0,0 +1,138 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+var _ = Suite(&testReplaySuite{})
+
+type testReplaySuite struct{}
+
+// mapOracle is a reference implementation of the MemBuffer semantics used by
+// memDbBuffer: a deleted key is kept as a tombstone with an empty value.
+type mapOracle map[string][]byte
+
+func (m mapOracle) apply(op Op) {
+	switch op.Tp {
+	case OpSet:
+		m[string(op.Key)] = op.Value
+	case OpDelete:
+		m[string(op.Key)] = []byte{}
+	}
+}
+
+func (m mapOracle) get(k Key) ([]byte, bool) {
+	v, ok := m[string(k)]
+	return v, ok
+}
+
+func (m mapOracle) seek(k Key) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		if key >= string(k) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func randomOps(rnd *rand.Rand, n int) []Op {
+	ops := make([]Op, 0, n)
+	for i := 0; i < n; i++ {
+		op := Op{
+			Tp:  OpType(rnd.Intn(4) + 1),
+			Key: Key(fmt.Sprintf("k%02d", rnd.Intn(32))),
+		}
+		if op.Tp == OpSet {
+			op.Value = []byte(fmt.Sprintf("v%d", rnd.Intn(1000)))
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func checkAgainstOracle(c *C, mb MemBuffer, oracle mapOracle, op Op) {
+	switch op.Tp {
+	case OpGet:
+		v, err := mb.Get(op.Key)
+		expect, ok := oracle.get(op.Key)
+		if !ok {
+			c.Assert(IsErrNotFound(err), IsTrue, Commentf("%v", op))
+			return
+		}
+		c.Assert(err, IsNil, Commentf("%v", op))
+		c.Assert(v, BytesEquals, expect, Commentf("%v", op))
+	case OpSeek:
+		iter, err := mb.Seek(op.Key)
+		c.Assert(err, IsNil)
+		defer iter.Close()
+		for _, k := range oracle.seek(op.Key) {
+			c.Assert(iter.Valid(), IsTrue, Commentf("%v", op))
+			c.Assert(string(iter.Key()), Equals, k, Commentf("%v", op))
+			c.Assert(iter.Value(), BytesEquals, oracle[k], Commentf("%v", op))
+			c.Assert(iter.Next(), IsNil)
+		}
+		c.Assert(iter.Valid(), IsFalse, Commentf("%v", op))
+	}
+}
+
+func (s *testReplaySuite) TestReplayOps(c *C) {
+	defer testleak.AfterTest(c)()
+	mb := NewMemDbBuffer()
+	ops := []Op{
+		{Tp: OpSet, Key: Key("a"), Value: []byte("1")},
+		{Tp: OpSet, Key: Key("b"), Value: []byte("2")},
+		{Tp: OpDelete, Key: Key("a")},
+		{Tp: OpGet, Key: Key("c")},
+		{Tp: OpSeek, Key: nil},
+	}
+	err := ReplayOps(mb, ops)
+	c.Assert(err, IsNil)
+	c.Assert(mb.Len(), Equals, 2)
+	v, err := mb.Get(Key("b"))
+	c.Assert(err, IsNil)
+	c.Assert(v, BytesEquals, []byte("2"))
+
+	err = ReplayOps(mb, []Op{{Tp: OpSet, Key: Key("a")}})
+	c.Assert(ErrCannotSetNilValue.Equal(err), IsTrue)
+	err = ReplayOps(mb, []Op{{Tp: OpType(0), Key: Key("a")}})
+	c.Assert(err, NotNil)
+}
+
+func (s *testReplaySuite) TestRandomOpsDifferential(c *C) {
+	defer testleak.AfterTest(c)()
+	seed := int64(20171214)
+	rnd := rand.New(rand.NewSource(seed))
+	for round := 0; round < 20; round++ {
+		ops := randomOps(rnd, 200)
+		mb := NewMemDbBuffer()
+		oracle := make(mapOracle)
+		for _, op := range ops {
+			err := ReplayOps(mb, []Op{op})
+			c.Assert(err, IsNil, Commentf("seed %d round %d %v", seed, round, op))
+			oracle.apply(op)
+			checkAgainstOracle(c, mb, oracle, op)
+		}
+		c.Assert(mb.Len(), Equals, len(oracle))
+		checkAgainstOracle(c, mb, oracle, Op{Tp: OpSeek})
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+)
+
+type sliceBufferFactory struct{}
+
+func (f sliceBufferFactory) NewMemBuffer() MemBuffer {
+	return NewSliceBuffer()
+}
+
+// SliceBufferFactory creates MemBuffers by NewSliceBuffer.
+var SliceBufferFactory MemBufferFactory = sliceBufferFactory{}
+
+// sliceBufferEntryOverhead is the estimated per-entry overhead of sliceBuffer,
+// which is the slice headers of the key and the value.
+const sliceBufferEntryOverhead = 48
+
+// sliceBuffer is a MemBuffer which keeps entries in a slice sorted by key.
+// Writes are O(n) except the ascending ones, which are appended, so it only
+// fits small buffers or ascending writes, but the implementation is simple
+// enough to serve as a reference of the MemBuffer contract.
+type sliceBuffer struct {
+	entries         []KeyValue
+	size            int
+	entrySizeLimit  int
+	bufferLenLimit  uint64
+	bufferSizeLimit int
+	// limitsSuspended skips the buffer size and length limits, see
+	// BufferStore.SuspendSizeTracking.
+	limitsSuspended bool
+}
+
+// NewSliceBuffer creates a new sliceBuffer.
+func NewSliceBuffer() MemBuffer {
+	return &sliceBuffer{
+		entrySizeLimit:  TxnEntrySizeLimit,
+		bufferLenLimit:  atomic.LoadUint64(&TxnEntryCountLimit),
+		bufferSizeLimit: TxnTotalSizeLimit,
+	}
+}
+
+// search returns the index of the first entry whose key is not less than k.
+func (b *sliceBuffer) search(k Key) int {
+	return sort.Search(len(b.entries), func(i int) bool {
+		return b.entries[i].Key.Cmp(k) >= 0
+	})
+}
+
+// Get returns the value associated with key.
+func (b *sliceBuffer) Get(k Key) ([]byte, error) {
+	i := b.search(k)
+	if i < len(b.entries) && b.entries[i].Key.Cmp(k) == 0 {
+		return b.entries[i].Value, nil
+	}
+	return nil, ErrNotExist
+}
+
+// Seek creates an Iterator.
+func (b *sliceBuffer) Seek(k Key) (Iterator, error) {
+	return &sliceBufferIter{b: b, idx: b.search(k)}, nil
+}
+
+// SeekReverse creates a reversed Iterator.
+func (b *sliceBuffer) SeekReverse(k Key) (Iterator, error) {
+	idx := len(b.entries) - 1
+	if k != nil {
+		idx = b.search(k) - 1
+	}
+	return &sliceBufferIter{b: b, idx: idx, reverse: true}, nil
+}
+
+func (b *sliceBuffer) put(k Key, v []byte) {
+	// Ascending writes are appended without the search.
+	if n := len(b.entries); n == 0 || b.entries[n-1].Key.Cmp(k) < 0 {
+		b.entries = append(b.entries, KeyValue{Key: k.Clone(), Value: append([]byte{}, v...)})
+		b.size += len(k) + len(v)
+		return
+	}
+	i := b.search(k)
+	if i < len(b.entries) && b.entries[i].Key.Cmp(k) == 0 {
+		b.size += len(v) - len(b.entries[i].Value)
+		b.entries[i].Value = append([]byte{}, v...)
+		return
+	}
+	b.entries = append(b.entries, KeyValue{})
+	copy(b.entries[i+1:], b.entries[i:])
+	b.entries[i] = KeyValue{Key: k.Clone(), Value: append([]byte{}, v...)}
+	b.size += len(k) + len(v)
+}
+
+// Set associates key with value.
+func (b *sliceBuffer) Set(k Key, v []byte) error {
+	if len(v) == 0 {
+		return errors.Trace(ErrCannotSetNilValue)
+	}
+	if len(k)+len(v) > b.entrySizeLimit {
+		return ErrEntryTooLarge.Gen("entry too large, size: %d", len(k)+len(v))
+	}
+	b.put(k, v)
+	if b.limitsSuspended {
+		return nil
+	}
+	if b.Size() > b.bufferSizeLimit {
+		return ErrTxnTooLarge.Gen("transaction too large, size:%d", b.Size())
+	}
+	if b.Len() > int(b.bufferLenLimit) {
+		return ErrTxnTooLarge.Gen("transaction too large, len:%d", b.Len())
+	}
+	return nil
+}
+
+func (b *sliceBuffer) suspendLimits(suspend bool) {
+	b.limitsSuspended = suspend
+}
+
+// Delete removes the entry from buffer with provided key.
+func (b *sliceBuffer) Delete(k Key) error {
+	b.put(k, nil)
+	return nil
+}
+
+// BatchDelete removes the entries from buffer with provided keys.
+func (b *sliceBuffer) BatchDelete(keys []Key) error {
+	for _, k := range keys {
+		b.put(k, nil)
+	}
+	return nil
+}
+
+func (b *sliceBuffer) remove(k Key) error {
+	i := b.search(k)
+	if i < len(b.entries) && b.entries[i].Key.Cmp(k) == 0 {
+		b.size -= len(b.entries[i].Key) + len(b.entries[i].Value)
+		b.entries = append(b.entries[:i], b.entries[i+1:]...)
+	}
+	return nil
+}
+
+// Size returns sum of keys and values length.
+func (b *sliceBuffer) Size() int {
+	return b.size
+}
+
+// Len returns the number of entries in the buffer.
+func (b *sliceBuffer) Len() int {
+	return len(b.entries)
+}
+
+// MemUsage returns sum of keys and values length plus the slice headers of all entries.
+func (b *sliceBuffer) MemUsage() int {
+	return b.size + len(b.entries)*sliceBufferEntryOverhead
+}
+
+// sliceBufferIter is the Iterator of sliceBuffer. It must not be used
+// after the buffer is modified.
+type sliceBufferIter struct {
+	b       *sliceBuffer
+	idx     int
+	reverse bool
+}
+
+// Valid implements the Iterator Valid.
+func (i *sliceBufferIter) Valid() bool {
+	return i.b != nil && i.idx >= 0 && i.idx < len(i.b.entries)
+}
+
+// Key implements the Iterator Key.
+func (i *sliceBufferIter) Key() Key {
+	return i.b.entries[i.idx].Key
+}
+
+// Value implements the Iterator Value.
+func (i *sliceBufferIter) Value() []byte {
+	return i.b.entries[i.idx].Value
+}
+
+// Next implements the Iterator Next.
+func (i *sliceBufferIter) Next() error {
+	if i.reverse {
+		i.idx--
+	} else {
+		i.idx++
+	}
+	return nil
+}
+
+// Close implements the Iterator Close.
+func (i *sliceBufferIter) Close() {
+	i.b = nil
+}
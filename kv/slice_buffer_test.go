@@ -0,0 +1,84 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"math/rand"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+var _ = Suite(&testSliceBufferSuite{})
+
+type testSliceBufferSuite struct{}
+
+func checkSameReverse(c *C, a, b MemBuffer, k Key) {
+	ia, err := a.SeekReverse(k)
+	c.Assert(err, IsNil)
+	defer ia.Close()
+	ib, err := b.SeekReverse(k)
+	c.Assert(err, IsNil)
+	defer ib.Close()
+	for ia.Valid() {
+		c.Assert(ib.Valid(), IsTrue)
+		c.Assert([]byte(ib.Key()), BytesEquals, []byte(ia.Key()))
+		c.Assert(ib.Value(), BytesEquals, ia.Value())
+		c.Assert(ia.Next(), IsNil)
+		c.Assert(ib.Next(), IsNil)
+	}
+	c.Assert(ib.Valid(), IsFalse)
+}
+
+func (s *testSliceBufferSuite) TestDifferential(c *C) {
+	defer testleak.AfterTest(c)()
+	rnd := rand.New(rand.NewSource(20171215))
+	for round := 0; round < 10; round++ {
+		ops := randomOps(rnd, 300)
+		memDb := DefaultMemBufferFactory.NewMemBuffer()
+		slice := SliceBufferFactory.NewMemBuffer()
+		oracle := make(mapOracle)
+		for _, op := range ops {
+			c.Assert(ReplayOps(memDb, []Op{op}), IsNil)
+			c.Assert(ReplayOps(slice, []Op{op}), IsNil)
+			oracle.apply(op)
+			checkAgainstOracle(c, memDb, oracle, op)
+			checkAgainstOracle(c, slice, oracle, op)
+			c.Assert(slice.Len(), Equals, memDb.Len())
+			c.Assert(slice.Size(), Equals, memDb.Size())
+		}
+		checkSameReverse(c, memDb, slice, nil)
+		checkSameReverse(c, memDb, slice, Key("k16"))
+	}
+}
+
+func (s *testSliceBufferSuite) TestUnionStoreWithFactory(c *C) {
+	defer testleak.AfterTest(c)()
+	store := NewMemDbBuffer()
+	store.Set(Key("a"), []byte("1"))
+	store.Set(Key("b"), []byte("2"))
+	us := NewUnionStoreWithFactory(&mockSnapshot{store}, SliceBufferFactory)
+	c.Assert(us.Set(Key("c"), []byte("3")), IsNil)
+	c.Assert(us.Delete(Key("a")), IsNil)
+	_, ok := us.(*unionStore).MemBuffer.(*lazyMemBuffer).mb.(*sliceBuffer)
+	c.Assert(ok, IsTrue)
+
+	iter, err := us.Seek(nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("b"), []byte("c")}, [][]byte{[]byte("2"), []byte("3")})
+	c.Assert(us.UndoKey(Key("a")), IsNil)
+	v, err := us.Get(Key("a"))
+	c.Assert(err, IsNil)
+	c.Assert(v, BytesEquals, []byte("1"))
+}
@@ -31,6 +31,15 @@ type UnionIter struct {
 	reverse    bool
 }
 
+// EntrySource is the layer an entry of UnionIter comes from.
+type EntrySource int
+
+// EntrySource types.
+const (
+	SourceBuffer EntrySource = iota
+	SourceSnapshot
+)
+
 func newUnionIter(dirtyIt Iterator, snapshotIt Iterator, reverse bool) (*UnionIter, error) {
 	it := &UnionIter{
 		dirtyIt:       dirtyIt,
@@ -46,6 +55,34 @@ func newUnionIter(dirtyIt Iterator, snapshotIt Iterator, reverse bool) (*UnionIt
 	return it, nil
 }
 
+// NewMergingIterator creates an Iterator from start over several layers of
+// buffers on top of snapshot. An earlier buffer takes precedence over the
+// later ones and the snapshot is the lowest layer. A tombstone in a buffer
+// masks the key in all the layers below.
+func NewMergingIterator(buffers []MemBuffer, snapshot Snapshot, start Key) (Iterator, error) {
+	it, err := snapshot.Seek(start)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// The layers are merged from the lowest one, every UnionIter hides the
+	// tombstones of its buffer and masks the layers below.
+	for i := len(buffers) - 1; i >= 0; i-- {
+		bufferIt, err := buffers[i].Seek(start)
+		if err != nil {
+			it.Close()
+			return nil, errors.Trace(err)
+		}
+		unionIt, err := newUnionIter(bufferIt, it, false)
+		if err != nil {
+			bufferIt.Close()
+			it.Close()
+			return nil, errors.Trace(err)
+		}
+		it = unionIt
+	}
+	return it, nil
+}
+
 // Go next and update valid status.
 func (iter *UnionIter) dirtyNext() error {
 	err := iter.dirtyIt.Next()
@@ -166,6 +203,20 @@ func (iter *UnionIter) Key() Key {
 	return iter.dirtyIt.Key()
 }
 
+// Source returns the layer of the current entry. A buffered entry shadows
+// the snapshot one of the same key, so SourceBuffer is returned for it.
+// For the iterators of NewMergingIterator, the entries of all the buffers
+// are SourceBuffer.
+func (iter *UnionIter) Source() EntrySource {
+	if iter.curIsDirty {
+		return SourceBuffer
+	}
+	if it, ok := iter.snapshotIt.(*UnionIter); ok {
+		return it.Source()
+	}
+	return SourceSnapshot
+}
+
 // Valid implements the Iterator Valid interface.
 func (iter *UnionIter) Valid() bool {
 	return iter.isValid
@@ -15,6 +15,12 @@ package kv
 
 import (
 	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/juju/errors"
 )
@@ -28,6 +34,9 @@ type UnionStore interface {
 	CheckLazyConditionPairs() error
 	// WalkBuffer iterates all buffered kv pairs.
 	WalkBuffer(f func(k Key, v []byte) error) error
+	// WalkBufferRangeLimit iterates at most limit buffered kv pairs in range [start, end).
+	// A nil end means no upper bound, a limit of 0 or negative means no limit.
+	WalkBufferRangeLimit(start, end Key, limit int, f func(k Key, v []byte) error) error
 	// SetOption sets an option with a value, when val is nil, uses the default
 	// value of this option.
 	SetOption(opt Option, val interface{})
@@ -35,6 +44,186 @@ type UnionStore interface {
 	DelOption(opt Option)
 	// GetOption gets an option.
 	GetOption(opt Option) interface{}
+	// Update reads the current value of k, passes it to f, then applies the
+	// returned value to the buffer, or deletes k if f asks so. If the value
+	// is read from the snapshot, a lazy condition pair is recorded so that
+	// any concurrent change of k is detected before commit.
+	Update(k Key, f func(old []byte, exists bool) (new []byte, delete bool, err error)) error
+	// SeekUntil creates an Iterator from start over the buffer and snapshot,
+	// which becomes invalid at the first entry for which stop returns true.
+	// The stopping entry is excluded.
+	SeekUntil(start Key, stop func(k Key, v []byte) bool) (Iterator, error)
+	// SeekSnapshotOnly creates an Iterator over the snapshot in range [start, end).
+	// Buffered writes are invisible through this iterator. A nil end means no upper bound.
+	SeekSnapshotOnly(start, end Key) (Iterator, error)
+	// PreCommit runs all the checks which must pass before the transaction
+	// is committed: lazy condition pairs are checked, then the buffer size
+	// is validated against the transaction limits. Each step can be skipped
+	// by setting SkipPreCommitConditionCheck or SkipPreCommitSizeCheck to true.
+	PreCommit() error
+	// PreCommitWith runs the checks of PreCommit and build, which builds the
+	// commit mutations and must not depend on the checks. build runs after
+	// the checks, or concurrently with the condition check if
+	// AsyncConditionCheck is true, then ConditionCheckMetrics is called on
+	// the goroutine of the check, not the caller's. It is the single entry
+	// point the commit layer should call.
+	PreCommitWith(build func() error) error
+	// UndoKey drops the buffered write of k, so that k is read from the snapshot
+	// again. The lazy condition pair recorded for k is dropped too.
+	UndoKey(k Key) error
+	// BatchAssertNotExists records lazy condition pairs which check that the keys
+	// don't exist in the store before commit.
+	// A key which already has a must-not-exist condition pair recorded is
+	// skipped, one which has a value expected fails with ErrConditionConflict.
+	// The pairs before the conflicting one are still recorded.
+	BatchAssertNotExists(keys []Key) error
+	// CheckBatchUnique returns the keys which exist in the store, by the
+	// buffer or else the snapshot, or appear more than once in keys. Each
+	// offending key is returned once in the order of its first appearance.
+	// The snapshot is read by one BatchExist.
+	CheckBatchUnique(keys []Key) (dupes []Key, err error)
+	// BatchAssertEquals records lazy condition pairs which check that the keys
+	// have the given values in the store before commit. An empty value means
+	// the key must not exist.
+	// A key which already has a condition pair of the same value recorded is
+	// skipped, one with a different value fails with ErrConditionConflict.
+	// The pairs before the conflicting one are still recorded.
+	BatchAssertEquals(pairs []KeyValue) error
+	// MarshalState serializes the buffered writes, lazy condition pairs and
+	// options, which can be restored by RestoreUnionStore. The snapshot and
+	// the func options are not serialized, another option which can't be
+	// serialized fails it.
+	MarshalState() ([]byte, error)
+	// GetWithOld returns the current value of k and the value of k in the snapshot.
+	// Either value is nil if k doesn't exist, which is not treated as an error.
+	GetWithOld(k Key) (newVal []byte, oldVal []byte, err error)
+	// DeleteWithCondition deletes k and records a lazy condition pair which
+	// checks that the value of k in the store equals expect before commit.
+	// An empty expect means k must not exist in the store, which makes the
+	// delete only assert the absence. It fails with ErrConditionConflict
+	// without deleting k if k has a condition pair expecting another value.
+	DeleteWithCondition(k Key, expect []byte) error
+	// PrepareRetry drops the lazy condition pairs of conflictKeys after a
+	// conflict, so that the keys are resolved again on retry. The buffered
+	// writes, including those of conflictKeys, are kept.
+	PrepareRetry(conflictKeys []Key) error
+	// LockKeys returns the sorted keys the transaction needs to lock, which
+	// are the keys of the buffered writes and the lazy condition pairs.
+	LockKeys() []Key
+	// CheckLazyConditionPairsAll checks all lazy condition pairs like
+	// CheckLazyConditionPairs, but doesn't stop at the first mismatch. All the
+	// violated conditions are returned in key order. It's meant for diagnosis,
+	// the commit path should use CheckLazyConditionPairs.
+	CheckLazyConditionPairsAll() ([]ConditionViolation, error)
+	// WriteSetChecksum returns a checksum of the buffered writes, tombstones
+	// included. It only depends on the final write set, not on the order of
+	// the writes.
+	WriteSetChecksum() (uint64, error)
+	// Dirty returns whether there is any buffered write, a transaction which
+	// is not dirty has nothing to commit. Lazy condition pairs are not writes.
+	Dirty() bool
+	// FlushConditionChecks checks the lazy condition pairs recorded so far,
+	// then drops them if they all match, so they are not checked again at
+	// commit. Pairs recorded later are checked at commit as usual.
+	FlushConditionChecks() error
+	// SetSlowReadObserver sets f to be called with the number of keys and the
+	// duration of each snapshot batch read slower than the SlowReadThreshold
+	// option. The background reads of PrefetchConditions are reported too, so
+	// f may be called from another goroutine. A nil f removes the observer.
+	SetSlowReadObserver(f func(keys int, dur time.Duration))
+	// SetWithMeta sets k like Set and attaches meta to the write. The meta is
+	// only kept in the buffer and never committed, it's dropped by the next
+	// write of k.
+	SetWithMeta(k Key, v []byte, meta []byte) error
+	// GetMeta returns the meta attached to the buffered write of k, or nil.
+	GetMeta(k Key) []byte
+	// WalkBufferWithMeta iterates all buffered kv pairs with their meta.
+	WalkBufferWithMeta(f func(k Key, v []byte, meta []byte) error) error
+	// SetWithTTL sets k like Set and attaches ttl to the write, which the
+	// commit layer can translate into the storage TTL. The TTL is dropped by
+	// the next write of k and doesn't affect the reads in the transaction.
+	SetWithTTL(k Key, v []byte, ttl time.Duration) error
+	// GetTTL returns the TTL attached to the buffered write of k, or 0.
+	GetTTL(k Key) time.Duration
+	// SizeHistogram returns the histograms of the buffered key and value sizes.
+	// Bucket 0 counts the empty ones and bucket i counts the sizes in
+	// [2^(i-1), 2^i). Tombstones count as empty values.
+	SizeHistogram() (keyHist, valHist []int)
+	// SizeByPrefix returns the sum of the key and value sizes of the buffered
+	// entries grouped by the first prefixLen bytes of the keys. A key shorter
+	// than prefixLen is a group by itself.
+	SizeByPrefix(prefixLen int) map[string]int
+	// SeekLast creates a reversed Iterator positioned at the greatest key in
+	// the buffer and the snapshot. It's the same as SeekReverse(nil).
+	SeekLast() (Iterator, error)
+	// Reserve reserves room in the buffer for a batch of writes, see Reserver.
+	Reserve(entries int, bytes int) (*Reservation, error)
+	// History returns the writes of k in order, which are only kept while
+	// the KeepHistory option is on. UndoKey doesn't drop the history.
+	History(k Key) ([]HistoryEntry, error)
+	// BufferedSince returns the time k is first written in the buffer, which
+	// is only kept while the TrackWriteTime option is on. Overwriting k
+	// doesn't change the time, UndoKey drops it. ok is false if there is no
+	// time of k.
+	BufferedSince(k Key) (t time.Time, ok bool)
+	// Seal rejects all the later writes with ErrStoreSealed, it's called after
+	// the commit mutations are built. Reads and WalkBuffer still work.
+	Seal()
+	// EstimateRangeCount returns the approximate number of keys in range
+	// [start, end), which is the estimate of the snapshot adjusted by the
+	// buffered writes in the range. It returns -1 if the snapshot has no
+	// statistics.
+	EstimateRangeCount(start, end Key) (int64, error)
+	// WalkCommitMutations iterates the buffered writes to commit as Ops, which
+	// are passed through the CommitFilter option. A rejected write stops the
+	// walk with the error of the filter.
+	WalkCommitMutations(f func(op Op) error) error
+	// ApplyMutations applies the OpSet and OpDelete ops to the buffer in order,
+	// it's the inverse of WalkCommitMutations. A later op of a key overrides
+	// the earlier ones. It stops at the first failed op.
+	ApplyMutations(ops []Op) error
+	// HotKeys returns at most topN most accessed keys counted by the
+	// TrackAccess option, ordered by the count descending. The reads of both
+	// the buffer and the snapshot are counted.
+	HotKeys(topN int) []KeyCount
+	// ValidateConditionConsistency checks that no lazy condition pair
+	// contradicts the buffered write of its key, i.e. a key which must not
+	// exist is deleted. It's a debug check of the callers, the error lists
+	// all the inconsistent keys.
+	ValidateConditionConsistency() error
+	// DumpBuffer returns at most limit buffered writes in key order for admin
+	// inspection, a limit of 0 or negative means no limit. It doesn't change
+	// the state of the store.
+	DumpBuffer(limit int) []BufferEntry
+	// RefreshSnapshot replaces the snapshot by newSnapshot, which is usually a
+	// newer one, for read-committed style reads. The buffered writes and the
+	// lazy condition pairs are kept, the pairs are checked against
+	// newSnapshot. The values read ahead from the old snapshot are dropped,
+	// and the old snapshot is released.
+	RefreshSnapshot(newSnapshot Snapshot)
+	// Release releases the snapshot and subtracts the buffer memory usage
+	// from the MemTracker of the store, it's called when the transaction
+	// ends. It's idempotent, the store must not be read after it and the
+	// later writes are not tracked.
+	Release()
+	// WalkShadowed iterates the keys in range [start, end) which exist in the
+	// snapshot and have a buffered write, with the snapshot value as old and
+	// the buffered value as new. new is nil for a buffered delete. A nil end
+	// means no upper bound.
+	WalkShadowed(start, end Key, f func(k Key, old, new []byte) error) error
+	// RangeFullyBuffered returns true if every key in range [start, end) of
+	// the snapshot is shadowed by a buffered write or delete, so a scan of
+	// the range can skip the snapshot. A nil end means no upper bound.
+	RangeFullyBuffered(start, end Key) (bool, error)
+	// SetConditionClearedObserver sets f to be called with the number of the
+	// lazy condition pairs dropped whenever they're flushed by
+	// FlushConditionChecks, dropped by PrepareRetry or UndoKey, or released
+	// by Release. A nil f removes the observer.
+	SetConditionClearedObserver(f func(count int))
+	// Resolve reads k like Get and also returns the layer the value comes
+	// from and whether k exists, a missing key is not an error. A buffered
+	// delete is SourceBuffer with exists false.
+	Resolve(k Key) (value []byte, src EntrySource, exists bool, err error)
 }
 
 // Option is used for customizing kv store's behaviors during a transaction.
@@ -54,6 +243,45 @@ type conditionPair struct {
 	err   error
 }
 
+// ConditionCheckStats describes a run of CheckLazyConditionPairs.
+type ConditionCheckStats struct {
+	// Pairs is the number of lazy condition pairs checked.
+	Pairs int
+	// FetchedKeys is the number of keys fetched from the snapshot.
+	FetchedKeys int
+	// FetchDuration is the time spent fetching values from the snapshot.
+	FetchDuration time.Duration
+	// CompareDuration is the time spent comparing the values with the expected ones.
+	CompareDuration time.Duration
+	// RangeScan is true if the keys are fetched by a scan, see ConditionScanDensity.
+	RangeScan bool
+}
+
+// BufferEntry is a buffered write in the dump of UnionStore.DumpBuffer.
+type BufferEntry struct {
+	Key Key
+	// Tombstone is true for a buffered delete.
+	Tombstone bool
+	ValueLen  int
+}
+
+// KeyCount is a key with its access count, see UnionStore.HotKeys.
+type KeyCount struct {
+	Key   Key
+	Count int
+}
+
+// ConditionViolation describes a lazy condition pair which doesn't match.
+type ConditionViolation struct {
+	Key Key
+	// Expected is the expected value, nil means the key must not exist.
+	Expected []byte
+	// Actual is the value in the snapshot, nil means the key doesn't exist.
+	Actual []byte
+	// Err is the error CheckLazyConditionPairs would return for the pair.
+	Err error
+}
+
 // UnionStore is an in-memory Store which contains a buffer for write and a
 // snapshot for read.
 type unionStore struct {
@@ -61,18 +289,50 @@ type unionStore struct {
 	snapshot           Snapshot                    // for read
 	lazyConditionPairs map[string](*conditionPair) // for delay check
 	opts               options
+	sealed             bool
+	// slowReadObserver is called with the reads slower than SlowReadThreshold.
+	slowReadObserver func(keys int, dur time.Duration)
+	// prefetcher reads the keys of the condition pairs if PrefetchConditions is set.
+	prefetcher *conditionPrefetcher
+	// tracker tracks the buffer memory usage, tracked is the usage added to it.
+	tracker  *MemTracker
+	tracked  int64
+	released bool
+	// accessCounts counts the Gets of each key if TrackAccess is set.
+	accessMu     sync.Mutex
+	accessCounts map[string]int
+	// conditionCleared is called when the condition pairs are dropped.
+	conditionCleared func(count int)
+	// forbidden is the merged ForbiddenRanges sorted by the start keys.
+	forbidden []KeyRange
 }
 
 // NewUnionStore builds a new UnionStore.
 func NewUnionStore(snapshot Snapshot) UnionStore {
+	return NewUnionStoreWithFactory(snapshot, DefaultMemBufferFactory)
+}
+
+// NewUnionStoreWithFactory builds a new UnionStore which buffers writes in
+// the MemBuffer created by factory.
+func NewUnionStoreWithFactory(snapshot Snapshot, factory MemBufferFactory) UnionStore {
 	return &unionStore{
-		BufferStore:        NewBufferStore(snapshot),
+		BufferStore:        newBufferStoreWithFactory(snapshot, factory),
 		snapshot:           snapshot,
 		lazyConditionPairs: make(map[string](*conditionPair)),
 		opts:               make(map[Option]interface{}),
 	}
 }
 
+// NewUnionStoreWithMemTracker builds a new UnionStore whose buffer memory
+// usage is tracked by tracker. A write fails with ErrGlobalMemExceeded if
+// the union stores sharing tracker exceed its budget, the write is kept in
+// the buffer like the ones failed by the transaction limits.
+func NewUnionStoreWithMemTracker(snapshot Snapshot, tracker *MemTracker) UnionStore {
+	us := NewUnionStore(snapshot).(*unionStore)
+	us.tracker = tracker
+	return us
+}
+
 // invalidIterator implements Iterator interface.
 // It is used for read-only transaction which has no data written, the iterator is always invalid.
 type invalidIterator struct{}
@@ -96,7 +356,233 @@ func (it invalidIterator) Value() []byte {
 func (it invalidIterator) Close() {}
 
 type lazyMemBuffer struct {
-	mb MemBuffer
+	mb      MemBuffer
+	factory MemBufferFactory
+	// transformer transforms the values in mb, values are kept as is if it's nil.
+	transformer ValueTransformer
+	// seqs records the sequence number of the latest write of each key if
+	// trackOrder is true.
+	trackOrder bool
+	seqs       map[string]uint64
+	nextSeq    uint64
+	// metas keeps the metadata set by setWithMeta, which belongs to the latest
+	// write of the key.
+	metas map[string][]byte
+	// ttls keeps the TTLs set by setWithTTL like metas.
+	ttls map[string]time.Duration
+	// history keeps all the writes of each key if keepHistory is true.
+	keepHistory bool
+	history     map[string][]HistoryEntry
+	// writeTimes keeps the time of the first write of each key if
+	// trackWriteTime is true.
+	trackWriteTime bool
+	writeTimes     map[string]time.Time
+	// inline is true if mb is the sliceBuffer which keeps the first written key,
+	// see prepare.
+	inline bool
+	// appendOnly keeps mb the sliceBuffer, see the AppendOnly option.
+	appendOnly bool
+	// limitsSuspended is passed to every mb, see suspendLimits.
+	limitsSuspended bool
+}
+
+// HistoryEntry is a write of a key kept by the KeepHistory option.
+// Tp is either OpSet or OpDelete, Value is only used by OpSet.
+type HistoryEntry struct {
+	Tp    OpType
+	Value []byte
+}
+
+// init creates mb by the factory. A panic or a nil buffer of the factory
+// fails the write with ErrBufferAllocFailed instead of crashing the process.
+func (lmb *lazyMemBuffer) init() (err error) {
+	if lmb.factory == nil {
+		lmb.mb = NewMemDbBuffer()
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			lmb.mb = nil
+			err = ErrBufferAllocFailed.Gen("failed to allocate the buffer: %v", r)
+		}
+	}()
+	mb := lmb.factory.NewMemBuffer()
+	if mb == nil {
+		return ErrBufferAllocFailed.Gen("failed to allocate the buffer: nil buffer")
+	}
+	lmb.mb = mb
+	lmb.applyLimits()
+	return nil
+}
+
+func (lmb *lazyMemBuffer) suspendLimits(suspend bool) {
+	lmb.limitsSuspended = suspend
+	if lmb.mb != nil {
+		lmb.applyLimits()
+	}
+}
+
+// applyLimits passes limitsSuspended to mb.
+func (lmb *lazyMemBuffer) applyLimits() {
+	if s, ok := lmb.mb.(limitSuspender); ok {
+		s.suspendLimits(lmb.limitsSuspended)
+	}
+}
+
+// prepare makes mb ready for a write of k. Most transactions write a single
+// key, so the first written key is kept in a sliceBuffer, which is much
+// cheaper to create than a memDbBuffer. The buffer is upgraded to the one
+// created by the factory when another key is written.
+func (lmb *lazyMemBuffer) prepare(k Key) error {
+	if lmb.mb == nil {
+		lmb.mb = NewSliceBuffer()
+		lmb.inline = true
+		lmb.applyLimits()
+		return nil
+	}
+	if !lmb.inline || lmb.appendOnly {
+		return nil
+	}
+	entries := lmb.mb.(*sliceBuffer).entries
+	if len(entries) == 0 || (len(entries) == 1 && entries[0].Key.Cmp(k) == 0) {
+		return nil
+	}
+	return lmb.upgrade()
+}
+
+// upgrade moves the entries of the inline sliceBuffer to a new buffer created
+// by the factory.
+func (lmb *lazyMemBuffer) upgrade() error {
+	sb := lmb.mb.(*sliceBuffer)
+	if err := lmb.init(); err != nil {
+		lmb.mb = sb
+		return errors.Trace(err)
+	}
+	lmb.inline = false
+	for _, e := range sb.entries {
+		var err error
+		if len(e.Value) == 0 {
+			err = lmb.mb.Delete(e.Key)
+		} else {
+			err = lmb.mb.Set(e.Key, e.Value)
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// track records k as the latest written key.
+func (lmb *lazyMemBuffer) track(k Key) {
+	if lmb.trackOrder {
+		if lmb.seqs == nil {
+			lmb.seqs = make(map[string]uint64)
+		}
+		lmb.nextSeq++
+		lmb.seqs[string(k)] = lmb.nextSeq
+	}
+	delete(lmb.metas, string(k))
+	delete(lmb.ttls, string(k))
+	if lmb.trackWriteTime {
+		if lmb.writeTimes == nil {
+			lmb.writeTimes = make(map[string]time.Time)
+		}
+		if _, ok := lmb.writeTimes[string(k)]; !ok {
+			lmb.writeTimes[string(k)] = time.Now()
+		}
+	}
+}
+
+// record appends the write of k to its history if keepHistory is on.
+func (lmb *lazyMemBuffer) record(k Key, tp OpType, v []byte) {
+	if !lmb.keepHistory {
+		return
+	}
+	if lmb.history == nil {
+		lmb.history = make(map[string][]HistoryEntry)
+	}
+	e := HistoryEntry{Tp: tp}
+	if tp == OpSet {
+		e.Value = append([]byte(nil), v...)
+	}
+	lmb.history[string(k)] = append(lmb.history[string(k)], e)
+}
+
+func (lmb *lazyMemBuffer) setWithMeta(k Key, v []byte, meta []byte) error {
+	if err := lmb.Set(k, v); err != nil {
+		return err
+	}
+	if len(meta) > 0 {
+		if lmb.metas == nil {
+			lmb.metas = make(map[string][]byte)
+		}
+		lmb.metas[string(k)] = append([]byte(nil), meta...)
+	}
+	return nil
+}
+
+func (lmb *lazyMemBuffer) meta(k Key) []byte {
+	return lmb.metas[string(k)]
+}
+
+func (lmb *lazyMemBuffer) setWithTTL(k Key, v []byte, ttl time.Duration) error {
+	if err := lmb.Set(k, v); err != nil {
+		return err
+	}
+	if ttl > 0 {
+		if lmb.ttls == nil {
+			lmb.ttls = make(map[string]time.Duration)
+		}
+		lmb.ttls[string(k)] = ttl
+	}
+	return nil
+}
+
+func (lmb *lazyMemBuffer) ttl(k Key) time.Duration {
+	return lmb.ttls[string(k)]
+}
+
+func (lmb *lazyMemBuffer) trackInsertion() {
+	lmb.trackOrder = true
+}
+
+// keysByInsertion returns the buffered keys in the order of their latest writes.
+func (lmb *lazyMemBuffer) keysByInsertion() ([]Key, bool) {
+	if !lmb.trackOrder {
+		return nil, false
+	}
+	keys := make([]Key, 0, len(lmb.seqs))
+	for k := range lmb.seqs {
+		keys = append(keys, Key(k))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return lmb.seqs[string(keys[i])] < lmb.seqs[string(keys[j])]
+	})
+	return keys, true
+}
+
+// lastKey returns the greatest buffered key, ok is false if there is none.
+func (lmb *lazyMemBuffer) lastKey() (k Key, ok bool, err error) {
+	if lmb.mb == nil {
+		return nil, false, nil
+	}
+	if lmb.inline {
+		entries := lmb.mb.(*sliceBuffer).entries
+		if len(entries) == 0 {
+			return nil, false, nil
+		}
+		return entries[len(entries)-1].Key, true, nil
+	}
+	it, err := lmb.mb.SeekReverse(nil)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	defer it.Close()
+	if !it.Valid() {
+		return nil, false, nil
+	}
+	return it.Key().Clone(), true, nil
 }
 
 func (lmb *lazyMemBuffer) Get(k Key) ([]byte, error) {
@@ -104,37 +590,157 @@ func (lmb *lazyMemBuffer) Get(k Key) ([]byte, error) {
 		return nil, errors.Trace(ErrNotExist)
 	}
 
-	return lmb.mb.Get(k)
+	v, err := lmb.mb.Get(k)
+	if err != nil || lmb.transformer == nil || len(v) == 0 {
+		return v, err
+	}
+	v, err = lmb.transformer.Decode(v)
+	return v, errors.Trace(err)
 }
 
 func (lmb *lazyMemBuffer) Set(key Key, value []byte) error {
-	if lmb.mb == nil {
-		lmb.mb = NewMemDbBuffer()
+	if err := lmb.prepare(key); err != nil {
+		return err
+	}
+	plain := value
+	if lmb.transformer != nil && len(value) > 0 {
+		value = lmb.transformer.Encode(value)
 	}
 
-	return lmb.mb.Set(key, value)
+	if err := lmb.mb.Set(key, value); err != nil {
+		return err
+	}
+	lmb.track(key)
+	lmb.record(key, OpSet, plain)
+	return nil
 }
 
 func (lmb *lazyMemBuffer) Delete(k Key) error {
+	if err := lmb.prepare(k); err != nil {
+		return err
+	}
+
+	if err := lmb.mb.Delete(k); err != nil {
+		return err
+	}
+	lmb.track(k)
+	lmb.record(k, OpDelete, nil)
+	return nil
+}
+
+// BulkLoad implements the BulkLoader interface if the buffer created by the
+// factory implements it.
+func (lmb *lazyMemBuffer) BulkLoad(iter func() (Key, []byte, bool)) error {
 	if lmb.mb == nil {
-		lmb.mb = NewMemDbBuffer()
+		if err := lmb.init(); err != nil {
+			return err
+		}
+	} else if lmb.inline {
+		if err := lmb.upgrade(); err != nil {
+			return err
+		}
+	}
+	bl, ok := lmb.mb.(BulkLoader)
+	if !ok {
+		return errors.Trace(ErrNotImplemented)
+	}
+	// A pair is tracked when the next one is asked for, since it's loaded then.
+	var last Key
+	var lastValue []byte
+	err := bl.BulkLoad(func() (Key, []byte, bool) {
+		if last != nil {
+			lmb.track(last)
+			lmb.record(last, OpSet, lastValue)
+		}
+		k, v, ok := iter()
+		last, lastValue = k, v
+		if !ok {
+			last = nil
+			return k, v, false
+		}
+		if lmb.transformer != nil && len(v) > 0 {
+			v = lmb.transformer.Encode(v)
+		}
+		return k, v, true
+	})
+	return err
+}
+
+func (lmb *lazyMemBuffer) BatchDelete(keys []Key) error {
+	if lmb.mb == nil || lmb.inline {
+		for _, k := range keys {
+			if err := lmb.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	return lmb.mb.Delete(k)
+	if err := lmb.mb.BatchDelete(keys); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		lmb.track(k)
+		lmb.record(k, OpDelete, nil)
+	}
+	return nil
 }
 
 func (lmb *lazyMemBuffer) Seek(k Key) (Iterator, error) {
 	if lmb.mb == nil {
 		return invalidIterator{}, nil
 	}
-	return lmb.mb.Seek(k)
+	it, err := lmb.mb.Seek(k)
+	if err != nil || lmb.transformer == nil {
+		return it, err
+	}
+	return newTransformIter(it, lmb.transformer)
 }
 
 func (lmb *lazyMemBuffer) SeekReverse(k Key) (Iterator, error) {
 	if lmb.mb == nil {
 		return invalidIterator{}, nil
 	}
-	return lmb.mb.SeekReverse(k)
+	it, err := lmb.mb.SeekReverse(k)
+	if err != nil || lmb.transformer == nil {
+		return it, err
+	}
+	return newTransformIter(it, lmb.transformer)
+}
+
+func (lmb *lazyMemBuffer) Reserve(entries int, bytes int) (*Reservation, error) {
+	if lmb.mb == nil {
+		if err := lmb.init(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	} else if lmb.inline {
+		if err := lmb.upgrade(); err != nil {
+			return nil, err
+		}
+	}
+	r, ok := lmb.mb.(Reserver)
+	if !ok {
+		return nil, errors.Trace(ErrNotImplemented)
+	}
+	return r.Reserve(entries, bytes)
+}
+
+func (lmb *lazyMemBuffer) remove(k Key) error {
+	if lmb.mb == nil {
+		return nil
+	}
+	r, ok := lmb.mb.(entryRemover)
+	if !ok {
+		return errors.Trace(ErrNotImplemented)
+	}
+	if err := r.remove(k); err != nil {
+		return err
+	}
+	delete(lmb.seqs, string(k))
+	delete(lmb.metas, string(k))
+	delete(lmb.ttls, string(k))
+	delete(lmb.writeTimes, string(k))
+	return nil
 }
 
 func (lmb *lazyMemBuffer) Size() int {
@@ -151,16 +757,24 @@ func (lmb *lazyMemBuffer) Len() int {
 	return lmb.mb.Len()
 }
 
+func (lmb *lazyMemBuffer) MemUsage() int {
+	if lmb.mb == nil {
+		return 0
+	}
+	return lmb.mb.MemUsage()
+}
+
 // Get implements the Retriever interface.
 func (us *unionStore) Get(k Key) ([]byte, error) {
+	us.countAccess(k)
 	v, err := us.MemBuffer.Get(k)
+	if err == nil && len(v) == 0 && us.opts.isTrue(DistinctDeletedError) {
+		return nil, errors.Trace(ErrDeleted)
+	}
 	if IsErrNotFound(err) {
 		if _, ok := us.opts.Get(PresumeKeyNotExists); ok {
-			e, ok := us.opts.Get(PresumeKeyNotExistsError)
-			if ok && e != nil {
-				us.markLazyConditionPair(k, nil, e.(error))
-			} else {
-				us.markLazyConditionPair(k, nil, ErrKeyExists)
+			if err = us.recordLazyConditionPair(k, nil, us.presumeKeyNotExistsError()); err != nil {
+				return nil, errors.Trace(err)
 			}
 			return nil, errors.Trace(ErrNotExist)
 		}
@@ -177,62 +791,1320 @@ func (us *unionStore) Get(k Key) ([]byte, error) {
 	return v, nil
 }
 
-// markLazyConditionPair marks a kv pair for later check.
-// If condition not match, should return e as error.
-func (us *unionStore) markLazyConditionPair(k Key, v []byte, e error) {
-	us.lazyConditionPairs[string(k)] = &conditionPair{
-		key:   k.Clone(),
-		value: v,
-		err:   e,
+// countAccess counts a read of k if TrackAccess is set, it's safe for the
+// concurrent Gets.
+func (us *unionStore) countAccess(k Key) {
+	if !us.opts.isTrue(TrackAccess) {
+		return
+	}
+	us.accessMu.Lock()
+	if us.accessCounts == nil {
+		us.accessCounts = make(map[string]int)
 	}
+	us.accessCounts[string(k)]++
+	us.accessMu.Unlock()
 }
 
-// CheckLazyConditionPairs implements the UnionStore interface.
-func (us *unionStore) CheckLazyConditionPairs() error {
-	if len(us.lazyConditionPairs) == 0 {
-		return nil
+// HotKeys implements the UnionStore HotKeys interface.
+// The keys with the same count are ordered by the key.
+func (us *unionStore) HotKeys(topN int) []KeyCount {
+	us.accessMu.Lock()
+	counts := make([]KeyCount, 0, len(us.accessCounts))
+	for k, cnt := range us.accessCounts {
+		counts = append(counts, KeyCount{Key: Key(k), Count: cnt})
 	}
-	keys := make([]Key, 0, len(us.lazyConditionPairs))
-	for _, v := range us.lazyConditionPairs {
-		keys = append(keys, v.key)
+	us.accessMu.Unlock()
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Key.Cmp(counts[j].Key) < 0
+	})
+	if topN >= 0 && len(counts) > topN {
+		counts = counts[:topN]
+	}
+	return counts
+}
+
+// presumeKeyNotExistsError returns the error of a must-not-exist condition pair.
+func (us *unionStore) presumeKeyNotExistsError() error {
+	if e, ok := us.opts.Get(PresumeKeyNotExistsError); ok && e != nil {
+		return e.(error)
+	}
+	return ErrKeyExists
+}
+
+// Resolve implements the UnionStore Resolve interface.
+func (us *unionStore) Resolve(k Key) ([]byte, EntrySource, bool, error) {
+	us.countAccess(k)
+	v, err := us.MemBuffer.Get(k)
+	if err == nil {
+		if len(v) == 0 {
+			return nil, SourceBuffer, false, nil
+		}
+		return v, SourceBuffer, true, nil
+	}
+	if !IsErrNotFound(err) {
+		return nil, SourceBuffer, false, errors.Trace(err)
+	}
+	if _, ok := us.opts.Get(PresumeKeyNotExists); ok {
+		if err = us.recordLazyConditionPair(k, nil, us.presumeKeyNotExistsError()); err != nil {
+			return nil, SourceSnapshot, false, errors.Trace(err)
+		}
+		return nil, SourceSnapshot, false, nil
+	}
+	v, err = us.BufferStore.r.Get(k)
+	if IsErrNotFound(err) || (err == nil && len(v) == 0) {
+		return nil, SourceSnapshot, false, nil
+	}
+	if err != nil {
+		return nil, SourceSnapshot, false, errors.Trace(err)
+	}
+	return v, SourceSnapshot, true, nil
+}
+
+// GetWithOld implements the UnionStore GetWithOld interface.
+func (us *unionStore) GetWithOld(k Key) ([]byte, []byte, error) {
+	us.countAccess(k)
+	oldVal, err := us.snapshot.Get(k)
+	if err != nil && !IsErrNotFound(err) {
+		return nil, nil, errors.Trace(err)
+	}
+	if len(oldVal) == 0 {
+		oldVal = nil
+	}
+	newVal, err := us.MemBuffer.Get(k)
+	if IsErrNotFound(err) {
+		return oldVal, oldVal, nil
 	}
-	values, err := us.snapshot.BatchGet(keys)
 	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if len(newVal) == 0 {
+		newVal = nil
+	}
+	return newVal, oldVal, nil
+}
+
+// Set implements the Mutator Set interface.
+func (us *unionStore) Set(k Key, v []byte) error {
+	if err := us.checkWrite(k); err != nil {
+		return errors.Trace(err)
+	}
+	if err := us.checkValueSize(k, v); err != nil {
+		return errors.Trace(err)
+	}
+	if err := us.checkAppend(k); err != nil {
 		return errors.Trace(err)
 	}
+	return us.trackMem(us.MemBuffer.Set(k, v))
+}
 
-	for k, v := range us.lazyConditionPairs {
-		if len(v.value) == 0 {
-			if _, exist := values[k]; exist {
-				return errors.Trace(v.err)
-			}
-		} else {
-			if bytes.Compare(values[k], v.value) != 0 {
-				return errors.Trace(ErrLazyConditionPairsNotMatch)
-			}
+// BulkLoad loads the presorted kv pairs returned by iter like
+// BulkLoader.BulkLoad, the pairs pass the checks of Set. It fails with
+// ErrNotImplemented if the buffer of the MemBufferFactory isn't a BulkLoader.
+func (us *unionStore) BulkLoad(iter func() (Key, []byte, bool)) error {
+	var checkErr error
+	err := us.BufferStore.MemBuffer.(*lazyMemBuffer).BulkLoad(func() (Key, []byte, bool) {
+		k, v, ok := iter()
+		if !ok {
+			return k, v, false
+		}
+		if checkErr = us.checkWrite(k); checkErr == nil {
+			checkErr = us.checkValueSize(k, v)
 		}
+		return k, v, checkErr == nil
+	})
+	if err == nil {
+		err = checkErr
 	}
-	return nil
+	return us.trackMem(errors.Trace(err))
 }
 
-// SetOption implements the UnionStore SetOption interface.
-func (us *unionStore) SetOption(opt Option, val interface{}) {
-	us.opts[opt] = val
+// RewriteKeys is BufferStore.RewriteKeys with the checks of Set applied to
+// the new keys. It's rejected by the AppendOnly option, which doesn't allow
+// removing the buffered keys.
+func (us *unionStore) RewriteKeys(mapping func(old Key) (Key, bool)) error {
+	if us.opts.isTrue(AppendOnly) {
+		return ErrAppendOnlyViolation.Gen("rewrite keys")
+	}
+	if us.sealed {
+		return errors.Trace(ErrStoreSealed)
+	}
+	err := us.BufferStore.rewriteKeys(mapping, func(k Key, v []byte) error {
+		if err := us.checkWrite(k); err != nil {
+			return errors.Trace(err)
+		}
+		if len(v) == 0 {
+			return nil
+		}
+		return errors.Trace(us.checkValueSize(k, v))
+	})
+	return us.trackMem(err)
 }
 
-// DelOption implements the UnionStore DelOption interface.
-func (us *unionStore) DelOption(opt Option) {
-	delete(us.opts, opt)
+// SetWithMeta implements the UnionStore SetWithMeta interface.
+func (us *unionStore) SetWithMeta(k Key, v []byte, meta []byte) error {
+	if err := us.checkWrite(k); err != nil {
+		return errors.Trace(err)
+	}
+	if err := us.checkValueSize(k, v); err != nil {
+		return errors.Trace(err)
+	}
+	if err := us.checkAppend(k); err != nil {
+		return errors.Trace(err)
+	}
+	return us.trackMem(us.BufferStore.SetWithMeta(k, v, meta))
 }
 
-// GetOption implements the UnionStore GetOption interface.
-func (us *unionStore) GetOption(opt Option) interface{} {
-	return us.opts[opt]
+// SetWithTTL implements the UnionStore SetWithTTL interface.
+func (us *unionStore) SetWithTTL(k Key, v []byte, ttl time.Duration) error {
+	if err := us.checkWrite(k); err != nil {
+		return errors.Trace(err)
+	}
+	if err := us.checkValueSize(k, v); err != nil {
+		return errors.Trace(err)
+	}
+	if err := us.checkAppend(k); err != nil {
+		return errors.Trace(err)
+	}
+	return us.trackMem(us.BufferStore.SetWithTTL(k, v, ttl))
 }
 
-type options map[Option]interface{}
+// trackMem adds the change of the buffer memory usage by a write to the
+// MemTracker, err is the error of the write.
+func (us *unionStore) trackMem(err error) error {
+	if us.tracker == nil {
+		return err
+	}
+	usage := int64(us.MemUsage())
+	delta := usage - us.tracked
+	us.tracked = usage
+	if e := us.tracker.add(delta); e != nil && err == nil {
+		return errors.Trace(e)
+	}
+	return err
+}
 
-func (opts options) Get(opt Option) (interface{}, bool) {
-	v, ok := opts[opt]
-	return v, ok
+// Release implements the UnionStore Release interface.
+func (us *unionStore) Release() {
+	if us.released {
+		return
+	}
+	us.released = true
+	if us.prefetcher != nil {
+		us.prefetcher.wait()
+	}
+	us.snapshot.Release()
+	us.notifyConditionCleared(len(us.lazyConditionPairs))
+	us.lazyConditionPairs = us.newConditionPairs()
+	if us.tracker != nil {
+		us.tracker.add(-us.tracked)
+		us.tracker, us.tracked = nil, 0
+	}
+}
+
+// checkWrite checks whether k can be written, the store must not be sealed
+// and k must pass the KeyValidator option.
+func (us *unionStore) checkWrite(k Key) error {
+	if us.sealed {
+		return errors.Trace(ErrStoreSealed)
+	}
+	if us.inForbiddenRange(k) {
+		return ErrForbiddenKeyRange.Gen("key %q is in a forbidden range", k)
+	}
+	if f, ok := us.opts[KeyValidator].(func(k Key) error); ok && f != nil {
+		return f(k)
+	}
+	return nil
+}
+
+// setForbiddenRanges sorts and merges the ranges, so a key is looked up by a
+// binary search.
+func (us *unionStore) setForbiddenRanges(ranges []KeyRange) {
+	sorted := make([]KeyRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r.EndKey == nil || r.StartKey.Cmp(r.EndKey) < 0 {
+			sorted = append(sorted, r)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].StartKey.Cmp(sorted[j].StartKey) < 0
+	})
+	us.forbidden = sorted[:0]
+	for _, r := range sorted {
+		n := len(us.forbidden)
+		if n == 0 {
+			us.forbidden = append(us.forbidden, r)
+			continue
+		}
+		last := &us.forbidden[n-1]
+		if last.EndKey != nil && r.StartKey.Cmp(last.EndKey) > 0 {
+			us.forbidden = append(us.forbidden, r)
+			continue
+		}
+		if last.EndKey != nil && (r.EndKey == nil || r.EndKey.Cmp(last.EndKey) > 0) {
+			last.EndKey = r.EndKey
+		}
+	}
+}
+
+func (us *unionStore) inForbiddenRange(k Key) bool {
+	i := sort.Search(len(us.forbidden), func(i int) bool {
+		return us.forbidden[i].StartKey.Cmp(k) > 0
+	})
+	if i == 0 {
+		return false
+	}
+	r := us.forbidden[i-1]
+	return r.EndKey == nil || k.Cmp(r.EndKey) < 0
+}
+
+// checkValueSize checks v against the MaxValueBytes option.
+func (us *unionStore) checkValueSize(k Key, v []byte) error {
+	if limit, ok := us.opts[MaxValueBytes].(int); ok && len(v) > limit {
+		return ErrValueTooLarge.Gen("value of key %q is too large, size: %d, limit: %d", k, len(v), limit)
+	}
+	return nil
+}
+
+// checkAppend checks that a Set of k follows the AppendOnly option.
+func (us *unionStore) checkAppend(k Key) error {
+	if !us.opts.isTrue(AppendOnly) {
+		return nil
+	}
+	last, ok, err := us.BufferStore.MemBuffer.(*lazyMemBuffer).lastKey()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !ok {
+		return nil
+	}
+	switch k.Cmp(last) {
+	case 0:
+		return ErrAppendOnlyViolation.Gen("overwrite %q", k)
+	case -1:
+		return ErrAppendOnlyViolation.Gen("set %q after %q", k, last)
+	}
+	return nil
+}
+
+// Delete implements the Mutator Delete interface.
+func (us *unionStore) Delete(k Key) error {
+	if err := us.checkWrite(k); err != nil {
+		return errors.Trace(err)
+	}
+	if us.opts.isTrue(AppendOnly) {
+		return ErrAppendOnlyViolation.Gen("delete %q", k)
+	}
+	if err := us.checkDeleteExists(k); err != nil {
+		return errors.Trace(err)
+	}
+	return us.trackMem(us.MemBuffer.Delete(k))
+}
+
+// BatchDelete implements the MemBuffer BatchDelete interface.
+// With StrictDelete, no key is deleted if any of them doesn't exist.
+func (us *unionStore) BatchDelete(keys []Key) error {
+	for _, k := range keys {
+		if err := us.checkWrite(k); err != nil {
+			return errors.Trace(err)
+		}
+		if us.opts.isTrue(AppendOnly) {
+			return ErrAppendOnlyViolation.Gen("delete %q", k)
+		}
+		if err := us.checkDeleteExists(k); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return us.trackMem(us.MemBuffer.BatchDelete(keys))
+}
+
+// checkDeleteExists checks k exists before it's deleted if StrictDelete is set.
+func (us *unionStore) checkDeleteExists(k Key) error {
+	if !us.opts.isTrue(StrictDelete) {
+		return nil
+	}
+	// BufferStore.Get doesn't record lazy condition pairs.
+	_, err := us.BufferStore.Get(k)
+	if IsErrNotFound(err) {
+		return ErrDeleteNotExist.Gen("delete key %q which doesn't exist", k)
+	}
+	return errors.Trace(err)
+}
+
+// DeleteWithCondition implements the UnionStore DeleteWithCondition interface.
+func (us *unionStore) DeleteWithCondition(k Key, expect []byte) error {
+	if len(expect) == 0 {
+		expect = nil
+	} else {
+		expect = append([]byte(nil), expect...)
+	}
+	if err := us.checkConditionConflict(k, expect); err != nil {
+		return errors.Trace(err)
+	}
+	if err := us.Delete(k); err != nil {
+		return errors.Trace(err)
+	}
+	return us.recordLazyConditionPair(k, expect, ErrLazyConditionPairsNotMatch)
+}
+
+// markLazyConditionPair marks a kv pair for later check.
+// If condition not match, should return e as error.
+func (us *unionStore) markLazyConditionPair(k Key, v []byte, e error) {
+	us.lazyConditionPairs[string(k)] = &conditionPair{
+		key:   k.Clone(),
+		value: v,
+		err:   e,
+	}
+	if us.opts.isTrue(PrefetchConditions) {
+		if us.prefetcher == nil {
+			us.prefetcher = newConditionPrefetcher(us.snapshot)
+		}
+		us.prefetcher.add(k.Clone(), us.slowReadReporter())
+	}
+}
+
+// recordLazyConditionPair marks a kv pair for later check unless k already
+// has a pair recorded. The first pair of a key wins, a later one expecting a
+// different value fails with ErrConditionConflict.
+func (us *unionStore) recordLazyConditionPair(k Key, v []byte, e error) error {
+	if err := us.checkConditionConflict(k, v); err != nil {
+		return errors.Trace(err)
+	}
+	if _, ok := us.lazyConditionPairs[string(k)]; !ok {
+		us.markLazyConditionPair(k, v, e)
+	}
+	return nil
+}
+
+// checkConditionConflict checks the condition pair recorded for k, if any,
+// expects v too.
+func (us *unionStore) checkConditionConflict(k Key, v []byte) error {
+	c, ok := us.lazyConditionPairs[string(k)]
+	if ok && !bytes.Equal(c.value, v) {
+		return ErrConditionConflict.Gen("condition of key %q expects %q, but %q is recorded", k, v, c.value)
+	}
+	return nil
+}
+
+// UndoKey implements the UnionStore UndoKey interface.
+func (us *unionStore) UndoKey(k Key) error {
+	if us.sealed {
+		return errors.Trace(ErrStoreSealed)
+	}
+	if err := us.trackMem(us.BufferStore.UndoKey(k)); err != nil {
+		return errors.Trace(err)
+	}
+	if _, ok := us.lazyConditionPairs[string(k)]; ok {
+		delete(us.lazyConditionPairs, string(k))
+		us.notifyConditionCleared(1)
+	}
+	return nil
+}
+
+// PrepareRetry implements the UnionStore PrepareRetry interface.
+func (us *unionStore) PrepareRetry(conflictKeys []Key) error {
+	cnt := len(us.lazyConditionPairs)
+	for _, k := range conflictKeys {
+		delete(us.lazyConditionPairs, string(k))
+	}
+	us.notifyConditionCleared(cnt - len(us.lazyConditionPairs))
+	return nil
+}
+
+// SetConditionClearedObserver implements the UnionStore SetConditionClearedObserver interface.
+func (us *unionStore) SetConditionClearedObserver(f func(count int)) {
+	us.conditionCleared = f
+}
+
+func (us *unionStore) notifyConditionCleared(count int) {
+	if us.conditionCleared != nil {
+		us.conditionCleared(count)
+	}
+}
+
+// LockKeys implements the UnionStore LockKeys interface.
+func (us *unionStore) LockKeys() []Key {
+	keys := make([]Key, 0, us.Len()+len(us.lazyConditionPairs))
+	for _, v := range us.lazyConditionPairs {
+		keys = append(keys, v.key)
+	}
+	// The buffered keys which also have condition pairs are skipped.
+	us.WalkBuffer(func(k Key, v []byte) error {
+		if _, ok := us.lazyConditionPairs[string(k)]; !ok {
+			keys = append(keys, k.Clone())
+		}
+		return nil
+	})
+	sort.Sort(keySlice(keys))
+	return keys
+}
+
+// WriteSetChecksum implements the UnionStore WriteSetChecksum interface.
+func (us *unionStore) WriteSetChecksum() (uint64, error) {
+	sum, err := writeSetChecksum(us.WalkBuffer)
+	return sum, errors.Trace(err)
+}
+
+// writeSetChecksum computes the checksum of WriteSetChecksum over the entries
+// visited by walk.
+func writeSetChecksum(walk func(f func(k Key, v []byte) error) error) (uint64, error) {
+	h := fnv.New64a()
+	var buf [binary.MaxVarintLen64]byte
+	// The buffer is walked in key order. Lengths are written before the keys
+	// and values so that the boundaries are part of the checksum.
+	err := walk(func(k Key, v []byte) error {
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(k)))])
+		h.Write(k)
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(v)))])
+		h.Write(v)
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return h.Sum64(), nil
+}
+
+// EstimateRangeCount implements the UnionStore EstimateRangeCount interface.
+// The buffered sets are counted as inserts and the buffered deletes as
+// deletes, the snapshot isn't read to tell whether they overwrite existing
+// keys.
+func (us *unionStore) EstimateRangeCount(start, end Key) (int64, error) {
+	cnt, err := us.snapshot.EstimateRangeCount(start, end)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if cnt < 0 {
+		return -1, nil
+	}
+	err = us.WalkBufferRangeLimit(start, end, 0, func(k Key, v []byte) error {
+		if len(v) == 0 {
+			cnt--
+		} else {
+			cnt++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if cnt < 0 {
+		cnt = 0
+	}
+	return cnt, nil
+}
+
+// WalkShadowed implements the UnionStore WalkShadowed interface.
+// The snapshot values of the buffered keys are read by one BatchGet.
+func (us *unionStore) WalkShadowed(start, end Key, f func(k Key, old, new []byte) error) error {
+	var keys []Key
+	var values [][]byte
+	err := us.WalkBufferRangeLimit(start, end, 0, func(k Key, v []byte) error {
+		keys = append(keys, append(Key(nil), k...))
+		values = append(values, append([]byte(nil), v...))
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	olds, err := us.snapshot.BatchGet(keys)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for i, k := range keys {
+		old := olds[string(k)]
+		if len(old) == 0 {
+			continue
+		}
+		v := values[i]
+		if len(v) == 0 {
+			v = nil
+		}
+		if err = f(k, old, v); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// RangeFullyBuffered implements the UnionStore RangeFullyBuffered interface.
+// The snapshot keys in the range are scanned once, it stops at the first one
+// which isn't buffered.
+func (us *unionStore) RangeFullyBuffered(start, end Key) (bool, error) {
+	it, err := us.SeekSnapshotOnly(start, end)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	defer it.Close()
+	for it.Valid() {
+		_, err = us.MemBuffer.Get(it.Key())
+		if IsErrNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		if err = it.Next(); err != nil {
+			return false, errors.Trace(err)
+		}
+	}
+	return true, nil
+}
+
+// Seal implements the UnionStore Seal interface.
+func (us *unionStore) Seal() {
+	us.sealed = true
+}
+
+// Dirty implements the UnionStore Dirty interface.
+func (us *unionStore) Dirty() bool {
+	// The Len of BufferStore is frozen while the size tracking is suspended.
+	return us.MemBuffer.Len() > 0
+}
+
+// SizeHistogram implements the UnionStore SizeHistogram interface.
+func (us *unionStore) SizeHistogram() (keyHist, valHist []int) {
+	return sizeHistogram(us.WalkBuffer)
+}
+
+// sizeHistogram builds the histograms of SizeHistogram from the entries
+// visited by walk.
+func sizeHistogram(walk func(f func(k Key, v []byte) error) error) (keyHist, valHist []int) {
+	add := func(hist []int, size int) []int {
+		bucket := 0
+		for ; size > 0; size >>= 1 {
+			bucket++
+		}
+		for len(hist) <= bucket {
+			hist = append(hist, 0)
+		}
+		hist[bucket]++
+		return hist
+	}
+	walk(func(k Key, v []byte) error {
+		keyHist = add(keyHist, len(k))
+		valHist = add(valHist, len(v))
+		return nil
+	})
+	return keyHist, valHist
+}
+
+// BufferedSince implements the UnionStore BufferedSince interface.
+func (us *unionStore) BufferedSince(k Key) (time.Time, bool) {
+	t, ok := us.BufferStore.MemBuffer.(*lazyMemBuffer).writeTimes[string(k)]
+	return t, ok
+}
+
+// SizeByPrefix implements the UnionStore SizeByPrefix interface.
+func (us *unionStore) SizeByPrefix(prefixLen int) map[string]int {
+	if prefixLen < 0 {
+		prefixLen = 0
+	}
+	sizes := make(map[string]int)
+	us.WalkBuffer(func(k Key, v []byte) error {
+		prefix := k
+		if len(prefix) > prefixLen {
+			prefix = prefix[:prefixLen]
+		}
+		sizes[string(prefix)] += len(k) + len(v)
+		return nil
+	})
+	return sizes
+}
+
+// History implements the UnionStore History interface.
+func (us *unionStore) History(k Key) ([]HistoryEntry, error) {
+	return us.BufferStore.MemBuffer.(*lazyMemBuffer).history[string(k)], nil
+}
+
+// BatchAssertNotExists implements the UnionStore BatchAssertNotExists interface.
+func (us *unionStore) BatchAssertNotExists(keys []Key) error {
+	e := us.presumeKeyNotExistsError()
+	for _, k := range keys {
+		if err := us.recordLazyConditionPair(k, nil, e); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// CheckBatchUnique implements the UnionStore CheckBatchUnique interface.
+func (us *unionStore) CheckBatchUnique(keys []Key) ([]Key, error) {
+	counts := make(map[string]int, len(keys))
+	exists := make(map[string]bool, len(keys))
+	var unbuffered []Key
+	for _, k := range keys {
+		counts[string(k)]++
+		if counts[string(k)] > 1 {
+			continue
+		}
+		v, err := us.MemBuffer.Get(k)
+		if IsErrNotFound(err) {
+			unbuffered = append(unbuffered, k)
+			continue
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		exists[string(k)] = len(v) > 0
+	}
+	if len(unbuffered) > 0 {
+		m, err := us.snapshot.BatchExist(unbuffered)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for k, v := range m {
+			exists[k] = v
+		}
+	}
+	var dupes []Key
+	for _, k := range keys {
+		cnt, ok := counts[string(k)]
+		if !ok {
+			continue
+		}
+		delete(counts, string(k))
+		if cnt > 1 || exists[string(k)] {
+			dupes = append(dupes, k)
+		}
+	}
+	return dupes, nil
+}
+
+// BatchAssertEquals implements the UnionStore BatchAssertEquals interface.
+func (us *unionStore) BatchAssertEquals(pairs []KeyValue) error {
+	for _, p := range pairs {
+		var err error
+		if len(p.Value) == 0 {
+			err = us.recordLazyConditionPair(p.Key, nil, us.presumeKeyNotExistsError())
+		} else {
+			err = us.recordLazyConditionPair(p.Key, append([]byte(nil), p.Value...), ErrLazyConditionPairsNotMatch)
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// CheckLazyConditionPairs implements the UnionStore interface.
+func (us *unionStore) CheckLazyConditionPairs() error {
+	if len(us.lazyConditionPairs) == 0 {
+		return nil
+	}
+	return errors.Trace(us.newConditionCheck(us.lazyConditionPairs).run())
+}
+
+// conditionCheck is a check of lazy condition pairs with the options it
+// needs, it only reads its own fields, so it can run on another goroutine
+// while the union store is used.
+type conditionCheck struct {
+	pairs      map[string]*conditionPair
+	snapshot   Snapshot
+	prefetcher *conditionPrefetcher
+	metrics    func(ConditionCheckStats)
+	sortKeys   bool
+	density    float64
+	report     func(keys int, dur time.Duration)
+}
+
+// newConditionCheck creates a check of pairs, which must not be changed while
+// the check runs. The running prefetch is waited for.
+func (us *unionStore) newConditionCheck(pairs map[string]*conditionPair) *conditionCheck {
+	if us.prefetcher != nil {
+		us.prefetcher.wait()
+	}
+	metrics, _ := us.opts[ConditionCheckMetrics].(func(ConditionCheckStats))
+	density, _ := us.opts[ConditionScanDensity].(float64)
+	return &conditionCheck{
+		pairs:      pairs,
+		snapshot:   us.snapshot,
+		prefetcher: us.prefetcher,
+		metrics:    metrics,
+		sortKeys:   us.opts.isTrue(SortBatchKeys),
+		density:    density,
+		report:     us.slowReadReporter(),
+	}
+}
+
+// observeRead reports a snapshot read of keys which took dur like
+// unionStore.observeRead.
+func (cc *conditionCheck) observeRead(keys int, dur time.Duration) {
+	if cc.report != nil {
+		cc.report(keys, dur)
+	}
+}
+
+func (cc *conditionCheck) run() error {
+	if len(cc.pairs) == 0 {
+		return nil
+	}
+	stats := ConditionCheckStats{Pairs: len(cc.pairs)}
+	if cc.metrics != nil {
+		defer func() { cc.metrics(stats) }()
+	}
+
+	start := time.Now()
+	var existKeys, getKeys []Key
+	exists := make(map[string]bool)
+	values := make(map[string][]byte)
+	for k, v := range cc.pairs {
+		// The prefetched keys are not read again.
+		if cc.prefetcher != nil {
+			if val, ok := cc.prefetcher.get(k); ok {
+				exists[k] = val != nil
+				values[k] = val
+				continue
+			}
+		}
+		if len(v.value) == 0 {
+			existKeys = append(existKeys, v.key)
+		} else {
+			getKeys = append(getKeys, v.key)
+		}
+	}
+	stats.FetchedKeys = len(existKeys) + len(getKeys)
+	if cc.sortKeys {
+		sort.Sort(keySlice(existKeys))
+		sort.Sort(keySlice(getKeys))
+	}
+	var err error
+	if scanKeys := append(existKeys, getKeys...); cc.useScan(scanKeys) {
+		stats.RangeScan = true
+		readStart := time.Now()
+		err = cc.scanKeys(scanKeys, exists, values)
+		cc.observeRead(len(scanKeys), time.Since(readStart))
+	} else {
+		err = cc.batchFetchKeys(existKeys, getKeys, exists, values)
+	}
+	stats.FetchDuration = time.Since(start)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	start = time.Now()
+	defer func() { stats.CompareDuration = time.Since(start) }()
+	for k, v := range cc.pairs {
+		if len(v.value) == 0 {
+			if exists[k] {
+				return errors.Trace(v.err)
+			}
+		} else {
+			if bytes.Compare(values[k], v.value) != 0 {
+				return errors.Trace(ErrLazyConditionPairsNotMatch)
+			}
+		}
+	}
+	return nil
+}
+
+// batchFetchKeys fetches the keys by BatchExist and BatchGet.
+func (cc *conditionCheck) batchFetchKeys(existKeys, getKeys []Key, exists map[string]bool, values map[string][]byte) error {
+	// Values of the must-not-exist pairs are not needed, so only the existence is checked.
+	if len(existKeys) > 0 {
+		readStart := time.Now()
+		m, err := cc.snapshot.BatchExist(existKeys)
+		cc.observeRead(len(existKeys), time.Since(readStart))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for k, v := range m {
+			exists[k] = v
+		}
+	}
+	if len(getKeys) > 0 {
+		readStart := time.Now()
+		m, err := cc.snapshot.BatchGet(getKeys)
+		cc.observeRead(len(getKeys), time.Since(readStart))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for k, v := range m {
+			values[k] = v
+		}
+	}
+	return nil
+}
+
+// useScan tells whether the condition keys are dense enough in the snapshot
+// to be fetched by a scan, see ConditionScanDensity.
+func (cc *conditionCheck) useScan(keys []Key) bool {
+	if cc.density <= 0 || len(keys) < 2 {
+		return false
+	}
+	lo, hi := keys[0], keys[0]
+	for _, k := range keys[1:] {
+		if k.Cmp(lo) < 0 {
+			lo = k
+		}
+		if k.Cmp(hi) > 0 {
+			hi = k
+		}
+	}
+	cnt, err := cc.snapshot.EstimateRangeCount(lo, hi.Next())
+	if err != nil || cnt < 0 {
+		return false
+	}
+	return float64(len(keys)) >= cc.density*float64(cnt)
+}
+
+// scanKeys fetches the keys by one scan of the snapshot over their
+// range, the keys not found don't exist.
+func (cc *conditionCheck) scanKeys(keys []Key, exists map[string]bool, values map[string][]byte) error {
+	wanted := make(map[string]struct{}, len(keys))
+	lo, hi := keys[0], keys[0]
+	for _, k := range keys {
+		wanted[string(k)] = struct{}{}
+		if k.Cmp(lo) < 0 {
+			lo = k
+		}
+		if k.Cmp(hi) > 0 {
+			hi = k
+		}
+	}
+	it, err := cc.snapshot.Seek(lo)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	it = newUpperBoundIter(it, hi.Next())
+	defer it.Close()
+	for it.Valid() {
+		if _, ok := wanted[string(it.Key())]; ok {
+			exists[string(it.Key())] = true
+			values[string(it.Key())] = append([]byte(nil), it.Value()...)
+		}
+		if err = it.Next(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// CheckLazyConditionPairsAll implements the UnionStore CheckLazyConditionPairsAll interface.
+func (us *unionStore) CheckLazyConditionPairsAll() ([]ConditionViolation, error) {
+	if len(us.lazyConditionPairs) == 0 {
+		return nil, nil
+	}
+	keys := make([]Key, 0, len(us.lazyConditionPairs))
+	for _, v := range us.lazyConditionPairs {
+		keys = append(keys, v.key)
+	}
+	sort.Sort(keySlice(keys))
+	// The actual values are reported, so all keys are fetched by BatchGet.
+	values, err := us.snapshot.BatchGet(keys)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var violations []ConditionViolation
+	for _, k := range keys {
+		v := us.lazyConditionPairs[string(k)]
+		actual, exists := values[string(k)]
+		e := v.err
+		if len(v.value) == 0 {
+			if !exists {
+				continue
+			}
+		} else {
+			if bytes.Compare(actual, v.value) == 0 {
+				continue
+			}
+			e = ErrLazyConditionPairsNotMatch
+		}
+		violations = append(violations, ConditionViolation{
+			Key:      k,
+			Expected: v.value,
+			Actual:   actual,
+			Err:      e,
+		})
+	}
+	return violations, nil
+}
+
+// SetSlowReadObserver implements the UnionStore SetSlowReadObserver interface.
+func (us *unionStore) SetSlowReadObserver(f func(keys int, dur time.Duration)) {
+	us.slowReadObserver = f
+}
+
+// observeRead reports a snapshot read of keys which took dur if it's slower
+// than the SlowReadThreshold option.
+func (us *unionStore) observeRead(keys int, dur time.Duration) {
+	if report := us.slowReadReporter(); report != nil {
+		report(keys, dur)
+	}
+}
+
+// slowReadReporter returns a func like observeRead with the current
+// SlowReadThreshold and observer, which is safe to call from another
+// goroutine, or nil if the slow reads are not observed.
+func (us *unionStore) slowReadReporter() func(keys int, dur time.Duration) {
+	threshold, ok := us.opts[SlowReadThreshold].(time.Duration)
+	observer := us.slowReadObserver
+	if !ok || observer == nil {
+		return nil
+	}
+	return func(keys int, dur time.Duration) {
+		if dur > threshold {
+			observer(keys, dur)
+		}
+	}
+}
+
+// newConditionPairs creates the map of lazy condition pairs sized by the
+// ConditionHint option.
+func (us *unionStore) newConditionPairs() map[string](*conditionPair) {
+	hint, _ := us.opts[ConditionHint].(int)
+	if hint < 0 {
+		hint = 0
+	}
+	return make(map[string](*conditionPair), hint)
+}
+
+// FlushConditionChecks implements the UnionStore FlushConditionChecks interface.
+func (us *unionStore) FlushConditionChecks() error {
+	if err := us.CheckLazyConditionPairs(); err != nil {
+		return errors.Trace(err)
+	}
+	us.notifyConditionCleared(len(us.lazyConditionPairs))
+	us.lazyConditionPairs = us.newConditionPairs()
+	return nil
+}
+
+// Update implements the UnionStore Update interface.
+func (us *unionStore) Update(k Key, f func(old []byte, exists bool) (new []byte, delete bool, err error)) error {
+	old, err := us.MemBuffer.Get(k)
+	// fromSnapshot means old is read from the snapshot, the read is checked
+	// at commit time.
+	fromSnapshot := false
+	if IsErrNotFound(err) {
+		old, err = us.snapshot.Get(k)
+		if err != nil && !IsErrNotFound(err) {
+			return errors.Trace(err)
+		}
+		if err = us.checkConditionConflict(k, old); err != nil {
+			return errors.Trace(err)
+		}
+		fromSnapshot = true
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	exists := len(old) > 0
+	// f may change old in place, the recorded condition must not see it.
+	observed := append([]byte(nil), old...)
+	if !exists {
+		old = nil
+	}
+	newVal, del, err := f(old, exists)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if del {
+		err = us.Delete(k)
+	} else {
+		err = us.Set(k, newVal)
+	}
+	if err != nil || !fromSnapshot {
+		return errors.Trace(err)
+	}
+	// The condition is recorded only when the write is done.
+	return us.recordLazyConditionPair(k, observed, ErrLazyConditionPairsNotMatch)
+}
+
+// SeekUntil implements the UnionStore SeekUntil interface.
+func (us *unionStore) SeekUntil(start Key, stop func(k Key, v []byte) bool) (Iterator, error) {
+	it, err := us.Seek(start)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return newStopIter(it, stop), nil
+}
+
+// SeekSnapshotOnly implements the UnionStore SeekSnapshotOnly interface.
+func (us *unionStore) SeekSnapshotOnly(start, end Key) (Iterator, error) {
+	it, err := us.snapshot.Seek(start)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return newUpperBoundIter(it, end), nil
+}
+
+// PreCommit implements the UnionStore PreCommit interface.
+func (us *unionStore) PreCommit() error {
+	return us.PreCommitWith(nil)
+}
+
+// PreCommitWith implements the UnionStore PreCommitWith interface.
+// With AsyncConditionCheck, the condition check is always waited for, and
+// its error is returned before the errors of the size check and build. The
+// check runs on a copy of the pairs, the pairs build records are checked
+// after build returns.
+func (us *unionStore) PreCommitWith(build func() error) error {
+	checkCondition := !us.opts.isTrue(SkipPreCommitConditionCheck)
+	if checkCondition && us.opts.isTrue(AsyncConditionCheck) {
+		pairs := make(map[string]*conditionPair, len(us.lazyConditionPairs))
+		for k, v := range us.lazyConditionPairs {
+			pairs[k] = v
+		}
+		cc := us.newConditionCheck(pairs)
+		ch := make(chan error, 1)
+		go func() {
+			ch <- cc.run()
+		}()
+		err := us.checkSizeAndBuild(build)
+		if condErr := <-ch; condErr != nil {
+			return errors.Trace(condErr)
+		}
+		// The pairs are replaced by new ones when recorded, so a changed
+		// pointer is a pair recorded by build.
+		recorded := make(map[string]*conditionPair)
+		for k, v := range us.lazyConditionPairs {
+			if pairs[k] != v {
+				recorded[k] = v
+			}
+		}
+		if condErr := us.newConditionCheck(recorded).run(); condErr != nil {
+			return errors.Trace(condErr)
+		}
+		return errors.Trace(err)
+	}
+	if checkCondition {
+		if err := us.CheckLazyConditionPairs(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(us.checkSizeAndBuild(build))
+}
+
+// checkSizeAndBuild runs the size check of PreCommit and then build if it's
+// not nil.
+func (us *unionStore) checkSizeAndBuild(build func() error) error {
+	if !us.opts.isTrue(SkipPreCommitSizeCheck) {
+		if err := us.checkTxnSize(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if build != nil {
+		return errors.Trace(build())
+	}
+	return nil
+}
+
+// checkTxnSize validates the buffer against the transaction size limits.
+func (us *unionStore) checkTxnSize() error {
+	if size := us.Size(); size > TxnTotalSizeLimit {
+		return ErrTxnTooLarge.Gen("transaction too large, size:%d", size)
+	}
+	if l := us.Len(); uint64(l) > atomic.LoadUint64(&TxnEntryCountLimit) {
+		return ErrTxnTooLarge.Gen("transaction too large, len:%d", l)
+	}
+	return nil
+}
+
+// SetOption implements the UnionStore SetOption interface.
+func (us *unionStore) SetOption(opt Option, val interface{}) {
+	us.opts[opt] = val
+	if opt == BufferValueTransformer {
+		t, _ := val.(ValueTransformer)
+		us.BufferStore.MemBuffer.(*lazyMemBuffer).transformer = t
+	}
+	if opt == ReadBatchWindow {
+		d, _ := val.(time.Duration)
+		us.setReadBatchWindow(d)
+	}
+	if opt == KeepHistory {
+		us.BufferStore.MemBuffer.(*lazyMemBuffer).keepHistory = us.opts.isTrue(KeepHistory)
+	}
+	if opt == TrackWriteTime {
+		us.BufferStore.MemBuffer.(*lazyMemBuffer).trackWriteTime = us.opts.isTrue(TrackWriteTime)
+	}
+	if opt == AppendOnly {
+		us.BufferStore.MemBuffer.(*lazyMemBuffer).appendOnly = us.opts.isTrue(AppendOnly)
+	}
+	if opt == ConditionHint && len(us.lazyConditionPairs) == 0 {
+		us.lazyConditionPairs = us.newConditionPairs()
+	}
+	if opt == ForbiddenRanges {
+		ranges, _ := val.([]KeyRange)
+		us.setForbiddenRanges(ranges)
+	}
+}
+
+// WalkCommitMutations implements the UnionStore WalkCommitMutations interface.
+func (us *unionStore) WalkCommitMutations(f func(op Op) error) error {
+	filter, _ := us.opts[CommitFilter].(func(op Op) (Op, error))
+	err := us.WalkBuffer(func(k Key, v []byte) error {
+		op := Op{Tp: OpSet, Key: k, Value: v}
+		if len(v) == 0 {
+			op = Op{Tp: OpDelete, Key: k}
+		}
+		if filter != nil {
+			var err error
+			op, err = filter(op)
+			if ErrSkipMutation.Equal(err) {
+				return nil
+			}
+			if err != nil {
+				return errors.Trace(err)
+			}
+			switch op.Tp {
+			case OpSet:
+				// An empty value is a tombstone in the buffer, so is it here.
+				if len(op.Value) == 0 {
+					op = Op{Tp: OpDelete, Key: op.Key}
+				}
+			case OpDelete:
+			default:
+				return errors.Errorf("invalid mutation type %d of key %q from the commit filter", op.Tp, op.Key)
+			}
+		}
+		return errors.Trace(f(op))
+	})
+	return errors.Trace(err)
+}
+
+// ApplyMutations implements the UnionStore ApplyMutations interface.
+func (us *unionStore) ApplyMutations(ops []Op) error {
+	for i, op := range ops {
+		var err error
+		switch op.Tp {
+		case OpSet:
+			err = us.Set(op.Key, op.Value)
+		case OpDelete:
+			err = us.Delete(op.Key)
+		default:
+			err = errors.Errorf("invalid mutation type %d", op.Tp)
+		}
+		if err != nil {
+			return errors.Annotatef(err, "mutation %d %v", i, op)
+		}
+	}
+	return nil
+}
+
+// ValidateConditionConsistency implements the UnionStore ValidateConditionConsistency interface.
+func (us *unionStore) ValidateConditionConsistency() error {
+	keys, err := us.deletedConditionKeys()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return errors.Errorf("keys %q must not exist but are deleted", keys)
+}
+
+// deletedConditionKeys returns the sorted keys which must not exist by the
+// lazy condition pairs but are deleted in the buffer.
+func (us *unionStore) deletedConditionKeys() ([]Key, error) {
+	var keys []Key
+	for _, v := range us.lazyConditionPairs {
+		if len(v.value) != 0 {
+			continue
+		}
+		val, err := us.MemBuffer.Get(v.key)
+		if IsErrNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(val) == 0 {
+			keys = append(keys, v.key)
+		}
+	}
+	sort.Sort(keySlice(keys))
+	return keys, nil
+}
+
+// DumpBuffer implements the UnionStore DumpBuffer interface.
+func (us *unionStore) DumpBuffer(limit int) []BufferEntry {
+	var entries []BufferEntry
+	us.WalkBufferRangeLimit(nil, nil, limit, func(k Key, v []byte) error {
+		entries = append(entries, BufferEntry{
+			Key:       k.Clone(),
+			Tombstone: len(v) == 0,
+			ValueLen:  len(v),
+		})
+		return nil
+	})
+	return entries
+}
+
+// RefreshSnapshot implements the UnionStore RefreshSnapshot interface.
+func (us *unionStore) RefreshSnapshot(newSnapshot Snapshot) {
+	if us.prefetcher != nil {
+		us.prefetcher.wait()
+		us.prefetcher = nil
+	}
+	old := us.snapshot
+	if bs, ok := old.(*batchingSnapshot); ok {
+		old = bs.Snapshot
+	}
+	us.snapshot = newSnapshot
+	us.BufferStore.r = newSnapshot
+	if d, ok := us.opts[ReadBatchWindow].(time.Duration); ok {
+		us.setReadBatchWindow(d)
+	}
+	if old != newSnapshot {
+		old.Release()
+	}
+}
+
+// setReadBatchWindow wraps the snapshot by a batchingSnapshot with window d,
+// or unwraps it if d is not positive.
+func (us *unionStore) setReadBatchWindow(d time.Duration) {
+	snapshot := us.snapshot
+	if bs, ok := snapshot.(*batchingSnapshot); ok {
+		snapshot = bs.Snapshot
+	}
+	if d > 0 {
+		snapshot = NewBatchingSnapshot(snapshot, d, DefaultReadBatchMaxSize)
+	}
+	us.snapshot = snapshot
+	us.BufferStore.r = snapshot
+}
+
+// DelOption implements the UnionStore DelOption interface.
+func (us *unionStore) DelOption(opt Option) {
+	delete(us.opts, opt)
+	if opt == BufferValueTransformer {
+		us.BufferStore.MemBuffer.(*lazyMemBuffer).transformer = nil
+	}
+	if opt == ReadBatchWindow {
+		us.setReadBatchWindow(0)
+	}
+	if opt == KeepHistory {
+		us.BufferStore.MemBuffer.(*lazyMemBuffer).keepHistory = false
+	}
+	if opt == TrackWriteTime {
+		us.BufferStore.MemBuffer.(*lazyMemBuffer).trackWriteTime = false
+	}
+	if opt == AppendOnly {
+		us.BufferStore.MemBuffer.(*lazyMemBuffer).appendOnly = false
+	}
+	if opt == ForbiddenRanges {
+		us.forbidden = nil
+	}
+}
+
+// GetOption implements the UnionStore GetOption interface.
+func (us *unionStore) GetOption(opt Option) interface{} {
+	return us.opts[opt]
+}
+
+type options map[Option]interface{}
+
+func (opts options) Get(opt Option) (interface{}, bool) {
+	v, ok := opts[opt]
+	return v, ok
+}
+
+// isTrue returns whether the option is set with a true value.
+func (opts options) isTrue(opt Option) bool {
+	b, _ := opts[opt].(bool)
+	return b
 }
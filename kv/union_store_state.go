@@ -0,0 +1,216 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/terror"
+)
+
+// unionStoreStateVersion is the version of the marshaled UnionStore state.
+// It must be increased whenever the format changes.
+const unionStoreStateVersion = 1
+
+// Types of the option values which can be marshaled.
+const (
+	stateValueNil      = "nil"
+	stateValueBool     = "bool"
+	stateValueInt      = "int"
+	stateValueIsoLevel = "isolevel"
+	stateValueError    = "error"
+	stateValueDuration = "duration"
+	stateValueFloat    = "float"
+	stateValueRanges   = "ranges"
+)
+
+type unionStoreState struct {
+	Version    int              `json:"version"`
+	Buffer     []KeyValue       `json:"buffer"`
+	Conditions []conditionState `json:"conditions"`
+	Options    []optionState    `json:"options"`
+}
+
+type conditionState struct {
+	Key   Key           `json:"key"`
+	Value []byte        `json:"value"`
+	Err   *terror.Error `json:"err"`
+}
+
+type optionState struct {
+	Opt   Option          `json:"opt"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// MarshalState implements the UnionStore MarshalState interface.
+func (us *unionStore) MarshalState() ([]byte, error) {
+	state := unionStoreState{Version: unionStoreStateVersion}
+	err := us.WalkBuffer(func(k Key, v []byte) error {
+		state.Buffer = append(state.Buffer, KeyValue{Key: k, Value: v})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, c := range us.lazyConditionPairs {
+		e, ok := errors.Cause(c.err).(*terror.Error)
+		if !ok {
+			return nil, errors.Errorf("can't marshal condition pair error %v of key %q", c.err, c.key)
+		}
+		state.Conditions = append(state.Conditions, conditionState{Key: c.key, Value: c.value, Err: e})
+	}
+	for opt, val := range us.opts {
+		// The func options, like KeyValidator and CommitFilter, can't be
+		// marshaled and are left out of the state, the caller sets them
+		// again on the restored store.
+		if reflect.ValueOf(val).Kind() == reflect.Func {
+			continue
+		}
+		o, err := marshalOption(opt, val)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		state.Options = append(state.Options, o)
+	}
+	// The maps are sorted so that the same state is always marshaled the same.
+	sort.Slice(state.Conditions, func(i, j int) bool {
+		return state.Conditions[i].Key.Cmp(state.Conditions[j].Key) < 0
+	})
+	sortOptionStates(state.Options)
+	data, err := json.Marshal(state)
+	return data, errors.Trace(err)
+}
+
+func sortOptionStates(options []optionState) {
+	sort.Slice(options, func(i, j int) bool {
+		return options[i].Opt < options[j].Opt
+	})
+}
+
+func marshalOption(opt Option, val interface{}) (optionState, error) {
+	o := optionState{Opt: opt}
+	switch x := val.(type) {
+	case nil:
+		o.Type = stateValueNil
+	case bool:
+		o.Type = stateValueBool
+	case int:
+		o.Type = stateValueInt
+	case IsoLevel:
+		o.Type = stateValueIsoLevel
+	case time.Duration:
+		o.Type = stateValueDuration
+	case float64:
+		o.Type = stateValueFloat
+	case []KeyRange:
+		o.Type = stateValueRanges
+	case error:
+		e, ok := errors.Cause(x).(*terror.Error)
+		if !ok {
+			return o, errors.Errorf("can't marshal option %d with value %v", opt, x)
+		}
+		o.Type = stateValueError
+		val = e
+	default:
+		return o, errors.Errorf("can't marshal option %d with value type %T", opt, val)
+	}
+	data, err := json.Marshal(val)
+	if err != nil {
+		return o, errors.Trace(err)
+	}
+	o.Value = data
+	return o, nil
+}
+
+func unmarshalOption(o optionState) (interface{}, error) {
+	var err error
+	switch o.Type {
+	case stateValueNil:
+		return nil, nil
+	case stateValueBool:
+		var b bool
+		err = json.Unmarshal(o.Value, &b)
+		return b, errors.Trace(err)
+	case stateValueInt:
+		var i int
+		err = json.Unmarshal(o.Value, &i)
+		return i, errors.Trace(err)
+	case stateValueIsoLevel:
+		var l IsoLevel
+		err = json.Unmarshal(o.Value, &l)
+		return l, errors.Trace(err)
+	case stateValueError:
+		e := &terror.Error{}
+		err = json.Unmarshal(o.Value, e)
+		return e, errors.Trace(err)
+	case stateValueDuration:
+		var d time.Duration
+		err = json.Unmarshal(o.Value, &d)
+		return d, errors.Trace(err)
+	case stateValueFloat:
+		var f float64
+		err = json.Unmarshal(o.Value, &f)
+		return f, errors.Trace(err)
+	case stateValueRanges:
+		var ranges []KeyRange
+		err = json.Unmarshal(o.Value, &ranges)
+		return ranges, errors.Trace(err)
+	}
+	return nil, errors.Errorf("unknown value type %s of option %d", o.Type, o.Opt)
+}
+
+// RestoreUnionStore rebuilds a UnionStore from the state marshaled by
+// UnionStore.MarshalState on top of snapshot. The buffered writes, lazy
+// condition pairs and options are restored while the snapshot is not part
+// of the state, nor are the func options. The options are set by SetOption
+// in the order of Option after the buffer is restored, so they apply to the
+// writes after the restore.
+func RestoreUnionStore(snapshot Snapshot, data []byte) (UnionStore, error) {
+	var state unionStoreState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if state.Version != unionStoreStateVersion {
+		return nil, errors.Errorf("unsupported union store state version %d, expect %d", state.Version, unionStoreStateVersion)
+	}
+	us := NewUnionStore(snapshot).(*unionStore)
+	for _, kv := range state.Buffer {
+		var err error
+		if len(kv.Value) == 0 {
+			err = us.MemBuffer.Delete(kv.Key)
+		} else {
+			err = us.MemBuffer.Set(kv.Key, kv.Value)
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	for _, c := range state.Conditions {
+		us.markLazyConditionPair(c.Key, c.Value, c.Err)
+	}
+	sortOptionStates(state.Options)
+	for _, o := range state.Options {
+		val, err := unmarshalOption(o)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		us.SetOption(o.Opt, val)
+	}
+	return us, nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+var _ = Suite(&testUnionStoreStateSuite{})
+
+type testUnionStoreStateSuite struct{}
+
+func (s *testUnionStoreStateSuite) TestRoundTrip(c *C) {
+	defer testleak.AfterTest(c)()
+	store := NewMemDbBuffer()
+	store.Set(Key("a"), []byte("1"))
+	store.Set(Key("b"), []byte("2"))
+	us := NewUnionStore(&mockSnapshot{store})
+
+	c.Assert(us.Set(Key("a"), []byte("x")), IsNil)
+	c.Assert(us.Set(Key("c"), []byte("3")), IsNil)
+	c.Assert(us.Delete(Key("b")), IsNil)
+	c.Assert(us.BatchAssertNotExists([]Key{Key("d")}), IsNil)
+	c.Assert(us.BatchAssertEquals([]KeyValue{{Key: Key("a"), Value: []byte("1")}}), IsNil)
+	us.SetOption(PresumeKeyNotExists, nil)
+	us.SetOption(PresumeKeyNotExistsError, ErrNotExist)
+	us.SetOption(IsolationLevel, RC)
+	us.SetOption(Priority, PriorityHigh)
+	us.SetOption(NotFillCache, true)
+
+	data, err := us.MarshalState()
+	c.Assert(err, IsNil)
+	restored, err := RestoreUnionStore(&mockSnapshot{store}, data)
+	c.Assert(err, IsNil)
+
+	var expect, obtain []KeyValue
+	collect := func(kvs *[]KeyValue) func(k Key, v []byte) error {
+		return func(k Key, v []byte) error {
+			*kvs = append(*kvs, KeyValue{Key: k.Clone(), Value: append([]byte{}, v...)})
+			return nil
+		}
+	}
+	c.Assert(us.WalkBuffer(collect(&expect)), IsNil)
+	c.Assert(restored.WalkBuffer(collect(&obtain)), IsNil)
+	c.Assert(obtain, DeepEquals, expect)
+	_, err = restored.Get(Key("b"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+
+	_, ok := restored.(*unionStore).opts.Get(PresumeKeyNotExists)
+	c.Assert(ok, IsTrue)
+	c.Assert(ErrNotExist.Equal(restored.GetOption(PresumeKeyNotExistsError).(error)), IsTrue)
+	c.Assert(restored.GetOption(IsolationLevel), Equals, RC)
+	c.Assert(restored.GetOption(Priority), Equals, PriorityHigh)
+	c.Assert(restored.GetOption(NotFillCache), Equals, true)
+
+	// Condition pairs are restored.
+	c.Assert(restored.CheckLazyConditionPairs(), IsNil)
+	store.Set(Key("d"), []byte("4"))
+	c.Assert(ErrKeyExists.Equal(restored.CheckLazyConditionPairs()), IsTrue)
+}
+
+func (s *testUnionStoreStateSuite) TestRestoreSetsOptions(c *C) {
+	defer testleak.AfterTest(c)()
+	us := NewUnionStore(&mockSnapshot{NewMemDbBuffer()})
+	us.SetOption(KeepHistory, true)
+	us.SetOption(TrackWriteTime, true)
+	c.Assert(us.Set(Key("a"), []byte("1")), IsNil)
+	data, err := us.MarshalState()
+	c.Assert(err, IsNil)
+	restored, err := RestoreUnionStore(&mockSnapshot{NewMemDbBuffer()}, data)
+	c.Assert(err, IsNil)
+
+	// The restored options take effect on the later writes.
+	c.Assert(restored.Set(Key("b"), []byte("2")), IsNil)
+	history, err := restored.History(Key("b"))
+	c.Assert(err, IsNil)
+	c.Assert(history, HasLen, 1)
+	_, ok := restored.BufferedSince(Key("b"))
+	c.Assert(ok, IsTrue)
+}
+
+func (s *testUnionStoreStateSuite) TestOptionValueTypes(c *C) {
+	defer testleak.AfterTest(c)()
+	us := NewUnionStore(&mockSnapshot{NewMemDbBuffer()})
+	ranges := []KeyRange{{StartKey: Key("x"), EndKey: Key("y")}, {StartKey: Key("z")}}
+	us.SetOption(SlowReadThreshold, time.Second)
+	us.SetOption(ConditionScanDensity, 0.5)
+	us.SetOption(ForbiddenRanges, ranges)
+	us.SetOption(KeyValidator, func(k Key) error { return nil })
+	us.SetOption(CommitFilter, func(op Op) (Op, error) { return op, nil })
+	data, err := us.MarshalState()
+	c.Assert(err, IsNil)
+	restored, err := RestoreUnionStore(&mockSnapshot{NewMemDbBuffer()}, data)
+	c.Assert(err, IsNil)
+
+	c.Assert(restored.GetOption(SlowReadThreshold), Equals, time.Second)
+	c.Assert(restored.GetOption(ConditionScanDensity), Equals, 0.5)
+	c.Assert(restored.GetOption(ForbiddenRanges), DeepEquals, ranges)
+	c.Assert(ErrForbiddenKeyRange.Equal(restored.Set(Key("x1"), []byte("1"))), IsTrue)
+	c.Assert(ErrForbiddenKeyRange.Equal(restored.Set(Key("z1"), []byte("1"))), IsTrue)
+	c.Assert(restored.Set(Key("y"), []byte("1")), IsNil)
+
+	// The func options are left out.
+	c.Assert(restored.GetOption(KeyValidator), IsNil)
+	c.Assert(restored.GetOption(CommitFilter), IsNil)
+}
+
+func (s *testUnionStoreStateSuite) TestStateOrder(c *C) {
+	defer testleak.AfterTest(c)()
+	us := NewUnionStore(&mockSnapshot{NewMemDbBuffer()})
+	c.Assert(us.BatchAssertNotExists([]Key{Key("c"), Key("a"), Key("d"), Key("b")}), IsNil)
+	us.SetOption(PresumeKeyNotExists, nil)
+	us.SetOption(IsolationLevel, RC)
+	us.SetOption(Priority, PriorityHigh)
+	us.SetOption(NotFillCache, true)
+	us.SetOption(KeepHistory, true)
+	us.SetOption(TrackWriteTime, true)
+	data, err := us.MarshalState()
+	c.Assert(err, IsNil)
+	for i := 0; i < 10; i++ {
+		again, err := us.MarshalState()
+		c.Assert(err, IsNil)
+		c.Assert(again, BytesEquals, data)
+	}
+
+	// The options are restored in the order of Option whatever the order
+	// in the state.
+	var state unionStoreState
+	c.Assert(json.Unmarshal(data, &state), IsNil)
+	for i, j := 0, len(state.Options)-1; i < j; i, j = i+1, j-1 {
+		state.Options[i], state.Options[j] = state.Options[j], state.Options[i]
+	}
+	reversed, err := json.Marshal(state)
+	c.Assert(err, IsNil)
+	restored, err := RestoreUnionStore(&mockSnapshot{NewMemDbBuffer()}, reversed)
+	c.Assert(err, IsNil)
+	restoredData, err := restored.MarshalState()
+	c.Assert(err, IsNil)
+	c.Assert(restoredData, BytesEquals, data)
+}
+
+func (s *testUnionStoreStateSuite) TestRestoreErrors(c *C) {
+	defer testleak.AfterTest(c)()
+	us := NewUnionStore(&mockSnapshot{NewMemDbBuffer()})
+	c.Assert(us.Set(Key("a"), []byte("1")), IsNil)
+	data, err := us.MarshalState()
+	c.Assert(err, IsNil)
+
+	var state unionStoreState
+	c.Assert(json.Unmarshal(data, &state), IsNil)
+	state.Version = unionStoreStateVersion + 1
+	data, err = json.Marshal(state)
+	c.Assert(err, IsNil)
+	_, err = RestoreUnionStore(&mockSnapshot{NewMemDbBuffer()}, data)
+	c.Assert(err, ErrorMatches, ".*unsupported union store state version.*")
+
+	_, err = RestoreUnionStore(&mockSnapshot{NewMemDbBuffer()}, []byte("invalid"))
+	c.Assert(err, NotNil)
+
+	// Options which can't be serialized are rejected.
+	us.SetOption(SchemaLeaseChecker, struct{}{})
+	_, err = us.MarshalState()
+	c.Assert(err, NotNil)
+}
@@ -14,6 +14,14 @@
 package kv
 
 import (
+	"bytes"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
 	. "github.com/pingcap/check"
 	"github.com/pingcap/tidb/terror"
 	"github.com/pingcap/tidb/util/testleak"
@@ -125,6 +133,2320 @@ func (s *testUnionStoreSuite) TestLazyConditionCheck(c *C) {
 	c.Assert(err, NotNil)
 }
 
+func (s *testUnionStoreSuite) TestUpdate(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("cnt"), []byte("1"))
+
+	incr := func(old []byte, exists bool) ([]byte, bool, error) {
+		if !exists {
+			return []byte("1"), false, nil
+		}
+		n, err := strconv.Atoi(string(old))
+		if err != nil {
+			return nil, false, err
+		}
+		return []byte(strconv.Itoa(n + 1)), false, nil
+	}
+
+	// Increment an existing value.
+	err := s.us.Update([]byte("cnt"), incr)
+	c.Assert(err, IsNil)
+	err = s.us.Update([]byte("cnt"), incr)
+	c.Assert(err, IsNil)
+	v, err := s.us.Get([]byte("cnt"))
+	c.Assert(err, IsNil)
+	c.Assert(v, BytesEquals, []byte("3"))
+
+	// Insert an absent value.
+	err = s.us.Update([]byte("new"), incr)
+	c.Assert(err, IsNil)
+	v, err = s.us.Get([]byte("new"))
+	c.Assert(err, IsNil)
+	c.Assert(v, BytesEquals, []byte("1"))
+	c.Assert(s.us.CheckLazyConditionPairs(), IsNil)
+
+	// Delete on condition.
+	s.store.Set([]byte("del"), []byte("done"))
+	err = s.us.Update([]byte("del"), func(old []byte, exists bool) ([]byte, bool, error) {
+		c.Assert(exists, IsTrue)
+		return nil, string(old) == "done", nil
+	})
+	c.Assert(err, IsNil)
+	_, err = s.us.Get([]byte("del"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+
+	// An error from f leaves the buffer untouched.
+	err = s.us.Update([]byte("cnt"), func(old []byte, exists bool) ([]byte, bool, error) {
+		return nil, false, ErrNotImplemented
+	})
+	c.Assert(ErrNotImplemented.Equal(err), IsTrue)
+	v, err = s.us.Get([]byte("cnt"))
+	c.Assert(err, IsNil)
+	c.Assert(v, BytesEquals, []byte("3"))
+
+	// Concurrent changes of the observed values are detected.
+	s.store.Set([]byte("cnt"), []byte("10"))
+	err = s.us.CheckLazyConditionPairs()
+	c.Assert(ErrLazyConditionPairsNotMatch.Equal(err), IsTrue)
+	s.store.Set([]byte("cnt"), []byte("1"))
+	s.store.Set([]byte("new"), []byte("1"))
+	err = s.us.CheckLazyConditionPairs()
+	c.Assert(ErrLazyConditionPairsNotMatch.Equal(err), IsTrue)
+
+	// A recorded condition expecting another value is a conflict.
+	c.Assert(s.us.BatchAssertNotExists([]Key{Key("other")}), IsNil)
+	s.store.Set([]byte("other"), []byte("1"))
+	err = s.us.Update([]byte("other"), incr)
+	c.Assert(ErrConditionConflict.Equal(err), IsTrue)
+
+	// An f which changes old in place doesn't change the condition.
+	s.store.Set([]byte("inplace"), []byte("1"))
+	err = s.us.Update([]byte("inplace"), func(old []byte, exists bool) ([]byte, bool, error) {
+		old[0]++
+		return old, false, nil
+	})
+	c.Assert(err, IsNil)
+	v, err = s.us.Get([]byte("inplace"))
+	c.Assert(err, IsNil)
+	c.Assert(v, BytesEquals, []byte("2"))
+	c.Assert(s.us.(*unionStore).lazyConditionPairs["inplace"].value, BytesEquals, []byte("1"))
+
+	// A failed Update records no condition.
+	s.store.Set([]byte("fail"), []byte("1"))
+	keys := len(s.us.LockKeys())
+	err = s.us.Update([]byte("fail"), func(old []byte, exists bool) ([]byte, bool, error) {
+		return nil, false, ErrNotImplemented
+	})
+	c.Assert(ErrNotImplemented.Equal(err), IsTrue)
+	s.us.SetOption(KeyValidator, func(k Key) error { return ErrNotImplemented })
+	err = s.us.Update([]byte("fail"), incr)
+	c.Assert(ErrNotImplemented.Equal(err), IsTrue)
+	s.us.DelOption(KeyValidator)
+	c.Assert(s.us.LockKeys(), HasLen, keys)
+}
+
+func (s *testUnionStoreSuite) TestSeekUntil(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("todo"))
+	s.store.Set([]byte("2"), []byte("todo"))
+	s.store.Set([]byte("4"), []byte("done"))
+	s.store.Set([]byte("5"), []byte("todo"))
+	s.us.Set([]byte("3"), []byte("todo"))
+	s.us.Set([]byte("6"), []byte("done"))
+
+	stop := func(k Key, v []byte) bool {
+		return string(v) == "done"
+	}
+	// Stops in the snapshot layer.
+	iter, err := s.us.SeekUntil(nil, stop)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("1"), []byte("2"), []byte("3")}, [][]byte{[]byte("todo"), []byte("todo"), []byte("todo")})
+
+	// Stops in the buffer layer.
+	iter, err = s.us.SeekUntil([]byte("5"), stop)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("5")}, [][]byte{[]byte("todo")})
+
+	// Stops at the first entry.
+	iter, err = s.us.SeekUntil([]byte("4"), stop)
+	c.Assert(err, IsNil)
+	c.Assert(iter.Valid(), IsFalse)
+	iter.Close()
+
+	// The buffered write shadows the snapshot one.
+	s.us.Set([]byte("4"), []byte("todo"))
+	iter, err = s.us.SeekUntil([]byte("4"), stop)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("4"), []byte("5")}, [][]byte{[]byte("todo"), []byte("todo")})
+}
+
+func (s *testUnionStoreSuite) TestSeekSnapshotOnly(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	s.store.Set([]byte("3"), []byte("3"))
+	s.store.Set([]byte("4"), []byte("4"))
+
+	s.us.Set([]byte("2"), []byte("b"))
+	s.us.Set([]byte("25"), []byte("25"))
+	s.us.Delete([]byte("3"))
+
+	iter, err := s.us.SeekSnapshotOnly([]byte("2"), []byte("4"))
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("2"), []byte("3")}, [][]byte{[]byte("2"), []byte("3")})
+
+	iter, err = s.us.SeekSnapshotOnly(nil, nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("1"), []byte("2"), []byte("3"), []byte("4")}, [][]byte{[]byte("1"), []byte("2"), []byte("3"), []byte("4")})
+
+	// Snapshot contents changes are visible.
+	s.store.Set([]byte("1"), []byte("a"))
+	iter, err = s.us.SeekSnapshotOnly(nil, []byte("3"))
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("1"), []byte("2")}, [][]byte{[]byte("a"), []byte("2")})
+}
+
+func (s *testUnionStoreSuite) TestPreCommit(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+
+	s.us.SetOption(PresumeKeyNotExists, nil)
+	_, err := s.us.Get([]byte("1"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+	s.us.DelOption(PresumeKeyNotExists)
+	err = s.us.PreCommit()
+	c.Assert(ErrKeyExists.Equal(err), IsTrue)
+
+	s.us.SetOption(SkipPreCommitConditionCheck, true)
+	c.Assert(s.us.PreCommit(), IsNil)
+	s.us.SetOption(SkipPreCommitConditionCheck, false)
+	c.Assert(s.us.PreCommit(), NotNil)
+	s.us.DelOption(SkipPreCommitConditionCheck)
+
+	// Size validation.
+	us := NewUnionStore(&mockSnapshot{NewMemDbBuffer()})
+	for i := 0; i < 10; i++ {
+		c.Assert(us.Set(encodeInt(i), encodeInt(i)), IsNil)
+	}
+	c.Assert(us.PreCommit(), IsNil)
+	originLimit := atomic.LoadUint64(&TxnEntryCountLimit)
+	defer atomic.StoreUint64(&TxnEntryCountLimit, originLimit)
+	atomic.StoreUint64(&TxnEntryCountLimit, 5)
+	err = us.PreCommit()
+	c.Assert(ErrTxnTooLarge.Equal(err), IsTrue)
+	us.SetOption(SkipPreCommitSizeCheck, true)
+	c.Assert(us.PreCommit(), IsNil)
+}
+
+// gatedSnapshot is a Snapshot whose BatchGet and BatchExist wait until gate is
+// closed, or fail after a second.
+type gatedSnapshot struct {
+	Snapshot
+	gate chan struct{}
+}
+
+func (s *gatedSnapshot) wait() error {
+	select {
+	case <-s.gate:
+		return nil
+	case <-time.After(time.Second):
+		return errors.New("gate is not opened")
+	}
+}
+
+func (s *gatedSnapshot) BatchGet(keys []Key) (map[string][]byte, error) {
+	if err := s.wait(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return s.Snapshot.BatchGet(keys)
+}
+
+func (s *gatedSnapshot) BatchExist(keys []Key) (map[string]bool, error) {
+	if err := s.wait(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return s.Snapshot.BatchExist(keys)
+}
+
+func (s *testUnionStoreSuite) TestAsyncConditionCheck(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	snap := &gatedSnapshot{Snapshot: &mockSnapshot{s.store}, gate: make(chan struct{})}
+	us := NewUnionStore(snap)
+	us.SetOption(AsyncConditionCheck, true)
+	us.SetOption(PresumeKeyNotExists, nil)
+	_, err := us.Get([]byte("1"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+	us.DelOption(PresumeKeyNotExists)
+
+	// The condition check waits for build to open the gate, so they must run
+	// concurrently. The mismatch still fails PreCommitWith.
+	built := false
+	err = us.PreCommitWith(func() error {
+		close(snap.gate)
+		built = true
+		return nil
+	})
+	c.Assert(ErrKeyExists.Equal(err), IsTrue)
+	c.Assert(built, IsTrue)
+
+	// The pairs recorded by build while the check runs are checked after it.
+	snap2 := &gatedSnapshot{Snapshot: &mockSnapshot{s.store}, gate: make(chan struct{})}
+	us2 := NewUnionStore(snap2)
+	us2.SetOption(AsyncConditionCheck, true)
+	c.Assert(us2.BatchAssertNotExists([]Key{Key("2")}), IsNil)
+	err = us2.PreCommitWith(func() error {
+		us2.SetOption(PresumeKeyNotExists, nil)
+		for i := 0; i < 100; i++ {
+			us2.Get(Key(strconv.Itoa(i + 3)))
+		}
+		us2.Get([]byte("1"))
+		us2.DelOption(PresumeKeyNotExists)
+		close(snap2.gate)
+		return nil
+	})
+	c.Assert(ErrKeyExists.Equal(err), IsTrue)
+
+	// The error of build is returned when the condition check is skipped.
+	us.SetOption(SkipPreCommitConditionCheck, true)
+	err = us.PreCommitWith(func() error {
+		return ErrNotImplemented
+	})
+	c.Assert(ErrNotImplemented.Equal(err), IsTrue)
+}
+
+func (s *testUnionStoreSuite) TestUndoKey(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+
+	// Undo a set.
+	s.us.Set([]byte("1"), []byte("2"))
+	s.us.Set([]byte("2"), []byte("2"))
+	c.Assert(s.us.UndoKey([]byte("1")), IsNil)
+	v, err := s.us.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(v, BytesEquals, []byte("1"))
+	c.Assert(s.us.Len(), Equals, 1)
+	c.Assert(s.us.Size(), Equals, 2)
+
+	// Undo a delete.
+	s.us.Delete([]byte("1"))
+	_, err = s.us.Get([]byte("1"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+	c.Assert(s.us.UndoKey([]byte("1")), IsNil)
+	v, err = s.us.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(v, BytesEquals, []byte("1"))
+
+	// Undo a key which is not buffered.
+	c.Assert(s.us.UndoKey([]byte("3")), IsNil)
+	c.Assert(s.us.Len(), Equals, 1)
+	c.Assert(NewUnionStore(&mockSnapshot{s.store}).UndoKey([]byte("3")), IsNil)
+
+	// The condition pair of the undone key is dropped.
+	s.us.SetOption(PresumeKeyNotExists, nil)
+	_, err = s.us.Get([]byte("1"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+	s.us.DelOption(PresumeKeyNotExists)
+	c.Assert(s.us.CheckLazyConditionPairs(), NotNil)
+	c.Assert(s.us.UndoKey([]byte("1")), IsNil)
+	c.Assert(s.us.CheckLazyConditionPairs(), IsNil)
+}
+
+// recordSnapshot is a Snapshot which records the keys passed to BatchGet and BatchExist.
+type recordSnapshot struct {
+	Snapshot
+	batchGetKeys   [][]Key
+	batchExistKeys [][]Key
+}
+
+func (s *recordSnapshot) BatchGet(keys []Key) (map[string][]byte, error) {
+	s.batchGetKeys = append(s.batchGetKeys, append([]Key(nil), keys...))
+	return s.Snapshot.BatchGet(keys)
+}
+
+func (s *recordSnapshot) BatchExist(keys []Key) (map[string]bool, error) {
+	s.batchExistKeys = append(s.batchExistKeys, append([]Key(nil), keys...))
+	return s.Snapshot.BatchExist(keys)
+}
+
+func (s *testUnionStoreSuite) TestPrefetchConditions(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	snap := &recordSnapshot{Snapshot: &mockSnapshot{s.store}}
+	us := NewUnionStore(snap)
+	us.SetOption(PrefetchConditions, true)
+	var stats []ConditionCheckStats
+	us.SetOption(ConditionCheckMetrics, func(st ConditionCheckStats) {
+		stats = append(stats, st)
+	})
+
+	c.Assert(us.BatchAssertNotExists([]Key{Key("3"), Key("4")}), IsNil)
+	c.Assert(us.BatchAssertEquals([]KeyValue{{Key: Key("1"), Value: []byte("1")}}), IsNil)
+	c.Assert(us.CheckLazyConditionPairs(), IsNil)
+	// All the keys are prefetched, the check doesn't read the snapshot.
+	c.Assert(stats, HasLen, 1)
+	c.Assert(stats[0].FetchedKeys, Equals, 0)
+	c.Assert(snap.batchExistKeys, HasLen, 0)
+	var fetched []string
+	for _, keys := range snap.batchGetKeys {
+		for _, k := range keys {
+			fetched = append(fetched, string(k))
+		}
+	}
+	sort.Strings(fetched)
+	c.Assert(fetched, DeepEquals, []string{"1", "3", "4"})
+
+	// A mismatch is still found with the prefetched values.
+	c.Assert(us.BatchAssertNotExists([]Key{Key("2")}), IsNil)
+	c.Assert(ErrKeyExists.Equal(us.CheckLazyConditionPairs()), IsTrue)
+	c.Assert(stats[1].FetchedKeys, Equals, 0)
+}
+
+func (s *testUnionStoreSuite) TestConditionHint(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	for _, hint := range []int{0, 2, 100, -1} {
+		us := NewUnionStore(&mockSnapshot{s.store})
+		us.SetOption(ConditionHint, hint)
+		c.Assert(us.BatchAssertNotExists([]Key{Key("2"), Key("3")}), IsNil)
+		c.Assert(us.CheckLazyConditionPairs(), IsNil)
+		c.Assert(us.BatchAssertNotExists([]Key{Key("1")}), IsNil)
+		c.Assert(ErrKeyExists.Equal(us.CheckLazyConditionPairs()), IsTrue)
+		// The hint doesn't drop the recorded pairs.
+		us.SetOption(ConditionHint, 10)
+		c.Assert(ErrKeyExists.Equal(us.CheckLazyConditionPairs()), IsTrue)
+	}
+}
+
+func (s *testUnionStoreSuite) TestBatchAssert(c *C) {
+	defer testleak.AfterTest(c)()
+	record := func(us UnionStore) {
+		err := us.BatchAssertNotExists([]Key{Key("3"), Key("4"), Key("3")})
+		c.Assert(err, IsNil)
+		err = us.BatchAssertEquals([]KeyValue{
+			{Key: Key("1"), Value: []byte("1")},
+			{Key: Key("2"), Value: []byte("2")},
+			{Key: Key("1"), Value: []byte("1")},
+			{Key: Key("5"), Value: nil},
+		})
+		c.Assert(err, IsNil)
+		// Already recorded conditions are skipped.
+		err = us.BatchAssertNotExists([]Key{Key("4"), Key("5")})
+		c.Assert(err, IsNil)
+	}
+
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	snap := &recordSnapshot{Snapshot: &mockSnapshot{s.store}}
+	us := NewUnionStore(snap)
+	record(us)
+	c.Assert(us.CheckLazyConditionPairs(), IsNil)
+	c.Assert(snap.batchGetKeys, HasLen, 1)
+	c.Assert(snap.batchGetKeys[0], HasLen, 2)
+	c.Assert(snap.batchExistKeys, HasLen, 1)
+	c.Assert(snap.batchExistKeys[0], HasLen, 3)
+
+	// All conditions are checked.
+	cases := []struct {
+		key   string
+		value string
+		err   *terror.Error
+	}{
+		{"4", "4", ErrKeyExists},
+		{"5", "5", ErrKeyExists},
+		{"2", "x", ErrLazyConditionPairsNotMatch},
+	}
+	for _, ca := range cases {
+		store := NewMemDbBuffer()
+		store.Set([]byte("1"), []byte("1"))
+		store.Set([]byte("2"), []byte("2"))
+		store.Set([]byte(ca.key), []byte(ca.value))
+		us = NewUnionStore(&mockSnapshot{store})
+		record(us)
+		c.Assert(ca.err.Equal(us.CheckLazyConditionPairs()), IsTrue)
+	}
+}
+
+// slowSnapshot is a Snapshot whose BatchGet takes at least delay.
+type slowSnapshot struct {
+	Snapshot
+	delay time.Duration
+}
+
+func (s *slowSnapshot) BatchGet(keys []Key) (map[string][]byte, error) {
+	time.Sleep(s.delay)
+	return s.Snapshot.BatchGet(keys)
+}
+
+func (s *testUnionStoreSuite) TestConditionCheckMetrics(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	us := NewUnionStore(&slowSnapshot{Snapshot: &mockSnapshot{s.store}, delay: 10 * time.Millisecond})
+	var stats []ConditionCheckStats
+	us.SetOption(ConditionCheckMetrics, func(s ConditionCheckStats) {
+		stats = append(stats, s)
+	})
+
+	// No pairs, nothing to report.
+	c.Assert(us.CheckLazyConditionPairs(), IsNil)
+	c.Assert(stats, HasLen, 0)
+
+	c.Assert(us.BatchAssertNotExists([]Key{Key("2"), Key("3")}), IsNil)
+	c.Assert(us.BatchAssertEquals([]KeyValue{{Key: Key("1"), Value: []byte("1")}}), IsNil)
+	c.Assert(us.CheckLazyConditionPairs(), IsNil)
+	c.Assert(stats, HasLen, 1)
+	c.Assert(stats[0].Pairs, Equals, 3)
+	c.Assert(stats[0].FetchedKeys, Equals, 3)
+	c.Assert(stats[0].FetchDuration >= 10*time.Millisecond, IsTrue)
+	c.Assert(stats[0].CompareDuration > 0, IsTrue)
+	c.Assert(stats[0].CompareDuration < stats[0].FetchDuration, IsTrue)
+
+	// Failed checks are reported too, and a nil callback is ignored.
+	s.store.Set([]byte("2"), []byte("2"))
+	c.Assert(us.CheckLazyConditionPairs(), NotNil)
+	c.Assert(stats, HasLen, 2)
+	us.SetOption(ConditionCheckMetrics, (func(ConditionCheckStats))(nil))
+	c.Assert(us.CheckLazyConditionPairs(), NotNil)
+	c.Assert(stats, HasLen, 2)
+}
+
+func (s *testUnionStoreSuite) TestSortBatchKeys(c *C) {
+	defer testleak.AfterTest(c)()
+	snap := &recordSnapshot{Snapshot: &mockSnapshot{s.store}}
+	us := NewUnionStore(snap)
+	var keys []Key
+	for i := 0; i < 50; i++ {
+		keys = append(keys, encodeInt(50-i))
+	}
+	c.Assert(us.BatchAssertNotExists(keys), IsNil)
+
+	c.Assert(us.CheckLazyConditionPairs(), IsNil)
+	c.Assert(snap.batchGetKeys, HasLen, 0)
+	c.Assert(snap.batchExistKeys, HasLen, 1)
+	fetched := snap.batchExistKeys[0]
+	c.Assert(fetched, HasLen, len(keys))
+	sort.Sort(keySlice(fetched))
+	sort.Sort(keySlice(keys))
+	c.Assert(fetched, DeepEquals, keys)
+
+	us.SetOption(SortBatchKeys, true)
+	c.Assert(us.CheckLazyConditionPairs(), IsNil)
+	c.Assert(snap.batchExistKeys, HasLen, 2)
+	c.Assert(sort.IsSorted(keySlice(snap.batchExistKeys[1])), IsTrue)
+	c.Assert(snap.batchExistKeys[1], DeepEquals, keys)
+}
+
+func (s *testUnionStoreSuite) TestBatchExist(c *C) {
+	defer testleak.AfterTest(c)()
+	var keys []Key
+	for i := 0; i < 20; i++ {
+		keys = append(keys, encodeInt(i))
+		if i%3 == 0 {
+			s.store.Set(encodeInt(i), encodeInt(i))
+		}
+	}
+	snap := &mockSnapshot{s.store}
+	values, err := snap.BatchGet(keys)
+	c.Assert(err, IsNil)
+	exists, err := snap.BatchExist(keys)
+	c.Assert(err, IsNil)
+	c.Assert(exists, HasLen, len(values))
+	for k := range values {
+		c.Assert(exists[k], IsTrue)
+	}
+}
+
+func (s *testUnionStoreSuite) TestGetWithOld(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	s.store.Set([]byte("3"), []byte("3"))
+	s.us.Set([]byte("1"), []byte("a"))
+	s.us.Set([]byte("4"), []byte("d"))
+	s.us.Delete([]byte("2"))
+
+	cases := []struct {
+		key    string
+		newVal []byte
+		oldVal []byte
+	}{
+		{"1", []byte("a"), []byte("1")}, // set over existing
+		{"2", nil, []byte("2")},         // delete existing
+		{"3", []byte("3"), []byte("3")}, // not buffered
+		{"4", []byte("d"), nil},         // set new
+		{"5", nil, nil},                 // absent
+	}
+	for _, ca := range cases {
+		newVal, oldVal, err := s.us.GetWithOld([]byte(ca.key))
+		c.Assert(err, IsNil)
+		c.Assert(newVal, DeepEquals, ca.newVal, Commentf("key %s", ca.key))
+		c.Assert(oldVal, DeepEquals, ca.oldVal, Commentf("key %s", ca.key))
+	}
+}
+
+func (s *testUnionStoreSuite) TestMaxValueBytes(c *C) {
+	defer testleak.AfterTest(c)()
+	c.Assert(s.us.Set([]byte("1"), make([]byte, 1024*1024)), IsNil)
+
+	s.us.SetOption(MaxValueBytes, 10)
+	c.Assert(s.us.Set([]byte("1"), make([]byte, 10)), IsNil)
+	err := s.us.Set([]byte("big"), make([]byte, 11))
+	c.Assert(ErrValueTooLarge.Equal(err), IsTrue)
+	c.Assert(err, ErrorMatches, `.*"big".*`)
+	_, err = s.us.Get([]byte("big"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+
+	s.us.DelOption(MaxValueBytes)
+	c.Assert(s.us.Set([]byte("big"), make([]byte, 11)), IsNil)
+}
+
+func (s *testUnionStoreSuite) TestDeleteWithCondition(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+
+	// Matching expected value.
+	c.Assert(s.us.DeleteWithCondition([]byte("1"), []byte("1")), IsNil)
+	_, err := s.us.Get([]byte("1"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+	c.Assert(s.us.CheckLazyConditionPairs(), IsNil)
+
+	// Mismatching expected value.
+	us := NewUnionStore(&mockSnapshot{s.store})
+	c.Assert(us.DeleteWithCondition([]byte("1"), []byte("2")), IsNil)
+	err = us.CheckLazyConditionPairs()
+	c.Assert(ErrLazyConditionPairsNotMatch.Equal(err), IsTrue)
+
+	// Empty expected value asserts the key doesn't exist.
+	us = NewUnionStore(&mockSnapshot{s.store})
+	c.Assert(us.DeleteWithCondition([]byte("2"), nil), IsNil)
+	c.Assert(us.CheckLazyConditionPairs(), IsNil)
+	c.Assert(us.DeleteWithCondition([]byte("1"), nil), IsNil)
+	err = us.CheckLazyConditionPairs()
+	c.Assert(ErrLazyConditionPairsNotMatch.Equal(err), IsTrue)
+}
+
+func (s *testUnionStoreSuite) TestPrepareRetry(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.us.Set([]byte("1"), []byte("a"))
+	s.us.Set([]byte("2"), []byte("b"))
+	c.Assert(s.us.BatchAssertNotExists([]Key{Key("1"), Key("3")}), IsNil)
+	err := s.us.CheckLazyConditionPairs()
+	c.Assert(terror.ErrorEqual(err, ErrKeyExists), IsTrue)
+
+	c.Assert(s.us.PrepareRetry([]Key{Key("1")}), IsNil)
+	c.Assert(s.us.CheckLazyConditionPairs(), IsNil)
+	// Buffered writes survive, including the one of the conflict key.
+	val, err := s.us.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("a"))
+	val, err = s.us.Get([]byte("2"))
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("b"))
+
+	// The conflict key is resolved again on retry.
+	c.Assert(s.us.BatchAssertNotExists([]Key{Key("1")}), IsNil)
+	err = s.us.CheckLazyConditionPairs()
+	c.Assert(terror.ErrorEqual(err, ErrKeyExists), IsTrue)
+	c.Assert(s.us.PrepareRetry([]Key{Key("1")}), IsNil)
+	c.Assert(s.us.BatchAssertEquals([]KeyValue{{Key: Key("1"), Value: []byte("1")}}), IsNil)
+	c.Assert(s.us.CheckLazyConditionPairs(), IsNil)
+}
+
+func (s *testUnionStoreSuite) TestLockKeys(c *C) {
+	defer testleak.AfterTest(c)()
+	c.Assert(s.us.LockKeys(), HasLen, 0)
+
+	s.store.Set([]byte("2"), []byte("2"))
+	s.us.Set([]byte("3"), []byte("3"))
+	s.us.Set([]byte("1"), []byte("1"))
+	s.us.Delete([]byte("2"))
+	c.Assert(s.us.BatchAssertNotExists([]Key{Key("4"), Key("1"), Key("0")}), IsNil)
+	c.Assert(s.us.BatchAssertEquals([]KeyValue{{Key: Key("5"), Value: []byte("5")}}), IsNil)
+	keys := s.us.LockKeys()
+	c.Assert(keys, DeepEquals, []Key{Key("0"), Key("1"), Key("2"), Key("3"), Key("4"), Key("5")})
+}
+
+func (s *testUnionStoreSuite) TestCheckLazyConditionPairsAll(c *C) {
+	defer testleak.AfterTest(c)()
+	violations, err := s.us.CheckLazyConditionPairsAll()
+	c.Assert(err, IsNil)
+	c.Assert(violations, HasLen, 0)
+
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	s.store.Set([]byte("3"), []byte("3"))
+	c.Assert(s.us.BatchAssertNotExists([]Key{Key("1"), Key("4")}), IsNil)
+	c.Assert(s.us.BatchAssertEquals([]KeyValue{
+		{Key: Key("2"), Value: []byte("2")},
+		{Key: Key("3"), Value: []byte("x")},
+		{Key: Key("5"), Value: []byte("5")},
+	}), IsNil)
+
+	violations, err = s.us.CheckLazyConditionPairsAll()
+	c.Assert(err, IsNil)
+	c.Assert(violations, HasLen, 3)
+	c.Assert(violations[0].Key, DeepEquals, Key("1"))
+	c.Assert(violations[0].Expected, IsNil)
+	c.Assert(violations[0].Actual, BytesEquals, []byte("1"))
+	c.Assert(terror.ErrorEqual(violations[0].Err, ErrKeyExists), IsTrue)
+	c.Assert(violations[1].Key, DeepEquals, Key("3"))
+	c.Assert(violations[1].Expected, BytesEquals, []byte("x"))
+	c.Assert(violations[1].Actual, BytesEquals, []byte("3"))
+	c.Assert(terror.ErrorEqual(violations[1].Err, ErrLazyConditionPairsNotMatch), IsTrue)
+	c.Assert(violations[2].Key, DeepEquals, Key("5"))
+	c.Assert(violations[2].Expected, BytesEquals, []byte("5"))
+	c.Assert(violations[2].Actual, IsNil)
+
+	// The fail-fast check reports a violation too.
+	c.Assert(s.us.CheckLazyConditionPairs(), NotNil)
+}
+
+// xorTransformer xors the values with a mask and prepends a version byte.
+type xorTransformer byte
+
+func (t xorTransformer) Encode(v []byte) []byte {
+	res := make([]byte, 0, len(v)+1)
+	res = append(res, 1)
+	for _, b := range v {
+		res = append(res, b^byte(t))
+	}
+	return res
+}
+
+func (t xorTransformer) Decode(v []byte) ([]byte, error) {
+	if len(v) == 0 || v[0] != 1 {
+		return nil, errors.Errorf("invalid encoded value %q", v)
+	}
+	res := make([]byte, 0, len(v)-1)
+	for _, b := range v[1:] {
+		res = append(res, b^byte(t))
+	}
+	return res, nil
+}
+
+func (s *testUnionStoreSuite) TestBufferValueTransformer(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("0"), []byte("0"))
+	s.us.SetOption(BufferValueTransformer, xorTransformer(0x5a))
+	s.us.Set([]byte("1"), []byte("11"))
+	s.us.Set([]byte("2"), []byte("22"))
+	s.us.Delete([]byte("3"))
+
+	val, err := s.us.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("11"))
+	_, err = s.us.Get([]byte("3"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+	iter, err := s.us.Seek(nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("0"), []byte("1"), []byte("2")}, [][]byte{[]byte("0"), []byte("11"), []byte("22")})
+	iter, err = s.us.SeekReverse(nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("2"), []byte("1"), []byte("0")}, [][]byte{[]byte("22"), []byte("11"), []byte("0")})
+
+	// The commit path sees the decoded values.
+	m := NewMemDbBuffer()
+	c.Assert(s.us.WalkBuffer(func(k Key, v []byte) error {
+		if len(v) == 0 {
+			return nil
+		}
+		return m.Set(k, v)
+	}), IsNil)
+	val, err = m.Get([]byte("2"))
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("22"))
+
+	// The buffer keeps and counts the encoded values.
+	raw, err := s.us.(*unionStore).BufferStore.MemBuffer.(*lazyMemBuffer).mb.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(raw, BytesEquals, xorTransformer(0x5a).Encode([]byte("11")))
+	// 3 keys, 2 encoded values of 3 bytes and a tombstone.
+	c.Assert(s.us.Size(), Equals, 3+2*3)
+}
+
+func (s *testUnionStoreSuite) TestWriteSetChecksum(c *C) {
+	defer testleak.AfterTest(c)()
+	checksum := func(us UnionStore) uint64 {
+		sum, err := us.WriteSetChecksum()
+		c.Assert(err, IsNil)
+		return sum
+	}
+	empty := checksum(s.us)
+
+	us1 := NewUnionStore(&mockSnapshot{s.store})
+	us1.Set([]byte("1"), []byte("1"))
+	us1.Set([]byte("2"), []byte("x"))
+	us1.Set([]byte("2"), []byte("2"))
+	us1.Delete([]byte("3"))
+	us2 := NewUnionStore(&mockSnapshot{s.store})
+	us2.Delete([]byte("3"))
+	us2.Set([]byte("2"), []byte("2"))
+	us2.Set([]byte("1"), []byte("1"))
+	c.Assert(checksum(us1), Equals, checksum(us2))
+	c.Assert(checksum(us1), Not(Equals), empty)
+
+	// A single different byte changes the checksum.
+	us2.Set([]byte("1"), []byte("0"))
+	c.Assert(checksum(us1), Not(Equals), checksum(us2))
+	// So does a tombstone.
+	us2.Set([]byte("1"), []byte("1"))
+	c.Assert(checksum(us1), Equals, checksum(us2))
+	us2.Delete([]byte("4"))
+	c.Assert(checksum(us1), Not(Equals), checksum(us2))
+	// Moving the boundary between the key and the value changes it too.
+	us3 := NewUnionStore(&mockSnapshot{s.store})
+	us3.Set([]byte("ab"), []byte("c"))
+	us4 := NewUnionStore(&mockSnapshot{s.store})
+	us4.Set([]byte("a"), []byte("bc"))
+	c.Assert(checksum(us3), Not(Equals), checksum(us4))
+}
+
+func (s *testUnionStoreSuite) TestBatchDelete(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	s.us.Set([]byte("2"), []byte("b"))
+	s.us.Set([]byte("3"), []byte("c"))
+	s.us.Set([]byte("4"), []byte("d"))
+
+	// Keys set in the buffer, in the snapshot only and in neither.
+	c.Assert(s.us.BatchDelete([]Key{Key("1"), Key("2"), Key("3"), Key("5")}), IsNil)
+	for _, k := range []string{"1", "2", "3", "5"} {
+		_, err := s.us.Get([]byte(k))
+		c.Assert(IsErrNotFound(err), IsTrue, Commentf("key %s", k))
+	}
+	val, err := s.us.Get([]byte("4"))
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("d"))
+	// Each deleted key is kept as a tombstone.
+	c.Assert(s.us.Len(), Equals, 5)
+	c.Assert(s.us.Size(), Equals, 5+1)
+	iter, err := s.us.Seek(nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("4")}, [][]byte{[]byte("d")})
+}
+
+func (s *testUnionStoreSuite) TestDirty(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	_, err := s.us.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	_, err = s.us.Get([]byte("2"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+	c.Assert(s.us.BatchAssertNotExists([]Key{Key("3")}), IsNil)
+	c.Assert(s.us.Dirty(), IsFalse)
+
+	s.us.Set([]byte("2"), []byte("2"))
+	c.Assert(s.us.Dirty(), IsTrue)
+	c.Assert(s.us.UndoKey([]byte("2")), IsNil)
+	c.Assert(s.us.Dirty(), IsFalse)
+	s.us.Delete([]byte("1"))
+	c.Assert(s.us.Dirty(), IsTrue)
+
+	// The writes while the size tracking is suspended count.
+	us := NewUnionStore(&mockSnapshot{s.store})
+	us.(*unionStore).SuspendSizeTracking()
+	c.Assert(us.Set([]byte("2"), []byte("2")), IsNil)
+	c.Assert(us.Len(), Equals, 0)
+	c.Assert(us.Dirty(), IsTrue)
+}
+
+func (s *testUnionStoreSuite) TestFlushConditionChecks(c *C) {
+	defer testleak.AfterTest(c)()
+	snap := &recordSnapshot{Snapshot: &mockSnapshot{s.store}}
+	us := NewUnionStore(snap)
+	c.Assert(us.FlushConditionChecks(), IsNil)
+	c.Assert(snap.batchExistKeys, HasLen, 0)
+
+	c.Assert(us.BatchAssertNotExists([]Key{Key("1"), Key("2")}), IsNil)
+	c.Assert(us.FlushConditionChecks(), IsNil)
+	c.Assert(us.FlushConditionChecks(), IsNil)
+	c.Assert(snap.batchExistKeys, HasLen, 1)
+
+	// Only the pairs recorded after the flush are checked at commit.
+	s.store.Set([]byte("1"), []byte("1"))
+	c.Assert(us.BatchAssertNotExists([]Key{Key("3")}), IsNil)
+	c.Assert(us.CheckLazyConditionPairs(), IsNil)
+	c.Assert(snap.batchExistKeys, HasLen, 2)
+	c.Assert(snap.batchExistKeys[1], DeepEquals, []Key{Key("3")})
+
+	// Mismatched pairs are kept.
+	c.Assert(us.BatchAssertNotExists([]Key{Key("1")}), IsNil)
+	c.Assert(us.FlushConditionChecks(), NotNil)
+	c.Assert(us.CheckLazyConditionPairs(), NotNil)
+}
+
+type delaySnapshot struct {
+	Snapshot
+	getDelay   time.Duration
+	existDelay time.Duration
+}
+
+func (s *delaySnapshot) BatchGet(keys []Key) (map[string][]byte, error) {
+	time.Sleep(s.getDelay)
+	return s.Snapshot.BatchGet(keys)
+}
+
+func (s *delaySnapshot) BatchExist(keys []Key) (map[string]bool, error) {
+	time.Sleep(s.existDelay)
+	return s.Snapshot.BatchExist(keys)
+}
+
+func (s *testUnionStoreSuite) TestSlowReadObserver(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	snap := &delaySnapshot{Snapshot: &mockSnapshot{s.store}, getDelay: 20 * time.Millisecond}
+	us := NewUnionStore(snap)
+	type slowRead struct {
+		keys int
+		dur  time.Duration
+	}
+	var reads []slowRead
+	check := func() {
+		c.Assert(us.BatchAssertNotExists([]Key{Key("2"), Key("3"), Key("4")}), IsNil)
+		c.Assert(us.BatchAssertEquals([]KeyValue{{Key: Key("1"), Value: []byte("1")}}), IsNil)
+		c.Assert(us.FlushConditionChecks(), IsNil)
+	}
+
+	// No threshold or no observer.
+	check()
+	us.SetOption(SlowReadThreshold, 10*time.Millisecond)
+	check()
+
+	// Only the slow BatchGet is reported.
+	us.SetSlowReadObserver(func(keys int, dur time.Duration) {
+		reads = append(reads, slowRead{keys, dur})
+	})
+	check()
+	c.Assert(reads, HasLen, 1)
+	c.Assert(reads[0].keys, Equals, 1)
+	c.Assert(reads[0].dur >= 20*time.Millisecond, IsTrue)
+
+	snap.existDelay = 20 * time.Millisecond
+	check()
+	c.Assert(reads, HasLen, 3)
+	c.Assert(reads[1].keys, Equals, 3)
+
+	us.SetOption(SlowReadThreshold, time.Second)
+	check()
+	us.SetSlowReadObserver(nil)
+	us.DelOption(SlowReadThreshold)
+	check()
+	c.Assert(reads, HasLen, 3)
+}
+
+func (s *testUnionStoreSuite) TestSlowPrefetchRead(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	snap := &delaySnapshot{Snapshot: &mockSnapshot{s.store}, getDelay: 20 * time.Millisecond}
+	us := NewUnionStore(snap)
+	defer us.Release()
+	var mu sync.Mutex
+	var keys []int
+	us.SetOption(SlowReadThreshold, 10*time.Millisecond)
+	us.SetOption(PrefetchConditions, true)
+	us.SetSlowReadObserver(func(n int, dur time.Duration) {
+		mu.Lock()
+		keys = append(keys, n)
+		mu.Unlock()
+	})
+
+	// The prefetched key is not read again by the check. The options can be
+	// changed while the prefetch is running.
+	c.Assert(us.BatchAssertEquals([]KeyValue{{Key: Key("1"), Value: []byte("1")}}), IsNil)
+	for i := 0; i < 100; i++ {
+		us.SetOption(PresumeKeyNotExists, nil)
+		us.DelOption(PresumeKeyNotExists)
+	}
+	c.Assert(us.FlushConditionChecks(), IsNil)
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(keys, DeepEquals, []int{1})
+}
+
+func (s *testUnionStoreSuite) TestSetWithMeta(c *C) {
+	defer testleak.AfterTest(c)()
+	c.Assert(s.us.SetWithMeta([]byte("1"), []byte("1"), []byte("idx1")), IsNil)
+	c.Assert(s.us.SetWithMeta([]byte("2"), []byte("2"), []byte("idx2")), IsNil)
+	c.Assert(s.us.SetWithMeta([]byte("3"), []byte("3"), nil), IsNil)
+	c.Assert(s.us.Set([]byte("4"), []byte("4")), IsNil)
+
+	val, err := s.us.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("1"))
+	c.Assert(s.us.GetMeta([]byte("1")), BytesEquals, []byte("idx1"))
+	c.Assert(s.us.GetMeta([]byte("3")), IsNil)
+	c.Assert(s.us.GetMeta([]byte("5")), IsNil)
+
+	// The next write of a key drops its meta.
+	c.Assert(s.us.Set([]byte("2"), []byte("b")), IsNil)
+	c.Assert(s.us.GetMeta([]byte("2")), IsNil)
+
+	metas := make(map[string]string)
+	c.Assert(s.us.WalkBufferWithMeta(func(k Key, v []byte, meta []byte) error {
+		metas[string(k)] = string(meta)
+		return nil
+	}), IsNil)
+	c.Assert(metas, DeepEquals, map[string]string{"1": "idx1", "2": "", "3": "", "4": ""})
+
+	// The meta is not part of the committed mutations.
+	m := NewMemDbBuffer()
+	c.Assert(s.us.(*unionStore).SaveTo(m), IsNil)
+	val, err = m.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("1"))
+
+	s.us.SetOption(MaxValueBytes, 1)
+	err = s.us.SetWithMeta([]byte("1"), []byte("11"), []byte("idx1"))
+	c.Assert(ErrValueTooLarge.Equal(err), IsTrue)
+}
+
+func (s *testUnionStoreSuite) TestSetWithTTL(c *C) {
+	defer testleak.AfterTest(c)()
+	c.Assert(s.us.SetWithTTL([]byte("1"), []byte("1"), time.Minute), IsNil)
+	c.Assert(s.us.Set([]byte("2"), []byte("2")), IsNil)
+	c.Assert(s.us.SetWithTTL([]byte("3"), []byte("3"), time.Hour), IsNil)
+	c.Assert(s.us.SetWithTTL([]byte("4"), []byte("4"), 0), IsNil)
+	// The next write drops the TTL.
+	c.Assert(s.us.Set([]byte("3"), []byte("33")), IsNil)
+
+	// The TTL doesn't affect reads.
+	val, err := s.us.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("1"))
+
+	// The commit layer builds the mutations with their TTLs.
+	ttls := make(map[string]time.Duration)
+	err = s.us.WalkBuffer(func(k Key, v []byte) error {
+		ttls[string(k)] = s.us.GetTTL(k)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(ttls, DeepEquals, map[string]time.Duration{"1": time.Minute, "2": 0, "3": 0, "4": 0})
+
+	c.Assert(s.us.UndoKey([]byte("1")), IsNil)
+	c.Assert(s.us.GetTTL([]byte("1")), Equals, time.Duration(0))
+}
+
+func (s *testUnionStoreSuite) TestSizeHistogram(c *C) {
+	defer testleak.AfterTest(c)()
+	keyHist, valHist := s.us.SizeHistogram()
+	c.Assert(keyHist, HasLen, 0)
+	c.Assert(valHist, HasLen, 0)
+
+	s.us.Set([]byte("a"), make([]byte, 1))
+	s.us.Set([]byte("bb"), make([]byte, 3))
+	s.us.Set([]byte("ccc"), make([]byte, 4))
+	s.us.Set([]byte("dddd"), make([]byte, 7))
+	s.us.Set([]byte("eeeee"), make([]byte, 100))
+	s.us.Delete([]byte("ffffffff"))
+	keyHist, valHist = s.us.SizeHistogram()
+	// Key sizes 1, 2, 3, 4, 5, 8.
+	c.Assert(keyHist, DeepEquals, []int{0, 1, 2, 2, 1})
+	// Value sizes 1, 3, 4, 7, 100 and a tombstone.
+	c.Assert(valHist, DeepEquals, []int{1, 1, 1, 2, 0, 0, 0, 1})
+}
+
+func (s *testUnionStoreSuite) TestSizeByPrefix(c *C) {
+	defer testleak.AfterTest(c)()
+	c.Assert(s.us.SizeByPrefix(2), HasLen, 0)
+	s.store.Set([]byte("t1_0"), []byte("snapshot"))
+	s.us.Set([]byte("t1_1"), []byte("1"))
+	s.us.Set([]byte("t1_2"), []byte("22"))
+	s.us.Set([]byte("t2_1"), []byte("333"))
+	s.us.Delete([]byte("i1_1"))
+	s.us.Set([]byte("t"), []byte("4444"))
+
+	c.Assert(s.us.SizeByPrefix(2), DeepEquals, map[string]int{
+		"t1": 4 + 1 + 4 + 2,
+		"t2": 4 + 3,
+		"i1": 4,
+		"t":  1 + 4,
+	})
+	c.Assert(s.us.SizeByPrefix(0), DeepEquals, map[string]int{"": s.us.Size()})
+
+	// A prefixed store only counts its keys, without the prefix.
+	ps := NewPrefixedUnionStore(s.us, Key("t1_"))
+	c.Assert(ps.SizeByPrefix(0), DeepEquals, map[string]int{"": 1 + 1 + 1 + 2})
+	c.Assert(ps.SizeByPrefix(1), DeepEquals, map[string]int{"1": 1 + 1, "2": 1 + 2})
+}
+
+func (s *testUnionStoreSuite) TestSeekLast(c *C) {
+	defer testleak.AfterTest(c)()
+	iter, err := s.us.SeekLast()
+	c.Assert(err, IsNil)
+	c.Assert(iter.Valid(), IsFalse)
+
+	// Keys only in the buffer.
+	us := NewUnionStore(&mockSnapshot{NewMemDbBuffer()})
+	us.Set([]byte("1"), []byte("1"))
+	us.Set([]byte("3"), []byte("3"))
+	us.Delete([]byte("4"))
+	iter, err = us.SeekLast()
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("3"), []byte("1")}, [][]byte{[]byte("3"), []byte("1")})
+
+	// Keys only in the snapshot.
+	s.store.Set([]byte("2"), []byte("2"))
+	s.store.Set([]byte("5"), []byte("5"))
+	iter, err = s.us.SeekLast()
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("5"), []byte("2")}, [][]byte{[]byte("5"), []byte("2")})
+
+	// Mixed, the greatest key is deleted in the buffer.
+	s.us.Set([]byte("3"), []byte("3"))
+	s.us.Delete([]byte("5"))
+	iter, err = s.us.SeekLast()
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("3"), []byte("2")}, [][]byte{[]byte("3"), []byte("2")})
+}
+
+func (s *testUnionStoreSuite) TestStrictDelete(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	s.us.Set([]byte("3"), []byte("3"))
+	s.us.Set([]byte("4"), []byte("4"))
+
+	// Deleting an absent key is allowed by default.
+	c.Assert(s.us.Delete([]byte("9")), IsNil)
+
+	s.us.SetOption(StrictDelete, true)
+	c.Assert(s.us.Delete([]byte("1")), IsNil)
+	c.Assert(s.us.Delete([]byte("3")), IsNil)
+	// Double deletes.
+	err := s.us.Delete([]byte("1"))
+	c.Assert(ErrDeleteNotExist.Equal(err), IsTrue)
+	err = s.us.Delete([]byte("3"))
+	c.Assert(ErrDeleteNotExist.Equal(err), IsTrue)
+	err = s.us.Delete([]byte("5"))
+	c.Assert(ErrDeleteNotExist.Equal(err), IsTrue)
+
+	err = s.us.BatchDelete([]Key{Key("2"), Key("5")})
+	c.Assert(ErrDeleteNotExist.Equal(err), IsTrue)
+	_, err = s.us.Get([]byte("2"))
+	c.Assert(err, IsNil)
+	c.Assert(s.us.BatchDelete([]Key{Key("2"), Key("4")}), IsNil)
+
+	err = s.us.DeleteWithCondition([]byte("6"), []byte("6"))
+	c.Assert(ErrDeleteNotExist.Equal(err), IsTrue)
+	c.Assert(s.us.CheckLazyConditionPairs(), IsNil)
+}
+
+func (s *testUnionStoreSuite) TestConditionConflict(c *C) {
+	defer testleak.AfterTest(c)()
+	// Duplicate must-not-exist conditions are recorded once.
+	s.us.SetOption(PresumeKeyNotExists, nil)
+	_, err := s.us.Get([]byte("1"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+	_, err = s.us.Get([]byte("1"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+	s.us.DelOption(PresumeKeyNotExists)
+	c.Assert(s.us.BatchAssertNotExists([]Key{Key("1"), Key("1")}), IsNil)
+	c.Assert(s.us.BatchAssertEquals([]KeyValue{{Key: Key("1")}}), IsNil)
+	c.Assert(s.us.BatchAssertEquals([]KeyValue{{Key: Key("2"), Value: []byte("2")}}), IsNil)
+	c.Assert(s.us.BatchAssertEquals([]KeyValue{{Key: Key("2"), Value: []byte("2")}}), IsNil)
+	c.Assert(s.us.(*unionStore).lazyConditionPairs, HasLen, 2)
+
+	// Conflicting conditions fail and the first one wins.
+	err = s.us.BatchAssertEquals([]KeyValue{{Key: Key("1"), Value: []byte("1")}})
+	c.Assert(ErrConditionConflict.Equal(err), IsTrue)
+	err = s.us.BatchAssertNotExists([]Key{Key("3"), Key("2")})
+	c.Assert(ErrConditionConflict.Equal(err), IsTrue)
+	err = s.us.BatchAssertEquals([]KeyValue{{Key: Key("2"), Value: []byte("x")}})
+	c.Assert(ErrConditionConflict.Equal(err), IsTrue)
+	err = s.us.DeleteWithCondition([]byte("2"), []byte("x"))
+	c.Assert(ErrConditionConflict.Equal(err), IsTrue)
+	_, err = s.us.(*unionStore).MemBuffer.Get([]byte("2"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+	s.us.SetOption(PresumeKeyNotExists, nil)
+	_, err = s.us.Get([]byte("2"))
+	c.Assert(ErrConditionConflict.Equal(err), IsTrue)
+	s.us.DelOption(PresumeKeyNotExists)
+
+	// The pair of 3 is recorded before the conflict.
+	c.Assert(s.us.(*unionStore).lazyConditionPairs, HasLen, 3)
+	s.store.Set([]byte("2"), []byte("2"))
+	c.Assert(s.us.CheckLazyConditionPairs(), IsNil)
+}
+
+func (s *testUnionStoreSuite) TestKeepHistory(c *C) {
+	defer testleak.AfterTest(c)()
+	s.us.Set([]byte("1"), []byte("0"))
+	s.us.SetOption(KeepHistory, true)
+	s.us.Set([]byte("1"), []byte("a"))
+	s.us.Set([]byte("1"), []byte("b"))
+	s.us.Delete([]byte("1"))
+	s.us.Set([]byte("1"), []byte("c"))
+	c.Assert(s.us.BatchDelete([]Key{Key("2")}), IsNil)
+
+	history, err := s.us.History([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(history, DeepEquals, []HistoryEntry{
+		{Tp: OpSet, Value: []byte("a")},
+		{Tp: OpSet, Value: []byte("b")},
+		{Tp: OpDelete},
+		{Tp: OpSet, Value: []byte("c")},
+	})
+	history, err = s.us.History([]byte("2"))
+	c.Assert(err, IsNil)
+	c.Assert(history, DeepEquals, []HistoryEntry{{Tp: OpDelete}})
+	history, err = s.us.History([]byte("3"))
+	c.Assert(err, IsNil)
+	c.Assert(history, HasLen, 0)
+	// Reads only see the latest value.
+	val, err := s.us.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("c"))
+
+	s.us.DelOption(KeepHistory)
+	s.us.Set([]byte("1"), []byte("d"))
+	history, err = s.us.History([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(history, HasLen, 4)
+}
+
+func (s *testUnionStoreSuite) TestSingleEntryBuffer(c *C) {
+	defer testleak.AfterTest(c)()
+	lmb := func(us UnionStore) *lazyMemBuffer {
+		return us.(*unionStore).BufferStore.MemBuffer.(*lazyMemBuffer)
+	}
+	check := func(us UnionStore, keys, values [][]byte) {
+		iter, err := us.Seek(nil)
+		c.Assert(err, IsNil)
+		checkIterator(c, iter, keys, values)
+	}
+
+	// The first key is kept inline, so are its overwrites.
+	us := NewUnionStore(&mockSnapshot{s.store})
+	c.Assert(us.Set([]byte("1"), []byte("a")), IsNil)
+	c.Assert(lmb(us).inline, IsTrue)
+	c.Assert(us.Set([]byte("1"), []byte("b")), IsNil)
+	c.Assert(lmb(us).inline, IsTrue)
+	check(us, [][]byte{[]byte("1")}, [][]byte{[]byte("b")})
+	c.Assert(us.Len(), Equals, 1)
+
+	// The second key upgrades the buffer.
+	c.Assert(us.Set([]byte("2"), []byte("c")), IsNil)
+	c.Assert(lmb(us).inline, IsFalse)
+	_, ok := lmb(us).mb.(*memDbBuffer)
+	c.Assert(ok, IsTrue)
+	check(us, [][]byte{[]byte("1"), []byte("2")}, [][]byte{[]byte("b"), []byte("c")})
+	c.Assert(us.Len(), Equals, 2)
+
+	// Delete then set the same key stays inline.
+	s.store.Set([]byte("3"), []byte("3"))
+	us = NewUnionStore(&mockSnapshot{s.store})
+	c.Assert(us.Delete([]byte("3")), IsNil)
+	_, err := us.Get([]byte("3"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+	c.Assert(us.Set([]byte("3"), []byte("d")), IsNil)
+	c.Assert(lmb(us).inline, IsTrue)
+	check(us, [][]byte{[]byte("3")}, [][]byte{[]byte("d")})
+
+	// The tombstone is moved by the upgrade.
+	us = NewUnionStore(&mockSnapshot{s.store})
+	c.Assert(us.Delete([]byte("3")), IsNil)
+	c.Assert(us.BatchDelete([]Key{Key("3"), Key("4")}), IsNil)
+	c.Assert(lmb(us).inline, IsFalse)
+	c.Assert(us.Len(), Equals, 2)
+	_, err = us.Get([]byte("3"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+	check(us, nil, nil)
+}
+
+func (s *testUnionStoreSuite) TestKeyValidator(c *C) {
+	defer testleak.AfterTest(c)()
+	errBadKey := errors.New("bad key")
+	s.us.SetOption(KeyValidator, func(k Key) error {
+		if !k.HasPrefix(Key("t")) {
+			return errBadKey
+		}
+		return nil
+	})
+	c.Assert(s.us.Set([]byte("t1"), []byte("1")), IsNil)
+	c.Assert(s.us.Delete([]byte("t2")), IsNil)
+	c.Assert(s.us.BatchDelete([]Key{Key("t3")}), IsNil)
+
+	err := s.us.Set([]byte("i1"), []byte("1"))
+	c.Assert(errors.Cause(err), Equals, errBadKey)
+	err = s.us.SetWithMeta([]byte("i1"), []byte("1"), []byte("m"))
+	c.Assert(errors.Cause(err), Equals, errBadKey)
+	err = s.us.Delete([]byte("i2"))
+	c.Assert(errors.Cause(err), Equals, errBadKey)
+	err = s.us.BatchDelete([]Key{Key("t4"), Key("i3")})
+	c.Assert(errors.Cause(err), Equals, errBadKey)
+	err = s.us.DeleteWithCondition([]byte("i4"), nil)
+	c.Assert(errors.Cause(err), Equals, errBadKey)
+	c.Assert(s.us.Len(), Equals, 3)
+
+	s.us.DelOption(KeyValidator)
+	c.Assert(s.us.Set([]byte("i1"), []byte("1")), IsNil)
+}
+
+func (s *testUnionStoreSuite) TestMergingIterator(c *C) {
+	defer testleak.AfterTest(c)()
+	// Layers from the top: top, middle, bottom, snapshot.
+	top, middle, bottom := NewMemDbBuffer(), NewMemDbBuffer(), NewMemDbBuffer()
+	for _, k := range []string{"1", "2", "3", "4", "5"} {
+		s.store.Set([]byte(k), []byte("s"+k))
+	}
+	bottom.Set([]byte("1"), []byte("b1"))
+	bottom.Delete([]byte("2"))
+	bottom.Set([]byte("6"), []byte("b6"))
+	bottom.Delete([]byte("9"))
+	middle.Set([]byte("2"), []byte("m2"))
+	middle.Delete([]byte("3"))
+	middle.Delete([]byte("6"))
+	middle.Set([]byte("7"), []byte("m7"))
+	top.Set([]byte("3"), []byte("t3"))
+	top.Delete([]byte("4"))
+	top.Delete([]byte("7"))
+	top.Set([]byte("8"), []byte("t8"))
+
+	snap := &mockSnapshot{s.store}
+	iter, err := NewMergingIterator([]MemBuffer{top, middle, bottom}, snap, nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter,
+		[][]byte{[]byte("1"), []byte("2"), []byte("3"), []byte("5"), []byte("8")},
+		[][]byte{[]byte("b1"), []byte("m2"), []byte("t3"), []byte("s5"), []byte("t8")})
+
+	iter, err = NewMergingIterator([]MemBuffer{top, middle, bottom}, snap, []byte("4"))
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("5"), []byte("8")}, [][]byte{[]byte("s5"), []byte("t8")})
+
+	// Without buffers it's the snapshot only.
+	iter, err = NewMergingIterator(nil, snap, []byte("4"))
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("4"), []byte("5")}, [][]byte{[]byte("s4"), []byte("s5")})
+}
+
+func (s *testUnionStoreSuite) TestSeal(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.us.Set([]byte("2"), []byte("2"))
+	s.us.Delete([]byte("3"))
+	s.us.Seal()
+
+	c.Assert(ErrStoreSealed.Equal(s.us.Set([]byte("4"), []byte("4"))), IsTrue)
+	c.Assert(ErrStoreSealed.Equal(s.us.SetWithMeta([]byte("4"), []byte("4"), nil)), IsTrue)
+	c.Assert(ErrStoreSealed.Equal(s.us.Delete([]byte("1"))), IsTrue)
+	c.Assert(ErrStoreSealed.Equal(s.us.BatchDelete([]Key{Key("1")})), IsTrue)
+	c.Assert(ErrStoreSealed.Equal(s.us.DeleteWithCondition([]byte("1"), nil)), IsTrue)
+	c.Assert(ErrStoreSealed.Equal(s.us.UndoKey([]byte("2"))), IsTrue)
+	err := s.us.Update([]byte("1"), func(old []byte, exists bool) ([]byte, bool, error) {
+		return []byte("x"), false, nil
+	})
+	c.Assert(ErrStoreSealed.Equal(err), IsTrue)
+	err = s.us.(*unionStore).RewriteKeys(func(k Key) (Key, bool) {
+		return append(Key("z"), k...), true
+	})
+	c.Assert(ErrStoreSealed.Equal(err), IsTrue)
+
+	// Reads and walking the buffer still work.
+	val, err := s.us.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("1"))
+	iter, err := s.us.Seek(nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("1"), []byte("2")}, [][]byte{[]byte("1"), []byte("2")})
+	m := NewMemDbBuffer()
+	c.Assert(s.us.(*unionStore).SaveTo(m), IsNil)
+	c.Assert(m.Len(), Equals, 2)
+}
+
+func (s *testUnionStoreSuite) TestRewriteKeys(c *C) {
+	defer testleak.AfterTest(c)()
+	us := s.us.(*unionStore)
+	c.Assert(us.Set([]byte("1"), []byte("1")), IsNil)
+	c.Assert(us.Set([]byte("2"), []byte("22")), IsNil)
+	prefix := func(p string) func(k Key) (Key, bool) {
+		return func(k Key) (Key, bool) {
+			return append(Key(p), k...), true
+		}
+	}
+	check := func() {
+		iter, err := us.Seek(nil)
+		c.Assert(err, IsNil)
+		checkIterator(c, iter, [][]byte{[]byte("1"), []byte("2")}, [][]byte{[]byte("1"), []byte("22")})
+	}
+
+	// The new keys pass the checks of Set, or the buffer isn't changed.
+	us.SetOption(ForbiddenRanges, []KeyRange{{StartKey: Key("f")}})
+	c.Assert(ErrForbiddenKeyRange.Equal(us.RewriteKeys(prefix("f"))), IsTrue)
+	check()
+	us.DelOption(ForbiddenRanges)
+	us.SetOption(KeyValidator, func(k Key) error {
+		if k.HasPrefix(Key("v")) {
+			return ErrNotImplemented
+		}
+		return nil
+	})
+	c.Assert(ErrNotImplemented.Equal(us.RewriteKeys(prefix("v"))), IsTrue)
+	check()
+	us.DelOption(KeyValidator)
+	us.SetOption(MaxValueBytes, 1)
+	c.Assert(ErrValueTooLarge.Equal(us.RewriteKeys(prefix("m"))), IsTrue)
+	check()
+	us.DelOption(MaxValueBytes)
+	us.SetOption(AppendOnly, true)
+	c.Assert(ErrAppendOnlyViolation.Equal(us.RewriteKeys(prefix("z"))), IsTrue)
+	check()
+	us.DelOption(AppendOnly)
+
+	c.Assert(us.RewriteKeys(prefix("a")), IsNil)
+	iter, err := us.Seek(nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("a1"), []byte("a2")}, [][]byte{[]byte("1"), []byte("22")})
+}
+
+// estimateSnapshot is a Snapshot which returns a fixed range count estimate.
+type estimateSnapshot struct {
+	Snapshot
+	cnt int64
+}
+
+func (s *estimateSnapshot) EstimateRangeCount(start, end Key) (int64, error) {
+	return s.cnt, nil
+}
+
+func (s *testUnionStoreSuite) TestEstimateRangeCount(c *C) {
+	defer testleak.AfterTest(c)()
+	cnt, err := s.us.EstimateRangeCount(nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(cnt, Equals, int64(-1))
+
+	snap := &estimateSnapshot{Snapshot: &mockSnapshot{s.store}, cnt: 10}
+	us := NewUnionStore(snap)
+	us.Set([]byte("a"), []byte("1"))
+	us.Set([]byte("b"), []byte("2"))
+	us.Set([]byte("c"), []byte("3"))
+	us.Delete([]byte("d"))
+	us.Set([]byte("x"), []byte("4"))
+
+	cnt, err = us.EstimateRangeCount(nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(cnt, Equals, int64(13))
+	cnt, err = us.EstimateRangeCount([]byte("b"), []byte("x"))
+	c.Assert(err, IsNil)
+	c.Assert(cnt, Equals, int64(11))
+	cnt, err = us.EstimateRangeCount([]byte("y"), nil)
+	c.Assert(err, IsNil)
+	c.Assert(cnt, Equals, int64(10))
+
+	// The estimate isn't negative.
+	snap.cnt = 0
+	cnt, err = us.EstimateRangeCount([]byte("d"), []byte("e"))
+	c.Assert(err, IsNil)
+	c.Assert(cnt, Equals, int64(0))
+}
+
+// VerifyConsistency checks that for every key in the buffer and snapshot, Get
+// of the union store returns the merge of the buffer over snapshot. It's a
+// safety net for the tests of the merge path.
+func (us *unionStore) VerifyConsistency(snapshot Snapshot) error {
+	keys := make(map[string]struct{})
+	err := us.WalkBuffer(func(k Key, v []byte) error {
+		keys[string(k)] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	iter, err := snapshot.Seek(nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for iter.Valid() {
+		keys[string(iter.Key())] = struct{}{}
+		if err = iter.Next(); err != nil {
+			iter.Close()
+			return errors.Trace(err)
+		}
+	}
+	iter.Close()
+
+	for key := range keys {
+		k := Key(key)
+		expect, err := us.MemBuffer.Get(k)
+		if IsErrNotFound(err) {
+			expect, err = snapshot.Get(k)
+		}
+		if IsErrNotFound(err) {
+			expect, err = nil, nil
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		actual, err := us.Get(k)
+		if IsErrNotFound(err) {
+			actual, err = nil, nil
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !bytes.Equal(actual, expect) {
+			return errors.Errorf("key %q: union store gets %q, but the merge is %q", k, actual, expect)
+		}
+	}
+	return nil
+}
+
+// staleSnapshot is a buggy Snapshot whose Get returns a stale value of a key.
+type staleSnapshot struct {
+	Snapshot
+	key   Key
+	value []byte
+}
+
+func (s *staleSnapshot) Get(k Key) ([]byte, error) {
+	if k.Cmp(s.key) == 0 {
+		return s.value, nil
+	}
+	return s.Snapshot.Get(k)
+}
+
+func (s *testUnionStoreSuite) TestVerifyConsistency(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	s.store.Set([]byte("3"), []byte("3"))
+	s.us.Set([]byte("2"), []byte("22"))
+	s.us.Delete([]byte("3"))
+	s.us.Set([]byte("4"), []byte("4"))
+	snapshot := &mockSnapshot{s.store}
+	c.Assert(s.us.(*unionStore).VerifyConsistency(snapshot), IsNil)
+
+	us := NewUnionStore(&staleSnapshot{Snapshot: snapshot, key: Key("1"), value: []byte("0")})
+	us.Set([]byte("2"), []byte("22"))
+	err := us.(*unionStore).VerifyConsistency(snapshot)
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, `key "1": .*`)
+}
+
+func (s *testUnionStoreSuite) TestWalkShadowed(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	s.store.Set([]byte("3"), []byte("3"))
+	s.store.Set([]byte("5"), []byte("5"))
+	// Insert.
+	s.us.Set([]byte("0"), []byte("0"))
+	// Update.
+	s.us.Set([]byte("1"), []byte("11"))
+	s.us.Set([]byte("5"), []byte("55"))
+	// Delete of existing and not existing keys.
+	s.us.Delete([]byte("2"))
+	s.us.Delete([]byte("4"))
+
+	walk := func(start, end Key) []string {
+		var visited []string
+		err := s.us.WalkShadowed(start, end, func(k Key, old, new []byte) error {
+			if new == nil {
+				visited = append(visited, string(k)+":"+string(old)+"->nil")
+			} else {
+				visited = append(visited, string(k)+":"+string(old)+"->"+string(new))
+			}
+			return nil
+		})
+		c.Assert(err, IsNil)
+		return visited
+	}
+	c.Assert(walk(nil, nil), DeepEquals, []string{"1:1->11", "2:2->nil", "5:5->55"})
+	c.Assert(walk([]byte("2"), []byte("5")), DeepEquals, []string{"2:2->nil"})
+	c.Assert(walk([]byte("6"), nil), HasLen, 0)
+
+	err := s.us.WalkShadowed(nil, nil, func(k Key, old, new []byte) error {
+		return ErrNotImplemented
+	})
+	c.Assert(ErrNotImplemented.Equal(err), IsTrue)
+}
+
+func (s *testUnionStoreSuite) TestRangeFullyBuffered(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	s.store.Set([]byte("4"), []byte("4"))
+	s.us.Set([]byte("1"), []byte("11"))
+	s.us.Delete([]byte("2"))
+	s.us.Set([]byte("3"), []byte("3"))
+
+	check := func(start, end Key, expected bool) {
+		ok, err := s.us.RangeFullyBuffered(start, end)
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, expected)
+	}
+	check([]byte("1"), []byte("4"), true)
+	check([]byte("3"), []byte("4"), true)
+	check([]byte("5"), nil, true)
+	check([]byte("2"), []byte("5"), false)
+	check(nil, nil, false)
+
+	s.us.Delete([]byte("4"))
+	check(nil, nil, true)
+}
+
+func (s *testUnionStoreSuite) TestConditionClearedObserver(c *C) {
+	defer testleak.AfterTest(c)()
+	var cleared []int
+	s.us.SetConditionClearedObserver(func(count int) {
+		cleared = append(cleared, count)
+	})
+	c.Assert(s.us.BatchAssertNotExists([]Key{Key("1"), Key("2")}), IsNil)
+	c.Assert(s.us.FlushConditionChecks(), IsNil)
+	c.Assert(cleared, DeepEquals, []int{2})
+
+	c.Assert(s.us.BatchAssertNotExists([]Key{Key("1"), Key("2"), Key("3")}), IsNil)
+	c.Assert(s.us.PrepareRetry([]Key{Key("1"), Key("4")}), IsNil)
+	c.Assert(cleared, DeepEquals, []int{2, 1})
+
+	// UndoKey reports a removed pair only.
+	c.Assert(s.us.UndoKey(Key("2")), IsNil)
+	c.Assert(s.us.UndoKey(Key("4")), IsNil)
+	c.Assert(cleared, DeepEquals, []int{2, 1, 1})
+
+	s.us.Release()
+	s.us.Release()
+	c.Assert(cleared, DeepEquals, []int{2, 1, 1, 1})
+
+	// The store still records condition pairs after Release.
+	s.us.SetOption(PresumeKeyNotExists, nil)
+	_, err := s.us.Get([]byte("5"))
+	c.Assert(terror.ErrorEqual(err, ErrNotExist), IsTrue)
+	s.us.DelOption(PresumeKeyNotExists)
+	c.Assert(s.us.BatchAssertNotExists([]Key{Key("6")}), IsNil)
+	c.Assert(s.us.LockKeys(), HasLen, 2)
+
+	// A mismatched flush keeps the pairs.
+	us := NewUnionStore(&mockSnapshot{s.store})
+	us.SetConditionClearedObserver(func(count int) {
+		cleared = append(cleared, count)
+	})
+	s.store.Set([]byte("1"), []byte("1"))
+	c.Assert(us.BatchAssertNotExists([]Key{Key("1")}), IsNil)
+	c.Assert(us.FlushConditionChecks(), NotNil)
+	c.Assert(cleared, HasLen, 4)
+
+	us.SetConditionClearedObserver(nil)
+	us.Release()
+	c.Assert(cleared, HasLen, 4)
+}
+
+func (s *testUnionStoreSuite) TestPrefixedUnionStore(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("t0_1"), []byte("0"))
+	s.store.Set([]byte("t1_1"), []byte("1"))
+	s.store.Set([]byte("t1_2"), []byte("2"))
+	s.store.Set([]byte("t2_1"), []byte("3"))
+	us := NewPrefixedUnionStore(s.us, Key("t1_"))
+
+	v, err := us.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(v, BytesEquals, []byte("1"))
+	_, err = us.Get([]byte("t0_1"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+
+	c.Assert(us.Set([]byte("3"), []byte("33")), IsNil)
+	c.Assert(us.Delete([]byte("2")), IsNil)
+	v, err = s.us.Get([]byte("t1_3"))
+	c.Assert(err, IsNil)
+	c.Assert(v, BytesEquals, []byte("33"))
+	_, err = s.us.Get([]byte("t1_2"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+
+	// The keys of the other prefixes aren't visible.
+	iter, err := us.Seek(nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("1"), []byte("3")}, [][]byte{[]byte("1"), []byte("33")})
+	iter, err = us.SeekReverse(nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("3"), []byte("1")}, [][]byte{[]byte("33"), []byte("1")})
+	iter, err = us.SeekReverse([]byte("3"))
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("1")}, [][]byte{[]byte("1")})
+	iter, err = us.SeekSnapshotOnly([]byte("2"), nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("2")}, [][]byte{[]byte("2")})
+
+	c.Assert(s.us.Set([]byte("t0_2"), []byte("x")), IsNil)
+	var walked []string
+	err = us.WalkBuffer(func(k Key, v []byte) error {
+		walked = append(walked, string(k))
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(walked, DeepEquals, []string{"2", "3"})
+	var ops []string
+	err = us.WalkCommitMutations(func(op Op) error {
+		ops = append(ops, op.String())
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(ops, DeepEquals, []string{`delete("2")`, `set("3", "33")`})
+	c.Assert(us.DumpBuffer(0), HasLen, 2)
+	c.Assert(s.us.DumpBuffer(0), HasLen, 3)
+	ok, err := us.RangeFullyBuffered([]byte("2"), nil)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+
+	// The reports only see the keys with the prefix, without it.
+	c.Assert(us.Len(), Equals, 2)
+	c.Assert(us.Size(), Equals, 1+1+2)
+	c.Assert(us.Dirty(), IsTrue)
+	c.Assert(NewPrefixedUnionStore(s.us, Key("t2_")).Dirty(), IsFalse)
+	keyHist, valHist := us.SizeHistogram()
+	c.Assert(keyHist, DeepEquals, []int{0, 2})
+	c.Assert(valHist, DeepEquals, []int{1, 0, 1})
+	sum, err := us.WriteSetChecksum()
+	c.Assert(err, IsNil)
+	other := NewUnionStore(&mockSnapshot{NewMemDbBuffer()})
+	other.Delete([]byte("2"))
+	other.Set([]byte("3"), []byte("33"))
+	expected, err := other.WriteSetChecksum()
+	c.Assert(err, IsNil)
+	c.Assert(sum, Equals, expected)
+
+	c.Assert(s.us.BatchAssertNotExists([]Key{Key("t0_1"), Key("t1_1"), Key("t1_4"), Key("t2_4")}), IsNil)
+	violations, err := us.CheckLazyConditionPairsAll()
+	c.Assert(err, IsNil)
+	c.Assert(violations, HasLen, 1)
+	c.Assert(violations[0].Key, DeepEquals, Key("1"))
+	c.Assert(us.ValidateConditionConsistency(), IsNil)
+	s.us.Delete([]byte("t2_4"))
+	c.Assert(us.ValidateConditionConsistency(), IsNil)
+	c.Assert(us.Delete([]byte("4")), IsNil)
+	err = us.ValidateConditionConsistency()
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, `.*\["4"\].*`)
+
+	// The whole keyspace is used with an all 0xff prefix.
+	s.store.Set([]byte("\xff\xff1"), []byte("1"))
+	us = NewPrefixedUnionStore(s.us, Key("\xff\xff"))
+	iter, err = us.SeekReverse(nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("1")}, [][]byte{[]byte("1")})
+}
+
+func (s *testUnionStoreSuite) TestForbiddenRanges(c *C) {
+	defer testleak.AfterTest(c)()
+	s.us.SetOption(ForbiddenRanges, []KeyRange{
+		{StartKey: Key("m"), EndKey: Key("n")},
+		{StartKey: Key("c"), EndKey: Key("e")},
+		{StartKey: Key("d"), EndKey: Key("f")},
+		{StartKey: Key("x"), EndKey: nil},
+	})
+	forbidden := func(k string) bool {
+		err := s.us.Set([]byte(k), []byte("1"))
+		if err == nil {
+			return false
+		}
+		c.Assert(ErrForbiddenKeyRange.Equal(err), IsTrue)
+		c.Assert(err.Error(), Matches, `.*"`+k+`".*`)
+		return true
+	}
+	for _, k := range []string{"c", "c1", "d", "e", "e1", "m", "m1", "x", "z"} {
+		c.Assert(forbidden(k), IsTrue, Commentf("key %s", k))
+	}
+	for _, k := range []string{"a", "b1", "f", "l", "n", "w"} {
+		c.Assert(forbidden(k), IsFalse, Commentf("key %s", k))
+	}
+	err := s.us.Delete([]byte("m"))
+	c.Assert(ErrForbiddenKeyRange.Equal(err), IsTrue)
+	err = s.us.BatchDelete([]Key{Key("a"), Key("d")})
+	c.Assert(ErrForbiddenKeyRange.Equal(err), IsTrue)
+	c.Assert(s.us.Delete([]byte("n")), IsNil)
+
+	s.us.DelOption(ForbiddenRanges)
+	c.Assert(forbidden("m"), IsFalse)
+}
+
+type densitySnapshot struct {
+	*recordSnapshot
+	store MemBuffer
+	seeks int
+}
+
+func (s *densitySnapshot) EstimateRangeCount(start, end Key) (int64, error) {
+	var cnt int64
+	it, err := s.store.Seek(start)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	for it.Valid() && it.Key().Cmp(end) < 0 {
+		cnt++
+		it.Next()
+	}
+	return cnt, nil
+}
+
+func (s *densitySnapshot) Seek(k Key) (Iterator, error) {
+	s.seeks++
+	return s.recordSnapshot.Seek(k)
+}
+
+func (s *testUnionStoreSuite) TestConditionScanDensity(c *C) {
+	defer testleak.AfterTest(c)()
+	for i := 0; i < 20; i++ {
+		s.store.Set([]byte("k"+strconv.Itoa(100 + i)[1:]), []byte(strconv.Itoa(i)))
+	}
+	check := func(notExists []Key, equals []KeyValue) (ConditionCheckStats, *densitySnapshot, error) {
+		snap := &densitySnapshot{recordSnapshot: &recordSnapshot{Snapshot: &mockSnapshot{s.store}}, store: s.store}
+		us := NewUnionStore(snap)
+		us.SetOption(ConditionScanDensity, 0.5)
+		var stats ConditionCheckStats
+		us.SetOption(ConditionCheckMetrics, func(st ConditionCheckStats) { stats = st })
+		c.Assert(us.BatchAssertNotExists(notExists), IsNil)
+		c.Assert(us.BatchAssertEquals(equals), IsNil)
+		return stats, snap, us.CheckLazyConditionPairs()
+	}
+
+	// Dense keys are scanned.
+	stats, snap, err := check([]Key{Key("k03x"), Key("k04x")}, []KeyValue{{Key: Key("k04"), Value: []byte("4")}, {Key: Key("k06"), Value: []byte("6")}})
+	c.Assert(err, IsNil)
+	c.Assert(stats.RangeScan, IsTrue)
+	c.Assert(snap.seeks, Equals, 1)
+	c.Assert(snap.batchGetKeys, HasLen, 0)
+	c.Assert(snap.batchExistKeys, HasLen, 0)
+	_, _, err = check([]Key{Key("k05")}, []KeyValue{{Key: Key("k04"), Value: []byte("4")}})
+	c.Assert(err, NotNil)
+	_, _, err = check(nil, []KeyValue{{Key: Key("k04"), Value: []byte("4")}, {Key: Key("k05"), Value: []byte("x")}})
+	c.Assert(ErrLazyConditionPairsNotMatch.Equal(err), IsTrue)
+
+	// Sparse keys are read by batches.
+	stats, snap, err = check([]Key{Key("k00x")}, []KeyValue{{Key: Key("k19"), Value: []byte("19")}})
+	c.Assert(err, IsNil)
+	c.Assert(stats.RangeScan, IsFalse)
+	c.Assert(snap.seeks, Equals, 0)
+	c.Assert(snap.batchGetKeys, HasLen, 1)
+	c.Assert(snap.batchExistKeys, HasLen, 1)
+	_, _, err = check([]Key{Key("k00")}, []KeyValue{{Key: Key("k19"), Value: []byte("19")}})
+	c.Assert(err, NotNil)
+}
+
+func (s *testUnionStoreSuite) TestResolve(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	s.store.Set([]byte("3"), []byte("3"))
+	s.us.Set([]byte("1"), []byte("11"))
+	s.us.Delete([]byte("2"))
+	s.us.Set([]byte("4"), []byte("4"))
+
+	check := func(k string, value []byte, src EntrySource, exists bool) {
+		v, s1, e, err := s.us.Resolve([]byte(k))
+		c.Assert(err, IsNil)
+		c.Assert(v, BytesEquals, value)
+		c.Assert(s1, Equals, src)
+		c.Assert(e, Equals, exists)
+	}
+	check("1", []byte("11"), SourceBuffer, true)
+	check("2", nil, SourceBuffer, false)
+	check("3", []byte("3"), SourceSnapshot, true)
+	check("4", []byte("4"), SourceBuffer, true)
+	check("5", nil, SourceSnapshot, false)
+
+	// A presumed missing key isn't read from the snapshot.
+	s.us.SetOption(PresumeKeyNotExists, nil)
+	check("3", nil, SourceSnapshot, false)
+	c.Assert(s.us.CheckLazyConditionPairs(), NotNil)
+}
+
+func (s *testUnionStoreSuite) TestBufferedSince(c *C) {
+	defer testleak.AfterTest(c)()
+	c.Assert(s.us.Set([]byte("1"), []byte("1")), IsNil)
+	_, ok := s.us.BufferedSince([]byte("1"))
+	c.Assert(ok, IsFalse)
+
+	s.us.SetOption(TrackWriteTime, true)
+	before := time.Now()
+	c.Assert(s.us.Set([]byte("2"), []byte("2")), IsNil)
+	c.Assert(s.us.Delete([]byte("3")), IsNil)
+	t2, ok := s.us.BufferedSince([]byte("2"))
+	c.Assert(ok, IsTrue)
+	c.Assert(t2.Before(before), IsFalse)
+	c.Assert(t2.After(time.Now()), IsFalse)
+	_, ok = s.us.BufferedSince([]byte("3"))
+	c.Assert(ok, IsTrue)
+
+	// Overwrites keep the time of the first write.
+	time.Sleep(time.Millisecond)
+	c.Assert(s.us.Set([]byte("2"), []byte("22")), IsNil)
+	t, ok := s.us.BufferedSince([]byte("2"))
+	c.Assert(ok, IsTrue)
+	c.Assert(t.Equal(t2), IsTrue)
+
+	c.Assert(s.us.UndoKey([]byte("2")), IsNil)
+	_, ok = s.us.BufferedSince([]byte("2"))
+	c.Assert(ok, IsFalse)
+
+	s.us.DelOption(TrackWriteTime)
+	c.Assert(s.us.Set([]byte("4"), []byte("4")), IsNil)
+	_, ok = s.us.BufferedSince([]byte("4"))
+	c.Assert(ok, IsFalse)
+}
+
+func (s *testUnionStoreSuite) TestCheckBatchUnique(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	s.us.Delete([]byte("2"))
+	s.us.Set([]byte("3"), []byte("3"))
+
+	dupes, err := s.us.CheckBatchUnique([]Key{Key("4"), Key("5")})
+	c.Assert(err, IsNil)
+	c.Assert(dupes, HasLen, 0)
+	// Existing in the snapshot and the buffer, and duplicated in the batch.
+	dupes, err = s.us.CheckBatchUnique([]Key{Key("5"), Key("1"), Key("2"), Key("4"), Key("3"), Key("5"), Key("1"), Key("5")})
+	c.Assert(err, IsNil)
+	c.Assert(dupes, DeepEquals, []Key{Key("5"), Key("1"), Key("3")})
+
+	snap := &recordSnapshot{Snapshot: &mockSnapshot{s.store}}
+	us := NewUnionStore(snap)
+	us.Set([]byte("3"), []byte("3"))
+	_, err = us.CheckBatchUnique([]Key{Key("1"), Key("3"), Key("1"), Key("4")})
+	c.Assert(err, IsNil)
+	c.Assert(snap.batchExistKeys, DeepEquals, [][]Key{{Key("1"), Key("4")}})
+}
+
+func (s *testUnionStoreSuite) TestAppendOnly(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("k0"), []byte("0"))
+	s.us.SetOption(AppendOnly, true)
+	for i := 1; i < 100; i++ {
+		c.Assert(s.us.Set([]byte("k"+strconv.Itoa(100+i)), []byte(strconv.Itoa(i))), IsNil)
+	}
+	lmb := s.us.(*unionStore).BufferStore.MemBuffer.(*lazyMemBuffer)
+	c.Assert(lmb.inline, IsTrue)
+	c.Assert(s.us.Len(), Equals, 99)
+	iter, err := s.us.Seek([]byte("k198"))
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("k198"), []byte("k199")}, [][]byte{[]byte("98"), []byte("99")})
+
+	isViolation := func(err error) bool {
+		return ErrAppendOnlyViolation.Equal(err)
+	}
+	c.Assert(isViolation(s.us.Delete([]byte("k200"))), IsTrue)
+	c.Assert(isViolation(s.us.BatchDelete([]Key{Key("k200")})), IsTrue)
+	c.Assert(isViolation(s.us.Set([]byte("k199"), []byte("x"))), IsTrue)
+	c.Assert(isViolation(s.us.Set([]byte("k0"), []byte("x"))), IsTrue)
+	c.Assert(isViolation(s.us.SetWithMeta([]byte("k150"), []byte("x"), nil)), IsTrue)
+	c.Assert(s.us.Len(), Equals, 99)
+	c.Assert(s.us.Set([]byte("k200"), []byte("100")), IsNil)
+
+	// The buffer is upgraded by the next write after the option is off.
+	s.us.DelOption(AppendOnly)
+	c.Assert(s.us.Delete([]byte("k150")), IsNil)
+	c.Assert(lmb.inline, IsFalse)
+	c.Assert(s.us.Len(), Equals, 100)
+	v, err := s.us.Get([]byte("k200"))
+	c.Assert(err, IsNil)
+	c.Assert(v, BytesEquals, []byte("100"))
+
+	// The check also works on an upgraded buffer.
+	s.us.SetOption(AppendOnly, true)
+	c.Assert(isViolation(s.us.Set([]byte("k150"), []byte("x"))), IsTrue)
+	c.Assert(s.us.Set([]byte("k201"), []byte("x")), IsNil)
+}
+
+func (s *testUnionStoreSuite) TestDistinctDeletedError(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.us.Delete([]byte("1"))
+	s.us.Delete([]byte("2"))
+
+	for _, k := range []string{"1", "2", "3"} {
+		_, err := s.us.Get([]byte(k))
+		c.Assert(IsErrNotFound(err), IsTrue)
+	}
+
+	s.us.SetOption(DistinctDeletedError, true)
+	for _, k := range []string{"1", "2"} {
+		_, err := s.us.Get([]byte(k))
+		c.Assert(ErrDeleted.Equal(err), IsTrue)
+		c.Assert(IsErrNotFound(err), IsFalse)
+	}
+	_, err := s.us.Get([]byte("3"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+	s.us.Set([]byte("1"), []byte("11"))
+	v, err := s.us.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(v, BytesEquals, []byte("11"))
+
+	s.us.DelOption(DistinctDeletedError)
+	_, err = s.us.Get([]byte("2"))
+	c.Assert(IsErrNotFound(err), IsTrue)
+}
+
+func (s *testUnionStoreSuite) TestMemTracker(c *C) {
+	defer testleak.AfterTest(c)()
+	us := NewUnionStoreWithMemTracker(&mockSnapshot{s.store}, NewMemTracker(1<<20))
+	tracker := us.(*unionStore).tracker
+	c.Assert(us.Set([]byte("1"), []byte("1")), IsNil)
+	c.Assert(tracker.Used(), Equals, int64(us.MemUsage()))
+	c.Assert(us.Delete([]byte("2")), IsNil)
+	c.Assert(us.UndoKey([]byte("1")), IsNil)
+	c.Assert(tracker.Used(), Equals, int64(us.MemUsage()))
+	us.Release()
+	c.Assert(tracker.Used(), Equals, int64(0))
+
+	// Several stores share a tracker and cross the budget together.
+	const stores, writes = 8, 100
+	tracker = NewMemTracker(stores * writes * 10)
+	var wg sync.WaitGroup
+	var exceeded int32
+	uss := make([]UnionStore, stores)
+	for i := 0; i < stores; i++ {
+		uss[i] = NewUnionStoreWithMemTracker(&mockSnapshot{s.store}, tracker)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			us := uss[i]
+			for j := 0; j < writes; j++ {
+				err := us.Set(encodeInt(i*writes+j), encodeInt(j))
+				if ErrGlobalMemExceeded.Equal(err) {
+					atomic.StoreInt32(&exceeded, 1)
+					return
+				}
+				if err != nil {
+					c.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	c.Assert(atomic.LoadInt32(&exceeded), Equals, int32(1))
+	for _, us := range uss {
+		us.Release()
+	}
+	c.Assert(tracker.Used(), Equals, int64(0))
+}
+
+func (s *testUnionStoreSuite) TestRefreshSnapshot(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	s.us.SetOption(PrefetchConditions, true)
+	s.us.SetOption(ReadBatchWindow, time.Millisecond)
+	s.us.Set([]byte("1"), []byte("11"))
+	c.Assert(s.us.BatchAssertEquals([]KeyValue{{Key: Key("2"), Value: []byte("2")}}), IsNil)
+	c.Assert(s.us.CheckLazyConditionPairs(), IsNil)
+
+	store := NewMemDbBuffer()
+	store.Set([]byte("1"), []byte("111"))
+	store.Set([]byte("2"), []byte("222"))
+	store.Set([]byte("3"), []byte("333"))
+	s.us.RefreshSnapshot(&mockSnapshot{store})
+
+	// The buffered key still reads the buffer, the others read the new snapshot.
+	val, err := s.us.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("11"))
+	val, err = s.us.Get([]byte("2"))
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("222"))
+	iter, err := s.us.Seek(nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("1"), []byte("2"), []byte("3")}, [][]byte{[]byte("11"), []byte("222"), []byte("333")})
+	_, ok := s.us.(*unionStore).snapshot.(*batchingSnapshot)
+	c.Assert(ok, IsTrue)
+
+	// The condition pair is checked against the new snapshot, not the
+	// prefetched value of the old one.
+	c.Assert(ErrLazyConditionPairsNotMatch.Equal(s.us.CheckLazyConditionPairs()), IsTrue)
+}
+
+func (s *testUnionStoreSuite) TestIterSource(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	s.store.Set([]byte("3"), []byte("3"))
+	s.us.Set([]byte("0"), []byte("0"))
+	s.us.Set([]byte("2"), []byte("22"))
+	s.us.Delete([]byte("3"))
+	s.us.Set([]byte("4"), []byte("4"))
+
+	sources := func(iter Iterator) map[string]EntrySource {
+		m := make(map[string]EntrySource)
+		for ; iter.Valid(); iter.Next() {
+			m[string(iter.Key())] = iter.(*UnionIter).Source()
+		}
+		iter.Close()
+		return m
+	}
+	iter, err := s.us.Seek(nil)
+	c.Assert(err, IsNil)
+	c.Assert(sources(iter), DeepEquals, map[string]EntrySource{
+		"0": SourceBuffer, "1": SourceSnapshot, "2": SourceBuffer, "4": SourceBuffer,
+	})
+	iter, err = s.us.SeekReverse(nil)
+	c.Assert(err, IsNil)
+	c.Assert(sources(iter), DeepEquals, map[string]EntrySource{
+		"0": SourceBuffer, "1": SourceSnapshot, "2": SourceBuffer, "4": SourceBuffer,
+	})
+
+	lower := NewMemDbBuffer()
+	lower.Set([]byte("1"), []byte("11"))
+	iter, err = NewMergingIterator([]MemBuffer{s.us.(*unionStore).MemBuffer, lower}, &mockSnapshot{s.store}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(sources(iter), DeepEquals, map[string]EntrySource{
+		"0": SourceBuffer, "1": SourceBuffer, "2": SourceBuffer, "4": SourceBuffer,
+	})
+}
+
+func (s *testUnionStoreSuite) TestCommitFilter(c *C) {
+	defer testleak.AfterTest(c)()
+	s.us.Set([]byte("a1"), []byte("1"))
+	s.us.Set([]byte("b1"), []byte("2"))
+	s.us.Delete([]byte("b2"))
+	s.us.Set([]byte("c1"), []byte("3"))
+
+	walk := func() ([]string, error) {
+		var ops []string
+		err := s.us.WalkCommitMutations(func(op Op) error {
+			ops = append(ops, op.String())
+			return nil
+		})
+		return ops, err
+	}
+	ops, err := walk()
+	c.Assert(err, IsNil)
+	c.Assert(ops, DeepEquals, []string{`set("a1", "1")`, `set("b1", "2")`, `delete("b2")`, `set("c1", "3")`})
+
+	// Drop the prefix b and rewrite the values of c.
+	s.us.SetOption(CommitFilter, func(op Op) (Op, error) {
+		if op.Key.HasPrefix(Key("b")) {
+			return op, ErrSkipMutation
+		}
+		if op.Key.HasPrefix(Key("c")) {
+			op.Value = []byte("x")
+		}
+		return op, nil
+	})
+	ops, err = walk()
+	c.Assert(err, IsNil)
+	c.Assert(ops, DeepEquals, []string{`set("a1", "1")`, `set("c1", "x")`})
+
+	// Reject a forbidden key.
+	s.us.SetOption(CommitFilter, func(op Op) (Op, error) {
+		if op.Key.Cmp(Key("b1")) == 0 {
+			return op, ErrNotImplemented
+		}
+		return op, nil
+	})
+	ops, err = walk()
+	c.Assert(ErrNotImplemented.Equal(err), IsTrue)
+	c.Assert(ops, DeepEquals, []string{`set("a1", "1")`})
+
+	// An emptied value is a delete, an unknown type is rejected.
+	s.us.SetOption(CommitFilter, func(op Op) (Op, error) {
+		if op.Key.HasPrefix(Key("b")) {
+			op.Tp = OpGet
+		}
+		op.Value = nil
+		return op, nil
+	})
+	ops, err = walk()
+	c.Assert(err, ErrorMatches, ".*invalid mutation type.*")
+	c.Assert(ops, DeepEquals, []string{`delete("a1")`})
+
+	// An error of f stops the walk.
+	s.us.DelOption(CommitFilter)
+	var visited []string
+	err = s.us.WalkCommitMutations(func(op Op) error {
+		visited = append(visited, string(op.Key))
+		if op.Tp == OpDelete {
+			return ErrNotImplemented
+		}
+		return nil
+	})
+	c.Assert(ErrNotImplemented.Equal(err), IsTrue)
+	c.Assert(visited, DeepEquals, []string{"a1", "b1", "b2"})
+}
+
+func (s *testUnionStoreSuite) TestApplyMutations(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	s.us.Set([]byte("1"), []byte("11"))
+	s.us.Delete([]byte("2"))
+	s.us.Set([]byte("3"), []byte("3"))
+
+	var ops []Op
+	err := s.us.WalkCommitMutations(func(op Op) error {
+		ops = append(ops, Op{Tp: op.Tp, Key: op.Key.Clone(), Value: append([]byte(nil), op.Value...)})
+		return nil
+	})
+	c.Assert(err, IsNil)
+	us := NewUnionStore(&mockSnapshot{s.store})
+	c.Assert(us.ApplyMutations(ops), IsNil)
+	for _, k := range []string{"1", "2", "3", "4"} {
+		v1, err1 := s.us.Get([]byte(k))
+		v2, err2 := us.Get([]byte(k))
+		c.Assert(v2, BytesEquals, v1)
+		c.Assert(IsErrNotFound(err2), Equals, IsErrNotFound(err1))
+	}
+	iter, err := us.Seek(nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("1"), []byte("3")}, [][]byte{[]byte("11"), []byte("3")})
+
+	// The later ops override the earlier ones.
+	c.Assert(us.ApplyMutations([]Op{
+		{Tp: OpDelete, Key: Key("1")},
+		{Tp: OpSet, Key: Key("2"), Value: []byte("22")},
+		{Tp: OpSet, Key: Key("1"), Value: []byte("111")},
+		{Tp: OpDelete, Key: Key("3")},
+	}), IsNil)
+	iter, err = us.Seek(nil)
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, [][]byte{[]byte("1"), []byte("2")}, [][]byte{[]byte("111"), []byte("22")})
+
+	c.Assert(us.ApplyMutations([]Op{{Tp: OpGet, Key: Key("1")}}), NotNil)
+}
+
+func (s *testUnionStoreSuite) TestHotKeys(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("2"), []byte("2"))
+	s.us.Set([]byte("3"), []byte("3"))
+	s.us.Get([]byte("1"))
+	c.Assert(s.us.HotKeys(10), HasLen, 0)
+
+	s.us.SetOption(TrackAccess, true)
+	for i := 0; i < 10; i++ {
+		s.us.Get([]byte("3"))
+	}
+	for i := 0; i < 5; i++ {
+		s.us.Get([]byte("1"))
+	}
+	s.us.GetWithOld([]byte("1"))
+	s.us.Get([]byte("2"))
+	s.us.Get([]byte("4"))
+
+	c.Assert(s.us.HotKeys(2), DeepEquals, []KeyCount{{Key("3"), 10}, {Key("1"), 6}})
+	c.Assert(s.us.HotKeys(10), DeepEquals, []KeyCount{{Key("3"), 10}, {Key("1"), 6}, {Key("2"), 1}, {Key("4"), 1}})
+	c.Assert(s.us.HotKeys(0), HasLen, 0)
+}
+
+// releaseSnapshot is a Snapshot which counts the calls of Release.
+type releaseSnapshot struct {
+	Snapshot
+	released int
+}
+
+func (s *releaseSnapshot) Release() {
+	s.released++
+}
+
+func (s *testUnionStoreSuite) TestRelease(c *C) {
+	defer testleak.AfterTest(c)()
+	snap := &releaseSnapshot{Snapshot: &mockSnapshot{s.store}}
+	us := NewUnionStore(snap)
+	us.SetOption(ReadBatchWindow, time.Millisecond)
+	us.Set([]byte("1"), []byte("1"))
+	// The batchingSnapshot forwards Release to the wrapped snapshot.
+	us.Release()
+	c.Assert(snap.released, Equals, 1)
+	us.Release()
+	c.Assert(snap.released, Equals, 1)
+
+	// RefreshSnapshot releases the replaced snapshot under the batchingSnapshot.
+	snap = &releaseSnapshot{Snapshot: &mockSnapshot{s.store}}
+	us = NewUnionStore(snap)
+	us.SetOption(ReadBatchWindow, time.Millisecond)
+	newSnap := &releaseSnapshot{Snapshot: &mockSnapshot{s.store}}
+	us.RefreshSnapshot(newSnap)
+	c.Assert(snap.released, Equals, 1)
+	us.RefreshSnapshot(newSnap)
+	c.Assert(newSnap.released, Equals, 0)
+	us.Release()
+	c.Assert(newSnap.released, Equals, 1)
+}
+
+// faultyFactory is a MemBufferFactory which panics, or returns nil if panic
+// is false.
+type faultyFactory struct {
+	panic bool
+}
+
+func (f faultyFactory) NewMemBuffer() MemBuffer {
+	if f.panic {
+		panic("out of memory")
+	}
+	return nil
+}
+
+func (s *testUnionStoreSuite) TestBufferAllocFailed(c *C) {
+	defer testleak.AfterTest(c)()
+	for _, f := range []faultyFactory{{panic: true}, {panic: false}} {
+		us := NewUnionStoreWithFactory(&mockSnapshot{s.store}, f)
+		// The first key is kept inline without the factory.
+		c.Assert(us.Set([]byte("1"), []byte("1")), IsNil)
+		err := us.Set([]byte("2"), []byte("2"))
+		c.Assert(ErrBufferAllocFailed.Equal(err), IsTrue)
+		val, err := us.Get([]byte("1"))
+		c.Assert(err, IsNil)
+		c.Assert(val, BytesEquals, []byte("1"))
+
+		us = NewUnionStoreWithFactory(&mockSnapshot{s.store}, f)
+		_, err = us.Reserve(1, 1)
+		c.Assert(ErrBufferAllocFailed.Equal(err), IsTrue)
+	}
+}
+
+func (s *testUnionStoreSuite) TestValidateConditionConsistency(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	// Insert a new key, update and delete existing keys.
+	c.Assert(s.us.BatchAssertNotExists([]Key{Key("2")}), IsNil)
+	s.us.Set([]byte("2"), []byte("2"))
+	c.Assert(s.us.Update([]byte("1"), func(old []byte, exists bool) ([]byte, bool, error) {
+		return []byte("11"), false, nil
+	}), IsNil)
+	c.Assert(s.us.DeleteWithCondition([]byte("1"), []byte("1")), IsNil)
+	c.Assert(s.us.BatchAssertNotExists([]Key{Key("5")}), IsNil)
+	c.Assert(s.us.ValidateConditionConsistency(), IsNil)
+
+	// Delete the keys which must not exist.
+	c.Assert(s.us.BatchAssertNotExists([]Key{Key("4"), Key("3")}), IsNil)
+	s.us.Delete([]byte("3"))
+	s.us.Delete([]byte("4"))
+	err := s.us.ValidateConditionConsistency()
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, `.*\["3" "4"\].*`)
+}
+
+func (s *testUnionStoreSuite) TestDumpBuffer(c *C) {
+	defer testleak.AfterTest(c)()
+	c.Assert(s.us.DumpBuffer(10), HasLen, 0)
+	s.store.Set([]byte("0"), []byte("0"))
+	s.us.Set([]byte("2"), []byte("22"))
+	s.us.Delete([]byte("1"))
+	s.us.Set([]byte("3"), []byte("333"))
+
+	expect := []BufferEntry{
+		{Key: Key("1"), Tombstone: true, ValueLen: 0},
+		{Key: Key("2"), ValueLen: 2},
+		{Key: Key("3"), ValueLen: 3},
+	}
+	c.Assert(s.us.DumpBuffer(0), DeepEquals, expect)
+	c.Assert(s.us.DumpBuffer(10), DeepEquals, expect)
+	c.Assert(s.us.DumpBuffer(2), DeepEquals, expect[:2])
+	// Dumping doesn't change the buffer.
+	c.Assert(s.us.Len(), Equals, 3)
+	c.Assert(s.us.DumpBuffer(-1), DeepEquals, expect)
+}
+
+func (s *testUnionStoreSuite) TestUnionIterReuse(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("1"), []byte("1"))
+	s.store.Set([]byte("3"), []byte("3"))
+	s.us.Set([]byte("2"), []byte("2"))
+	s.us.Delete([]byte("3"))
+	s.us.Set([]byte("4"), []byte("4"))
+
+	// Leave an iterator in the middle and close it twice, the later
+	// iterators still return fresh results.
+	for i := 0; i < 10; i++ {
+		iter, err := s.us.Seek(nil)
+		c.Assert(err, IsNil)
+		c.Assert(iter.Next(), IsNil)
+		iter.Close()
+		iter.Close()
+
+		iter, err = s.us.SeekReverse([]byte("4"))
+		c.Assert(err, IsNil)
+		checkIterator(c, iter, [][]byte{[]byte("2"), []byte("1")}, [][]byte{[]byte("2"), []byte("1")})
+		iter, err = s.us.Seek([]byte("2"))
+		c.Assert(err, IsNil)
+		checkIterator(c, iter, [][]byte{[]byte("2"), []byte("4")}, [][]byte{[]byte("2"), []byte("4")})
+	}
+}
+
 func checkIterator(c *C, iter Iterator, keys [][]byte, values [][]byte) {
 	defer iter.Close()
 	c.Assert(len(keys), Equals, len(values))
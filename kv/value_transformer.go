@@ -0,0 +1,72 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import "github.com/juju/errors"
+
+// ValueTransformer transforms the values kept in the buffer of a UnionStore,
+// e.g. encrypts them so that they are not plaintext in memory. It's set by
+// the BufferValueTransformer option.
+type ValueTransformer interface {
+	// Encode transforms a non-empty value before it's put into the buffer.
+	// The result must be non-empty too.
+	Encode(v []byte) []byte
+	// Decode restores a value encoded by Encode.
+	Decode(v []byte) ([]byte, error)
+}
+
+// transformIter decodes the values of a buffer iterator. The tombstones,
+// which have empty values, are kept as is.
+type transformIter struct {
+	Iterator
+	t     ValueTransformer
+	value []byte
+}
+
+func newTransformIter(it Iterator, t ValueTransformer) (Iterator, error) {
+	ti := &transformIter{Iterator: it, t: t}
+	if err := ti.decode(); err != nil {
+		it.Close()
+		return nil, errors.Trace(err)
+	}
+	return ti, nil
+}
+
+func (it *transformIter) decode() error {
+	it.value = nil
+	if !it.Iterator.Valid() {
+		return nil
+	}
+	v := it.Iterator.Value()
+	if len(v) == 0 {
+		it.value = v
+		return nil
+	}
+	var err error
+	it.value, err = it.t.Decode(v)
+	return errors.Trace(err)
+}
+
+// Value implements the Iterator Value.
+func (it *transformIter) Value() []byte {
+	return it.value
+}
+
+// Next implements the Iterator Next.
+func (it *transformIter) Next() error {
+	if err := it.Iterator.Next(); err != nil {
+		return errors.Trace(err)
+	}
+	return it.decode()
+}
@@ -90,8 +90,9 @@ func newTwoPhaseCommitter(txn *tikvTxn) (*twoPhaseCommitter, error) {
 		lockCnt int
 	)
 	mutations := make(map[string]*pb.Mutation)
-	err := txn.us.WalkBuffer(func(k kv.Key, v []byte) error {
-		if len(v) > 0 {
+	err := txn.us.WalkCommitMutations(func(op kv.Op) error {
+		k, v := op.Key, op.Value
+		if op.Tp == kv.OpSet {
 			mutations[string(k)] = &pb.Mutation{
 				Op:    pb.Op_Put,
 				Key:   k,
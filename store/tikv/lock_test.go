@@ -146,6 +146,26 @@ func (s *testLockSuite) TestScanLockResolveWithBatchGet(c *C) {
 	}
 }
 
+func (s *testLockSuite) TestScanLockResolveWithBatchExist(c *C) {
+	s.putAlphabets(c)
+	s.prepareAlphabetLocks(c)
+
+	keys := []kv.Key{kv.Key("bar"), kv.Key("foo"), kv.Key("a1")}
+	for ch := byte('a'); ch <= byte('z'); ch++ {
+		keys = append(keys, []byte{ch})
+	}
+
+	ver, err := s.store.CurrentVersion()
+	c.Assert(err, IsNil)
+	snapshot := newTiKVSnapshot(s.store, ver)
+	m, err := snapshot.BatchExist(keys)
+	c.Assert(err, IsNil)
+	c.Assert(len(m), Equals, int('z'-'a'+1))
+	for ch := byte('a'); ch <= byte('z'); ch++ {
+		c.Assert(m[string([]byte{ch})], IsTrue)
+	}
+}
+
 func (s *testLockSuite) TestCleanLock(c *C) {
 	for ch := byte('a'); ch <= byte('z'); ch++ {
 		k := []byte{ch}
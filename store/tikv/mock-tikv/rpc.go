@@ -222,6 +222,11 @@ func (h *rpcHandler) handleKvScan(req *kvrpcpb.ScanRequest) *kvrpcpb.ScanRespons
 		panic("KvScan: startKey not in region")
 	}
 	pairs := h.mvccStore.Scan(req.GetStartKey(), h.endKey, int(req.GetLimit()), req.GetVersion(), h.isolationLevel)
+	if req.GetKeyOnly() {
+		for i := range pairs {
+			pairs[i].Value = nil
+		}
+	}
 	return &kvrpcpb.ScanResponse{
 		Pairs: convertToPbPairs(pairs),
 	}
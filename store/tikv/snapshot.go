@@ -14,6 +14,8 @@
 package tikv
 
 import (
+	"bytes"
+	"sort"
 	"sync"
 	"time"
 	"unsafe"
@@ -92,7 +94,61 @@ func (s *tikvSnapshot) BatchGet(keys []kv.Key) (map[string][]byte, error) {
 	return m, nil
 }
 
+// BatchExist checks which keys exist in kv-server and returns a map contains the existing keys.
+// The keys are checked by key-only scans, so the values are not sent back.
+func (s *tikvSnapshot) BatchExist(keys []kv.Key) (map[string]bool, error) {
+	txnCmdCounter.WithLabelValues("batch_exist").Inc()
+	start := time.Now()
+	defer func() { txnCmdHistogram.WithLabelValues("batch_exist").Observe(time.Since(start).Seconds()) }()
+
+	bytesKeys := *(*[][]byte)(unsafe.Pointer(&keys))
+	bo := NewBackoffer(batchGetMaxBackoff, goctx.Background())
+
+	var mu sync.Mutex
+	m := make(map[string]bool)
+	err := s.batchExistKeysByRegions(bo, bytesKeys, func(k []byte) {
+		mu.Lock()
+		m[string(k)] = true
+		mu.Unlock()
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = s.store.CheckVisibility(s.version.Ver)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return m, nil
+}
+
+// EstimateRangeCount implements the Snapshot EstimateRangeCount interface.
+// TiKV doesn't report the approximate key count of a range yet, so it always
+// returns -1.
+func (s *tikvSnapshot) EstimateRangeCount(start, end kv.Key) (int64, error) {
+	return -1, nil
+}
+
+// Release implements the Snapshot Release interface. The connections are
+// shared by the store, so there is nothing to release.
+func (s *tikvSnapshot) Release() {}
+
 func (s *tikvSnapshot) batchGetKeysByRegions(bo *Backoffer, keys [][]byte, collectF func(k, v []byte)) error {
+	return s.batchKeysByRegions(bo, keys, batchGetSize, func(bo *Backoffer, batch batchKeys) error {
+		return s.batchGetSingleRegion(bo, batch, collectF)
+	})
+}
+
+func (s *tikvSnapshot) batchExistKeysByRegions(bo *Backoffer, keys [][]byte, collectF func(k []byte)) error {
+	return s.batchKeysByRegions(bo, keys, batchGetSize, func(bo *Backoffer, batch batchKeys) error {
+		return s.batchExistSingleRegion(bo, batch, collectF)
+	})
+}
+
+// batchKeysByRegions groups keys by regions into batches of at most limit
+// keys, and calls f with the batches concurrently.
+func (s *tikvSnapshot) batchKeysByRegions(bo *Backoffer, keys [][]byte, limit int, f func(bo *Backoffer, batch batchKeys) error) error {
 	groups, _, err := s.store.regionCache.GroupKeysByRegion(bo, keys)
 	if err != nil {
 		return errors.Trace(err)
@@ -102,14 +158,14 @@ func (s *tikvSnapshot) batchGetKeysByRegions(bo *Backoffer, keys [][]byte, colle
 
 	var batches []batchKeys
 	for id, g := range groups {
-		batches = appendBatchBySize(batches, id, g, func([]byte) int { return 1 }, batchGetSize)
+		batches = appendBatchBySize(batches, id, g, func([]byte) int { return 1 }, limit)
 	}
 
 	if len(batches) == 0 {
 		return nil
 	}
 	if len(batches) == 1 {
-		return errors.Trace(s.batchGetSingleRegion(bo, batches[0], collectF))
+		return errors.Trace(f(bo, batches[0]))
 	}
 	ch := make(chan error)
 	for _, batch1 := range batches {
@@ -117,12 +173,12 @@ func (s *tikvSnapshot) batchGetKeysByRegions(bo *Backoffer, keys [][]byte, colle
 		snapshotGP.Go(func() {
 			backoffer, cancel := bo.Fork()
 			defer cancel()
-			ch <- s.batchGetSingleRegion(backoffer, batch, collectF)
+			ch <- f(backoffer, batch)
 		})
 	}
 	for i := 0; i < len(batches); i++ {
 		if e := <-ch; e != nil {
-			log.Debugf("snapshot batchGet failed: %v, tid: %d", e, s.version.Ver)
+			log.Debugf("snapshot batch read failed: %v, tid: %d", e, s.version.Ver)
 			err = e
 		}
 	}
@@ -201,6 +257,95 @@ func (s *tikvSnapshot) batchGetSingleRegion(bo *Backoffer, batch batchKeys, coll
 	}
 }
 
+// batchExistSingleRegion checks the keys of batch by key-only scans from the
+// least pending key. A scan resolves the pending keys up to the last key it
+// returns, or all of them if it returns less than the limit, because a scan
+// doesn't cross the end of the region.
+func (s *tikvSnapshot) batchExistSingleRegion(bo *Backoffer, batch batchKeys, collectF func(k []byte)) error {
+	sender := NewRegionRequestSender(s.store.regionCache, s.store.client)
+
+	pending := append([][]byte(nil), batch.keys...)
+	sort.Slice(pending, func(i, j int) bool {
+		return bytes.Compare(pending[i], pending[j]) < 0
+	})
+	for len(pending) > 0 {
+		limit := len(pending)
+		if limit > scanBatchSize {
+			limit = scanBatchSize
+		}
+		req := &tikvrpc.Request{
+			Type: tikvrpc.CmdScan,
+			Scan: &pb.ScanRequest{
+				StartKey: pending[0],
+				Limit:    uint32(limit),
+				Version:  s.version.Ver,
+				KeyOnly:  true,
+			},
+			Context: pb.Context{
+				Priority:       s.priority,
+				IsolationLevel: pbIsolationLevel(s.isolationLevel),
+				NotFillCache:   s.notFillCache,
+			},
+		}
+		resp, err := sender.SendReq(bo, req, batch.region, ReadTimeoutMedium)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		regionErr, err := resp.GetRegionError()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if regionErr != nil {
+			err = bo.Backoff(BoRegionMiss, errors.New(regionErr.String()))
+			if err != nil {
+				return errors.Trace(err)
+			}
+			err = s.batchExistKeysByRegions(bo, pending, collectF)
+			return errors.Trace(err)
+		}
+		scanResp := resp.Scan
+		if scanResp == nil {
+			return errors.Trace(ErrBodyMissing)
+		}
+		i := 0
+		for _, pair := range scanResp.Pairs {
+			keyErr := pair.GetError()
+			if keyErr != nil {
+				lock, err := extractLockFromKeyErr(keyErr)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				pair.Key = lock.Key
+			}
+			for i < len(pending) && bytes.Compare(pending[i], pair.Key) < 0 {
+				i++
+			}
+			if i == len(pending) || !bytes.Equal(pending[i], pair.Key) {
+				continue
+			}
+			if keyErr != nil {
+				// The locked keys are read by get, which resolves the lock.
+				val, err := s.get(bo, pair.Key)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				if len(val) == 0 {
+					continue
+				}
+			}
+			collectF(pair.Key)
+		}
+		if len(scanResp.Pairs) < limit {
+			return nil
+		}
+		last := scanResp.Pairs[len(scanResp.Pairs)-1].Key
+		for len(pending) > 0 && bytes.Compare(pending[0], last) <= 0 {
+			pending = pending[1:]
+		}
+	}
+	return nil
+}
+
 // Get gets the value for key k from snapshot.
 func (s *tikvSnapshot) Get(k kv.Key) ([]byte, error) {
 	val, err := s.get(NewBackoffer(getMaxBackoff, goctx.Background()), k)
@@ -15,11 +15,15 @@ package tikv
 
 import (
 	"fmt"
+	"sync/atomic"
+	"testing"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	. "github.com/pingcap/check"
+	pb "github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/store/tikv/tikvrpc"
 	goctx "golang.org/x/net/context"
 )
 
@@ -130,6 +134,33 @@ func (s *testSnapshotSuite) TestBatchGetNotExist(c *C) {
 	}
 }
 
+func (s *testSnapshotSuite) TestBatchExist(c *C) {
+	// The keys take more than one key-only scan.
+	rowNum := scanBatchSize*2 + 10
+	txn := s.beginTxn(c)
+	for i := 0; i < rowNum; i += 2 {
+		k := encodeKey(s.prefix, s08d("key", i))
+		err := txn.Set(k, valueBytes(i))
+		c.Assert(err, IsNil)
+	}
+	err := txn.Commit(goctx.Background())
+	c.Assert(err, IsNil)
+
+	keys := makeKeys(rowNum, s.prefix)
+	txn = s.beginTxn(c)
+	snapshot := newTiKVSnapshot(s.store, kv.Version{Ver: txn.StartTS()})
+	values, err := snapshot.BatchGet(keys)
+	c.Assert(err, IsNil)
+	exists, err := snapshot.BatchExist(keys)
+	c.Assert(err, IsNil)
+	c.Assert(exists, HasLen, rowNum/2)
+	c.Assert(exists, HasLen, len(values))
+	for k := range values {
+		c.Assert(exists[k], IsTrue, Commentf("key: %q", k))
+	}
+	s.deleteKeys(keys, c)
+}
+
 func makeKeys(rowNum int, prefix string) []kv.Key {
 	keys := make([]kv.Key, 0, rowNum)
 	for i := 0; i < rowNum; i++ {
@@ -138,3 +169,90 @@ func makeKeys(rowNum int, prefix string) []kv.Key {
 	}
 	return keys
 }
+
+// payloadClient counts the bytes of the pairs sent back by the reads.
+type payloadClient struct {
+	Client
+	bytes int64
+}
+
+func (c *payloadClient) SendReq(ctx goctx.Context, addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+	resp, err := c.Client.SendReq(ctx, addr, req)
+	if err != nil {
+		return resp, err
+	}
+	var pairs []*pb.KvPair
+	if resp.BatchGet != nil {
+		pairs = resp.BatchGet.Pairs
+	} else if resp.Scan != nil {
+		pairs = resp.Scan.Pairs
+	}
+	for _, pair := range pairs {
+		atomic.AddInt64(&c.bytes, int64(pair.Size()))
+	}
+	return resp, nil
+}
+
+// BenchmarkBatchExist compares BatchGet and BatchExist on keys with 1KB
+// values, half of which exist, and logs the payload of the responses.
+func BenchmarkBatchExist(b *testing.B) {
+	client := &payloadClient{}
+	store, err := NewMockTikvStore(WithHijackClient(func(c Client) Client {
+		client.Client = c
+		return client
+	}))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	const rowNum = 1000
+	txn, err := store.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	value := make([]byte, 1024)
+	keys := make([]kv.Key, 0, rowNum)
+	for i := 0; i < rowNum; i++ {
+		k := encodeKey("bench", s08d("key", i))
+		keys = append(keys, k)
+		if i%2 == 0 {
+			if err = txn.Set(k, value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if err = txn.Commit(goctx.Background()); err != nil {
+		b.Fatal(err)
+	}
+	ver, err := store.CurrentVersion()
+	if err != nil {
+		b.Fatal(err)
+	}
+	snapshot := newTiKVSnapshot(store.(*tikvStore), ver)
+
+	run := func(name string, read func() (int, error)) {
+		b.Run(name, func(b *testing.B) {
+			atomic.StoreInt64(&client.bytes, 0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				n, err := read()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n != rowNum/2 {
+					b.Fatalf("%d keys exist, want %d", n, rowNum/2)
+				}
+			}
+			b.Logf("payload: %d bytes/op", atomic.LoadInt64(&client.bytes)/int64(b.N))
+		})
+	}
+	run("BatchGet", func() (int, error) {
+		m, err := snapshot.BatchGet(keys)
+		return len(m), err
+	})
+	run("BatchExist", func() (int, error) {
+		m, err := snapshot.BatchExist(keys)
+		return len(m), err
+	})
+}
@@ -119,6 +119,13 @@ func (txn *tikvTxn) Delete(k kv.Key) error {
 	return txn.us.Delete(k)
 }
 
+func (txn *tikvTxn) BatchDelete(keys []kv.Key) error {
+	txnCmdCounter.WithLabelValues("batch_delete").Inc()
+
+	txn.dirty = true
+	return txn.us.BatchDelete(keys)
+}
+
 func (txn *tikvTxn) SetOption(opt kv.Option, val interface{}) {
 	txn.us.SetOption(opt, val)
 	switch opt {
@@ -151,11 +158,12 @@ func (txn *tikvTxn) Commit(ctx goctx.Context) error {
 	start := time.Now()
 	defer func() { txnCmdHistogram.WithLabelValues("commit").Observe(time.Since(start).Seconds()) }()
 
-	if err := txn.us.CheckLazyConditionPairs(); err != nil {
+	var committer *twoPhaseCommitter
+	err := txn.us.PreCommitWith(func() error {
+		var err error
+		committer, err = newTwoPhaseCommitter(txn)
 		return errors.Trace(err)
-	}
-
-	committer, err := newTwoPhaseCommitter(txn)
+	})
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -174,6 +182,7 @@ func (txn *tikvTxn) Commit(ctx goctx.Context) error {
 
 func (txn *tikvTxn) close() {
 	txn.valid = false
+	txn.us.Release()
 }
 
 func (txn *tikvTxn) Rollback() error {
@@ -214,3 +223,7 @@ func (txn *tikvTxn) Len() int {
 func (txn *tikvTxn) Size() int {
 	return txn.us.Size()
 }
+
+func (txn *tikvTxn) MemUsage() int {
+	return txn.us.MemUsage()
+}